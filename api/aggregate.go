@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/blevesearch/bleve/search"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zachgoldstein/datatoapi/index"
+)
+
+// AggregateResponse holds the number of records matching an aggregation's query and the counts
+// of each facet
+type AggregateResponse struct {
+	Total  uint64              `json:"total"`
+	Facets search.FacetResults `json:"facets"`
+}
+
+// Aggregate counts the records matching an optional boolean query by the words of each field
+// in terms, e.g. /aggregate?terms=job,has_existential_identity_crisis&q=total_plumbuses:>1000
+// Used for requests of the form GET /aggregate
+func (api *API) Aggregate(w http.ResponseWriter, r *http.Request) {
+	log.Info("API Aggregating results")
+
+	query := r.URL.Query()
+	size := 0
+	if sizeParam := query.Get("size"); sizeParam != "" {
+		var err error
+		size, err = strconv.Atoi(sizeParam)
+		if err != nil || size <= 0 {
+			http.Error(w, "size should be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	request := index.AggregateRequest{Facets: map[string]index.FacetRequest{}}
+	for _, field := range splitParams(query["terms"]) {
+		request.Facets[field] = index.FacetRequest{Terms: &index.TermsFacet{Field: field, Size: size}}
+	}
+
+	var condition index.Condition = index.MatchAllCondition{}
+	if q := query.Get("q"); q != "" {
+		var err error
+		condition, err = index.ParseQuery(q)
+		if err != nil {
+			log.WithError(err).Error("Could not parse query")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	api.writeAggregate(w, r, request, condition)
+}
+
+// AggregateJSON counts the records matching a query by the facets described in the request body,
+// see index.AggregateRequest for its format.
+// Used for requests of the form POST /aggregate
+func (api *API) AggregateJSON(w http.ResponseWriter, r *http.Request) {
+	log.Info("API Aggregating results with json")
+
+	request := index.AggregateRequest{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxQueryBodySize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+	if err != nil {
+		log.WithError(err).Error("Could not parse json aggregation")
+		http.Error(w, fmt.Sprintf("Could not parse json aggregation: %s", err), http.StatusBadRequest)
+		return
+	}
+	clause := index.QueryClause{}
+	if request.Query != nil {
+		clause = *request.Query
+	}
+	condition, err := clause.Condition()
+	if err != nil {
+		log.WithError(err).Error("Could not parse json aggregation")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.writeAggregate(w, r, request, condition)
+}
+
+func (api *API) writeAggregate(w http.ResponseWriter, r *http.Request, request index.AggregateRequest, condition index.Condition) {
+	condition, err := api.indexStore.BindCondition(condition)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, err := api.indexStore.Aggregate(r.Context(), request, condition)
+	if err != nil {
+		log.WithError(err).Error("Could not aggregate index")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.WithFields(log.Fields{
+		"total": results.Total,
+	}).Info("Aggregated results")
+	writeJSON(w, AggregateResponse{
+		Total:  results.Total,
+		Facets: results.Facets,
+	})
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAggregateJSON(t *testing.T) {
+	router, cleanup := newTestRouter(t,
+		`{"id": 1, "name": "Rick Sanchez", "job": "scientist", "age": 70}`,
+		`{"id": 2, "name": "Morty Smith", "job": "student", "age": 14}`,
+		`{"id": 3, "name": "Summer Smith", "job": "student", "age": 17}`,
+		`{"id": 4, "name": "Beth Smith", "job": "surgeon", "age": 34}`,
+	)
+	defer cleanup()
+
+	tests := []struct {
+		body   string
+		status int
+		counts map[string]int
+	}{
+		{
+			body:   `{"query": {"range": {"field": "age", "gt": 17}}, "facets": {"jobs": {"terms": {"field": "job"}}}}`,
+			status: http.StatusOK,
+			counts: map[string]int{"scientist": 1, "surgeon": 1},
+		},
+		{
+			body:   `{"facets": {"ages": {"histogram": {"field": "age", "interval": 35, "min": 0, "max": 70}}}}`,
+			status: http.StatusOK,
+			counts: map[string]int{"0-35": 3, "35-70": 1},
+		},
+		{
+			body:   `{"facets": {"ages": {"terms": {"field": "age"}}}}`,
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("POST", "/aggregate", strings.NewReader(test.body)))
+		if recorder.Code != test.status {
+			t.Errorf("Aggregating %s returned status %d: %s", test.body, recorder.Code, recorder.Body.String())
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		response := AggregateResponse{}
+		err := json.Unmarshal(recorder.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatalf("Aggregating %s returned %s, which isn't an aggregation: %s", test.body, recorder.Body.String(), err)
+		}
+		counts := map[string]int{}
+		for _, facet := range response.Facets {
+			for _, term := range facet.Terms {
+				counts[term.Term] = term.Count
+			}
+			for _, numericRange := range facet.NumericRanges {
+				if numericRange.Count > 0 {
+					counts[numericRange.Name] = numericRange.Count
+				}
+			}
+		}
+		if len(counts) != len(test.counts) {
+			t.Errorf("Aggregating %s counted %v, expected %v", test.body, counts, test.counts)
+			continue
+		}
+		for name, count := range test.counts {
+			if counts[name] != count {
+				t.Errorf("Aggregating %s counted %v, expected %v", test.body, counts, test.counts)
+				break
+			}
+		}
+	}
+}
@@ -2,90 +2,205 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/blevesearch/bleve/search"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/zachgoldstein/datatoapi/index"
+	"github.com/zachgoldstein/datatoapi/models"
 	"github.com/zachgoldstein/datatoapi/storage"
 )
 
-// API starts an http server that interacts with an index store and an interface to data storage
-// in the cloud. It serves requests for specific fields
+// DefaultRequestTimeout bounds how long a request may spend in the index and storage before it is cancelled
+const DefaultRequestTimeout = 10 * time.Second
+
+// DefaultRecordLimit is the most records a lookup scanning data blocks returns unless the request sets a limit
+const DefaultRecordLimit = 1000
+
+// API interacts with an index store and an interface to data storage in the cloud
+// for a single dataset. It serves requests for specific fields
 type API struct {
-	indexStore  *index.IndexStore
-	realStorage storage.PhysicalStorer
+	Info             DatasetInfo
+	indexStore       *index.IndexStore
+	sparseIndexStore *index.SparseIndexStore
+	realStorage      storage.PhysicalStorer
+}
+
+// DatasetInfo describes a dataset served by the api
+type DatasetInfo struct {
+	Name   string        `json:"name"`
+	Format string        `json:"format"`
+	Schema models.Schema `json:"schema,omitempty"`
+	// IndexMode is full or sparse, sparse datasets can only look up their sort keys
+	IndexMode string   `json:"indexMode,omitempty"`
+	SortKeys  []string `json:"sortKeys,omitempty"`
 }
 
-// NewAPI creates an instance of API
-func NewAPI(indexStore *index.IndexStore, realStorage storage.PhysicalStorer) *API {
+// NewAPI creates an instance of API for a dataset
+func NewAPI(info DatasetInfo, indexStore *index.IndexStore, realStorage storage.PhysicalStorer) *API {
 	return &API{
+		Info:        info,
 		indexStore:  indexStore,
 		realStorage: realStorage,
 	}
 }
 
-// Start creates our http server and starts listening for requests on a port
-func (api *API) Start(port int, indexStore *index.IndexStore, physStore storage.PhysicalStorer) error {
-	r := mux.NewRouter()
-	r.HandleFunc("/search/{search}", api.Search)
-	r.HandleFunc("/{field}/{value}", api.Get)
-	r.HandleFunc("/all/{field}/{value}", api.All)
+// Routes registers the handlers for this dataset on a router
+func (api *API) Routes(r *mux.Router) {
+	if api.sparseIndexStore != nil {
+		api.sparseRoutes(r)
+		return
+	}
+	r.HandleFunc("/search/{search}", withTimeout(DefaultRequestTimeout, api.Search))
+	r.HandleFunc("/query", withTimeout(DefaultRequestTimeout, api.Query)).Methods(http.MethodGet)
+	r.HandleFunc("/query", withTimeout(DefaultRequestTimeout, api.QueryJSON)).Methods(http.MethodPost)
+	r.HandleFunc("/aggregate", withTimeout(DefaultRequestTimeout, api.Aggregate)).Methods(http.MethodGet)
+	r.HandleFunc("/aggregate", withTimeout(DefaultRequestTimeout, api.AggregateJSON)).Methods(http.MethodPost)
+	// Presence queries are under reserved names, so fields named exists or missing can still be looked up
+	r.HandleFunc("/_exists/{field}", withTimeout(DefaultRequestTimeout, api.Exists))
+	r.HandleFunc("/_missing/{field}", withTimeout(DefaultRequestTimeout, api.Missing))
+	r.HandleFunc("/{field}/{value}", withTimeout(DefaultRequestTimeout, api.Get))
+	r.HandleFunc("/all/{field}/{value}", withTimeout(DefaultRequestTimeout, api.All))
+}
+
+// withTimeout attaches a deadline to the request context. The request context is already
+// cancelled when the client disconnects, so either will abort index searches and storage reads.
+func withTimeout(timeout time.Duration, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		handler(w, r.WithContext(ctx))
+	}
+}
 
-	addr := fmt.Sprintf(":%v", port)
-	log.WithFields(log.Fields{
-		"port": addr,
-	}).Info("API Listening")
+// DefaultSearchSize is the number of hits returned by a search that doesn't set a size
+const DefaultSearchSize = 10
 
-	return http.ListenAndServe(addr, r)
+// SearchResponse is a page of search hits, ranked by how well they match
+type SearchResponse struct {
+	Total uint64      `json:"total"`
+	Hits  []SearchHit `json:"hits"`
 }
 
-// Search will return the closest json result, looking through all fields for values
-// that contain the search string.
-// It will take the closest search result, retrieve the associated data block index,
-// then use this to retrieve the chunk of raw data from cloud storage. It will search
-// this chunk for the record we're interested in, then return that in json format.
+// SearchHit is a record matching a search, with the fields that matched and fragments of them
+// with the search phrase highlighted
+type SearchHit struct {
+	ID        string              `json:"id"`
+	Score     float64             `json:"score"`
+	Fields    []string            `json:"fields"`
+	Fragments map[string][]string `json:"fragments,omitempty"`
+	Record    json.RawMessage     `json:"record"`
+}
+
+// Search returns the records containing a search phrase in any field, best matches first.
+// The size and from query parameters page through the hits, and searchFields restricts
+// the search to a comma separated list of fields.
+// It retrieves the data block of each hit from cloud storage, then reads the hit's record
+// from the block.
 func (api *API) Search(w http.ResponseWriter, r *http.Request) {
 	log.Info("API Searching for results")
 	vars := mux.Vars(r)
+	query := r.URL.Query()
+
+	textSearch := index.TextSearch{
+		Text:   vars["search"],
+		Fields: splitParams(query["searchFields"]),
+		Size:   DefaultSearchSize,
+	}
+	var err error
+	if sizeParam := query.Get("size"); sizeParam != "" {
+		textSearch.Size, err = strconv.Atoi(sizeParam)
+		if err != nil || textSearch.Size <= 0 || textSearch.Size > DefaultRecordLimit {
+			http.Error(w, fmt.Sprintf("size should be between 1 and %d", DefaultRecordLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	if fromParam := query.Get("from"); fromParam != "" {
+		textSearch.From, err = strconv.Atoi(fromParam)
+		if err != nil || textSearch.From < 0 {
+			http.Error(w, "from should be zero or a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	projection, err := projectionParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	hits, err := api.indexStore.SearchHits(vars["search"], r.URL.Query())
+	results, err := api.indexStore.SearchHits(r.Context(), textSearch)
 	if err != nil {
 		log.WithError(err).Error("Could not find index hits")
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	log.WithFields(log.Fields{
-		"hits": len(hits),
+		"hits":  len(results.Hits),
+		"total": results.Total,
 	}).Info("Retrieved hits")
 
-	blockBytes, err := api.getDataBlockBytes(w, hits[0])
-	if err != nil {
-		log.WithError(err).Error("Could not get data block bytes")
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
+	response := SearchResponse{
+		Total: results.Total,
+		Hits:  []SearchHit{},
 	}
+	blocks := map[string]*hitBlock{}
+	find := func(blockBytes []byte) ([]byte, error) {
+		return storage.SearchRecordInDataChunk(blockBytes, vars["search"])
+	}
+	for _, hit := range results.Hits {
+		record, err := api.hitRecord(r.Context(), hit, blocks, find)
+		if err != nil {
+			log.WithError(err).Error("Could not get record for hit")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		record, err = projection.Apply(record)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Hits = append(response.Hits, SearchHit{
+			ID:        hit.ID,
+			Score:     hit.Score,
+			Fields:    matchedFields(hit),
+			Fragments: recordFragments(hit),
+			Record:    record,
+		})
+	}
+	writeJSON(w, response)
+}
 
-	fullRecord, err := storage.SearchRecordInDataChunk(blockBytes, vars["search"])
-	if err != nil {
-		log.WithError(err).Error("Could not find record in data chunk")
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
+// matchedFields lists the record fields a search hit matched in
+func matchedFields(hit *search.DocumentMatch) []string {
+	fields := []string{}
+	for field := range hit.Locations {
+		if strings.HasPrefix(field, "Data.") {
+			fields = append(fields, strings.TrimPrefix(field, "Data."))
+		}
 	}
+	sort.Strings(fields)
+	return fields
+}
 
-	if !isJSON(fullRecord) {
-		err = fmt.Errorf("Retrieved record but data is malformed")
-		log.WithError(err).WithFields(log.Fields{
-			"record": fullRecord,
-		}).Error("Retrieved record but data is malformed")
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
+// recordFragments keys a search hit's highlighted fragments by record field. Fields the
+// hit didn't match in have nothing highlighted, so they're left out.
+func recordFragments(hit *search.DocumentMatch) map[string][]string {
+	fragments := map[string][]string{}
+	for field, fieldFragments := range hit.Fragments {
+		if _, matched := hit.Locations[field]; matched && strings.HasPrefix(field, "Data.") {
+			fragments[strings.TrimPrefix(field, "Data.")] = fieldFragments
+		}
 	}
-	w.Write([]byte(fullRecord))
+	return fragments
 }
 
 // Get will return the closest json result, looking a specific field for values
@@ -95,10 +210,26 @@ func (api *API) Search(w http.ResponseWriter, r *http.Request) {
 // this chunk for the record we're interested in, then return that in json format.
 func (api *API) Get(w http.ResponseWriter, r *http.Request) {
 	log.Info("API Retrieving results for field:value")
+	if api.matchLookup(w, r, 1, false) {
+		return
+	}
 
 	vars := mux.Vars(r)
+	if api.indexStore.IsBloomField(vars["field"]) {
+		records, err := api.bloomRecords(r.Context(), vars["field"], vars["value"], 1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(records) == 0 {
+			http.Error(w, fmt.Sprintf("Could not find record where '%s' == '%s'", vars["field"], vars["value"]), http.StatusNotFound)
+			return
+		}
+		writeRecord(w, r, records[0])
+		return
+	}
 
-	hits, err := api.indexStore.GetHits(vars["field"], vars["value"])
+	hits, err := api.indexStore.GetHits(r.Context(), vars["field"], vars["value"], 1)
 	if err != nil {
 		log.WithError(err).Error("Could not find index hits")
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -107,14 +238,14 @@ func (api *API) Get(w http.ResponseWriter, r *http.Request) {
 	log.WithFields(log.Fields{
 		"hits": len(hits),
 	}).Info("Retrieved hits")
-	blockBytes, err := api.getDataBlockBytes(w, hits[0])
+	blockBytes, err := api.getDataBlockBytes(r.Context(), hits[0])
 	if err != nil {
 		log.WithError(err).Error("Could not get data block bytes")
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	fullRecord, err := storage.GetRecordInDataChunk(blockBytes, vars["field"], vars["value"])
+	fullRecord, err := storage.GetRecordInDataChunk(blockBytes, vars["field"], vars["value"], api.indexStore.Comparator())
 	if err != nil {
 		log.WithError(err).Error("Could not get record in data chunk")
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -129,7 +260,7 @@ func (api *API) Get(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	w.Write([]byte(fullRecord))
+	writeRecord(w, r, fullRecord)
 }
 
 // All will return all json results, looking for a specific field for values
@@ -139,10 +270,27 @@ func (api *API) Get(w http.ResponseWriter, r *http.Request) {
 // this chunk for the record we're interested in, then return that in json format.
 func (api *API) All(w http.ResponseWriter, r *http.Request) {
 	log.Info("API Retrieving all results for field:value")
+	limit, err := recordLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if api.matchLookup(w, r, limit, true) {
+		return
+	}
 
 	vars := mux.Vars(r)
+	if api.indexStore.IsBloomField(vars["field"]) {
+		records, err := api.bloomRecords(r.Context(), vars["field"], vars["value"], limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeRecords(w, r, records)
+		return
+	}
 
-	hits, err := api.indexStore.GetHits(vars["field"], vars["value"])
+	hits, err := api.indexStore.GetHits(r.Context(), vars["field"], vars["value"], limit)
 	if err != nil {
 		log.WithError(err).Error("Could not find index hits")
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -152,31 +300,58 @@ func (api *API) All(w http.ResponseWriter, r *http.Request) {
 		"hits": len(hits),
 	}).Info("Retrieved hits")
 
+	// Several hits can point at the same block, which holds all of their records
 	records := [][]byte{}
+	fetched := map[string]bool{}
 	for _, hit := range hits {
-		blockBytes, err := api.getDataBlockBytes(w, hit)
-		if err != nil {
-			log.WithError(err).Error("Could not get data block bytes")
+		refKey, _ := hit.Fields["RefKey"].(string)
+		if fetched[refKey] {
 			continue
 		}
-		fullRecord, err := storage.GetRecordInDataChunk(blockBytes, vars["field"], vars["value"])
+		fetched[refKey] = true
+		blockBytes, err := api.getDataBlockBytes(r.Context(), hit)
 		if err != nil {
-			log.WithError(err).Error("Could not get record in data chunk")
+			log.WithError(err).Error("Could not get data block bytes")
 			continue
 		}
-		if !isJSON(fullRecord) {
-			err = fmt.Errorf("Retrieved record but data is malformed")
-			log.WithError(err).WithFields(log.Fields{
-				"record": fullRecord,
-			}).Error("Retrieved record but data is malformed")
-			continue
+		for _, fullRecord := range storage.GetRecordsInDataChunk(blockBytes, vars["field"], vars["value"], api.indexStore.Comparator()) {
+			if !isJSON(fullRecord) {
+				log.WithFields(log.Fields{
+					"record": string(fullRecord),
+				}).Error("Retrieved record but data is malformed")
+				continue
+			}
+			records = append(records, fullRecord)
+		}
+		if len(records) >= limit {
+			records = records[:limit]
+			break
 		}
-		records = append(records, fullRecord)
 	}
 	log.WithFields(log.Fields{
 		"hits": len(records),
 	}).Info("Combing records")
+	writeRecords(w, r, records)
+}
+
+// writeRecord writes a raw json record, projected by the request's fields and exclude parameters
+func writeRecord(w http.ResponseWriter, r *http.Request, record []byte) {
+	records, err := projectRecords(r, [][]byte{record})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write(records[0])
+}
 
+// writeRecords writes raw json records as a json array, projected by the request's fields and
+// exclude parameters
+func writeRecords(w http.ResponseWriter, r *http.Request, records [][]byte) {
+	records, err := projectRecords(r, records)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	combinedRecords := bytes.Join(records, []byte(`,`))
 
 	// insert '[' to the front
@@ -190,7 +365,23 @@ func (api *API) All(w http.ResponseWriter, r *http.Request) {
 	w.Write(combinedRecords)
 }
 
-func (api *API) getDataBlockBytes(w http.ResponseWriter, hit *search.DocumentMatch) ([]byte, error) {
+// projectRecords applies the request's projection to each record
+func projectRecords(r *http.Request, records [][]byte) ([][]byte, error) {
+	projection, err := projectionParams(r)
+	if err != nil || projection.Empty() {
+		return records, err
+	}
+	projected := make([][]byte, len(records))
+	for i, record := range records {
+		projected[i], err = projection.Apply(record)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return projected, nil
+}
+
+func (api *API) getDataBlockBytes(ctx context.Context, hit *search.DocumentMatch) ([]byte, error) {
 	// Get the chunk of data containing the record we're interested in
 	_, ok := hit.Fields["RefKey"]
 	if !ok {
@@ -201,13 +392,13 @@ func (api *API) getDataBlockBytes(w http.ResponseWriter, hit *search.DocumentMat
 		return nil, err
 	}
 	refKey := hit.Fields["RefKey"].(string)
-	dataBlock, err := api.indexStore.GetDataBlock(refKey)
+	dataBlock, err := api.indexStore.GetDataBlock(ctx, refKey)
 	if err != nil {
 		log.WithError(err).Error("Could not get data block")
 		return nil, err
 	}
 
-	blockBytes, err := api.realStorage.RetrieveDataBlockBytes(dataBlock)
+	blockBytes, err := api.realStorage.RetrieveDataBlockBytes(ctx, dataBlock)
 	if err != nil {
 		log.WithError(err).Error("Could not retrieve data block bytes")
 		return nil, err
@@ -215,6 +406,19 @@ func (api *API) getDataBlockBytes(w http.ResponseWriter, hit *search.DocumentMat
 	return blockBytes, nil
 }
 
+// recordLimit reads the limit query parameter, defaulting to DefaultRecordLimit
+func recordLimit(r *http.Request) (int, error) {
+	limitParam := r.URL.Query().Get("limit")
+	if limitParam == "" {
+		return DefaultRecordLimit, nil
+	}
+	limit, err := strconv.Atoi(limitParam)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("limit should be a positive number")
+	}
+	return limit, nil
+}
+
 func isJSON(str []byte) bool {
 	var js json.RawMessage
 	return json.Unmarshal(str, &js) == nil
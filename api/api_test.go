@@ -0,0 +1,156 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/zachgoldstein/datatoapi/index"
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+// newTestRouter indexes records in a temporary local dataset, returning a router serving its api
+// and a function removing it
+func newTestRouter(t *testing.T, records ...string) (*mux.Router, func()) {
+	dir, err := ioutil.TempDir("", "datatoapi-api")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	dataPath := filepath.Join(dir, "data.jsonfiles")
+	err = ioutil.WriteFile(dataPath, []byte(strings.Join(records, "\n")+"\n"), 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Could not write test data: %s", err)
+	}
+
+	realStorage := storage.NewLocalFS()
+	err = realStorage.Start(context.Background(), dataPath, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Could not start storage: %s", err)
+	}
+	indexStore := index.NewIndexStore(realStorage, nil, nil, storage.DefaultComparator)
+	err = indexStore.Start(context.Background(), filepath.Join(dir, "indexes"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Could not index test data: %s", err)
+	}
+	router := mux.NewRouter()
+	NewAPI(DatasetInfo{Name: "test"}, indexStore, realStorage).Routes(router)
+	return router, func() {
+		indexStore.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// getJSON requests a url from a router, decoding the response into value if it succeeded
+func getJSON(t *testing.T, router *mux.Router, url string, value interface{}) int {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", url, nil))
+	if recorder.Code == http.StatusOK && value != nil {
+		err := json.Unmarshal(recorder.Body.Bytes(), value)
+		if err != nil {
+			t.Fatalf("%s returned %s, which isn't json: %s", url, recorder.Body.String(), err)
+		}
+	}
+	return recorder.Code
+}
+
+func TestWithTimeout(t *testing.T) {
+	var deadline time.Time
+	handler := withTimeout(DefaultRequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ = r.Context().Deadline()
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if remaining := time.Until(deadline); remaining <= 0 || remaining > DefaultRequestTimeout {
+		t.Errorf("Request deadline was %s away, expected at most %s", remaining, DefaultRequestTimeout)
+	}
+
+	var err error
+	handler = withTimeout(10*time.Millisecond, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			err = r.Context().Err()
+		case <-time.After(time.Second):
+		}
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Slow handler saw %v, expected %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	router, cleanup := newTestRouter(t,
+		`{"id": 1, "name": "Rick Sanchez", "bio": "Rick is a scientist"}`,
+		`{"id": 2, "name": "Morty Smith", "bio": "Morty goes on adventures with Rick"}`,
+		`{"id": 3, "name": "Summer Smith", "bio": "Summer is an intern"}`,
+	)
+	defer cleanup()
+
+	response := SearchResponse{}
+	if status := getJSON(t, router, "/search/rick", &response); status != http.StatusOK {
+		t.Fatalf("Searching returned status %d", status)
+	}
+	if response.Total != 2 || len(response.Hits) != 2 {
+		t.Fatalf("Search for rick found %d of %d hits, expected 2 of 2", len(response.Hits), response.Total)
+	}
+	if response.Hits[0].Score < response.Hits[1].Score || response.Hits[1].Score <= 0 {
+		t.Errorf("Hits should be scored and ranked best first, got scores %g and %g", response.Hits[0].Score, response.Hits[1].Score)
+	}
+	for _, hit := range response.Hits {
+		record := map[string]interface{}{}
+		err := json.Unmarshal(hit.Record, &record)
+		if err != nil || !strings.Contains(record["bio"].(string), "Rick") {
+			t.Errorf("Hit %s has record %s, expected a record mentioning Rick", hit.ID, hit.Record)
+		}
+		if len(hit.Fields) == 0 {
+			t.Errorf("Hit %s didn't list the fields it matched", hit.ID)
+		}
+		for _, field := range hit.Fields {
+			if len(hit.Fragments[field]) == 0 || !strings.Contains(hit.Fragments[field][0], "<mark>Rick</mark>") {
+				t.Errorf("Hit %s has fragments %v for %s, expected Rick highlighted", hit.ID, hit.Fragments[field], field)
+			}
+		}
+	}
+
+	response = SearchResponse{}
+	getJSON(t, router, "/search/rick?searchFields=name", &response)
+	if response.Total != 1 || len(response.Hits) != 1 {
+		t.Fatalf("Search for rick in names found %d of %d hits, expected 1 of 1", len(response.Hits), response.Total)
+	}
+	if hit := response.Hits[0]; len(hit.Fields) != 1 || hit.Fields[0] != "name" || len(hit.Fragments) != 1 {
+		t.Errorf("Search in names matched fields %v with fragments %v, expected only name", hit.Fields, hit.Fragments)
+	}
+
+	records := []string{}
+	for from := 0; from < 3; from++ {
+		response = SearchResponse{}
+		getJSON(t, router, "/search/smith?size=1&from="+strconv.Itoa(from), &response)
+		if response.Total != 2 {
+			t.Errorf("Search for smith from %d found %d total hits, expected 2", from, response.Total)
+		}
+		for _, hit := range response.Hits {
+			records = append(records, string(hit.Record))
+		}
+	}
+	if len(records) != 2 || records[0] == records[1] {
+		t.Errorf("Paging through smith one hit at a time returned %q, expected two different records", records)
+	}
+
+	for _, url := range []string{"/search/rick?size=0", "/search/rick?size=many", "/search/rick?from=-1"} {
+		if status := getJSON(t, router, url, nil); status != http.StatusBadRequest {
+			t.Errorf("%s returned status %d, expected %d", url, status, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+// bloomRecords fetches every block whose bloom filter may hold a field's value, returning up to
+// limit matching records. Blocks that turn out not to hold the value are false positives.
+func (api *API) bloomRecords(ctx context.Context, field, value string, limit int) ([][]byte, error) {
+	blocks, err := api.indexStore.BloomBlocks(field, value)
+	if err != nil {
+		log.WithError(err).Error("Could not find bloom filter blocks")
+		return nil, err
+	}
+
+	records := [][]byte{}
+	falsePositives := 0
+	for i := range blocks {
+		blockBytes, err := api.realStorage.RetrieveDataBlockBytes(ctx, &blocks[i])
+		if err != nil {
+			log.WithError(err).Error("Could not retrieve data block bytes")
+			return nil, err
+		}
+		blockRecords := storage.GetRecordsInDataChunk(blockBytes, field, value, api.indexStore.Comparator())
+		if len(blockRecords) == 0 {
+			falsePositives++
+		}
+		records = append(records, blockRecords...)
+		if len(records) >= limit {
+			records = records[:limit]
+			break
+		}
+	}
+	log.WithFields(log.Fields{
+		"field":          field,
+		"records":        len(records),
+		"falsePositives": falsePositives,
+	}).Info("Retrieved records with bloom filters")
+	return records, nil
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zachgoldstein/datatoapi/index"
+)
+
+// matchParams reads the match mode and fuzziness query parameters, defaulting to exact matches
+// and index.DefaultFuzziness
+func matchParams(r *http.Request) (string, int, error) {
+	query := r.URL.Query()
+	mode := query.Get("match")
+	if mode == "" {
+		mode = index.MatchExact
+	}
+	fuzziness := index.DefaultFuzziness
+	if fuzzinessParam := query.Get("fuzziness"); fuzzinessParam != "" {
+		var err error
+		fuzziness, err = strconv.Atoi(fuzzinessParam)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	return mode, fuzziness, nil
+}
+
+// matchLookup serves /{field}/{value} and /all/{field}/{value} for the match modes other than
+// exact, returning true if it handled the request. All requests get an array of records, others
+// the first record.
+func (api *API) matchLookup(w http.ResponseWriter, r *http.Request, limit int, all bool) bool {
+	mode, fuzziness, err := matchParams(r)
+	if err != nil {
+		http.Error(w, "fuzziness should be a number", http.StatusBadRequest)
+		return true
+	}
+	if mode == index.MatchExact {
+		return false
+	}
+	vars := mux.Vars(r)
+	records, status, err := api.matchRecords(r.Context(), vars["field"], vars["value"], mode, fuzziness, limit)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return true
+	}
+	if !all {
+		if len(records) == 0 {
+			http.Error(w, "No records found", http.StatusNotFound)
+			return true
+		}
+		writeRecord(w, r, records[0])
+		return true
+	}
+	writeRecords(w, r, records)
+	return true
+}
+
+// matchRecords returns up to limit records where a field matches a value with a match mode
+func (api *API) matchRecords(ctx context.Context, field, value, mode string, fuzziness, limit int) ([][]byte, int, error) {
+	condition, err := index.MatchCondition(field, value, mode, fuzziness)
+	if err == nil {
+		condition, err = api.indexStore.BindCondition(condition)
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	hits, err := api.indexStore.QueryHits(ctx, condition, limit)
+	if err != nil {
+		log.WithError(err).Error("Could not find index hits")
+		return nil, http.StatusBadRequest, err
+	}
+	log.WithFields(log.Fields{
+		"hits":  len(hits),
+		"match": mode,
+	}).Info("Retrieved hits")
+	records, err := api.conditionRecords(ctx, hits, condition, limit)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return records, http.StatusOK, nil
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMatchModes(t *testing.T) {
+	router, cleanup := newTestRouter(t,
+		`{"id": 1, "name": "Rick Sanchez"}`,
+		`{"id": 2, "name": "Morty Smith"}`,
+		`{"id": 3, "name": "Summer Smith"}`,
+	)
+	defer cleanup()
+
+	tests := []struct {
+		url      string
+		status   int
+		expected []string
+	}{
+		{url: "/all/name/smi?match=prefix", status: http.StatusOK, expected: []string{"Morty Smith", "Summer Smith"}},
+		{url: "/name/sanc?match=prefix", status: http.StatusOK, expected: []string{"Rick Sanchez"}},
+		{url: "/all/name/sanc?match=prefix&limit=1", status: http.StatusOK, expected: []string{"Rick Sanchez"}},
+		{url: "/name/sanc", status: http.StatusNotFound},
+		{url: "/all/name/smyth?match=fuzzy", status: http.StatusOK, expected: []string{"Morty Smith", "Summer Smith"}},
+		{url: "/all/name/smiht?match=fuzzy&fuzziness=2", status: http.StatusOK, expected: []string{"Morty Smith", "Summer Smith"}},
+		{url: "/all/name/smiht?match=fuzzy&fuzziness=3", status: http.StatusOK, expected: []string{"Morty Smith", "Summer Smith"}},
+		{url: "/name/smyth?match=fuzzy&fuzziness=0", status: http.StatusNotFound},
+		{url: "/all/name/sm%3Fth?match=wildcard", status: http.StatusOK, expected: []string{"Morty Smith", "Summer Smith"}},
+		{url: "/all/name/*ort*?match=wildcard", status: http.StatusOK, expected: []string{"Morty Smith"}},
+		{url: "/all/name/s.*?match=regexp", status: http.StatusOK, expected: []string{"Morty Smith", "Rick Sanchez", "Summer Smith"}},
+		{url: "/all/name/r[aeiou]ck?match=regexp", status: http.StatusOK, expected: []string{"Rick Sanchez"}},
+		{url: "/all/name/(?match=regexp", status: http.StatusBadRequest},
+		{url: "/name/rick?match=sounds-like", status: http.StatusBadRequest},
+		{url: "/name/rick?match=fuzzy&fuzziness=some", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		records := []map[string]interface{}{}
+		var status int
+		if strings.HasPrefix(test.url, "/all/") {
+			status = getJSON(t, router, test.url, &records)
+		} else {
+			record := map[string]interface{}{}
+			status = getJSON(t, router, test.url, &record)
+			records = append(records, record)
+		}
+		if status != test.status {
+			t.Errorf("%s returned status %d, expected %d", test.url, status, test.status)
+			continue
+		}
+		if test.expected == nil {
+			continue
+		}
+		names := []string{}
+		for _, record := range records {
+			names = append(names, record["name"].(string))
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%s returned %q, expected %q", test.url, names, test.expected)
+		}
+	}
+}
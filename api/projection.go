@@ -0,0 +1,160 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+// Projection trims records down before they're returned, keeping only the fields asked for
+// and then dropping excluded ones. Fields are dotted paths into nested objects, e.g.
+// address.city, and paths through arrays apply to each of their elements.
+type Projection struct {
+	fields  *pathNode
+	exclude *pathNode
+}
+
+// pathNode is a tree of field paths sharing their prefixes. A leaf covers the whole value.
+type pathNode struct {
+	leaf     bool
+	children map[string]*pathNode
+}
+
+// NewProjection creates a projection keeping fields and dropping exclude, either can be empty
+func NewProjection(fields, exclude []string) (*Projection, error) {
+	projection := &Projection{}
+	var err error
+	if len(fields) > 0 {
+		projection.fields, err = newPathTree(fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(exclude) > 0 {
+		projection.exclude, err = newPathTree(exclude)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return projection, nil
+}
+
+// projectionParams reads a projection from the fields and exclude query parameters, which hold
+// comma separated paths and may be repeated
+func projectionParams(r *http.Request) (*Projection, error) {
+	query := r.URL.Query()
+	return NewProjection(splitParams(query["fields"]), splitParams(query["exclude"]))
+}
+
+func splitParams(values []string) []string {
+	params := []string{}
+	for _, value := range values {
+		for _, param := range strings.Split(value, ",") {
+			param = strings.TrimSpace(param)
+			if param != "" {
+				params = append(params, param)
+			}
+		}
+	}
+	return params
+}
+
+func newPathTree(paths []string) (*pathNode, error) {
+	root := &pathNode{children: map[string]*pathNode{}}
+	for _, path := range paths {
+		node := root
+		// Arrays can be marked like in queries, e.g. friends[].name
+		for _, name := range storage.FieldPath(path) {
+			if name == "" {
+				return nil, fmt.Errorf("Field path '%s' has an empty field name", path)
+			}
+			if node.children[name] == nil {
+				node.children[name] = &pathNode{children: map[string]*pathNode{}}
+			}
+			node = node.children[name]
+		}
+		node.leaf = true
+	}
+	return root, nil
+}
+
+// Empty returns true if the projection leaves records unchanged
+func (p *Projection) Empty() bool {
+	return p == nil || (p.fields == nil && p.exclude == nil)
+}
+
+// Apply projects a raw json record. Records are returned untouched when the projection is empty.
+func (p *Projection) Apply(rawRecord []byte) ([]byte, error) {
+	if p.Empty() {
+		return rawRecord, nil
+	}
+	// Numbers are kept as written, large ids would lose precision as float64s
+	decoder := json.NewDecoder(bytes.NewReader(rawRecord))
+	decoder.UseNumber()
+	var record interface{}
+	err := decoder.Decode(&record)
+	if err != nil {
+		return nil, err
+	}
+	if p.fields != nil {
+		record, _ = keepPaths(record, p.fields)
+	}
+	if p.exclude != nil {
+		dropPaths(record, p.exclude)
+	}
+	return json.Marshal(record)
+}
+
+// keepPaths copies the parts of value covered by node, returning false if there are none
+func keepPaths(value interface{}, node *pathNode) (interface{}, bool) {
+	if node.leaf {
+		return value, true
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		kept := map[string]interface{}{}
+		for name, child := range node.children {
+			childValue, ok := value[name]
+			if !ok {
+				continue
+			}
+			if childValue, ok = keepPaths(childValue, child); ok {
+				kept[name] = childValue
+			}
+		}
+		return kept, true
+	case []interface{}:
+		kept := []interface{}{}
+		for _, element := range value {
+			if element, ok := keepPaths(element, node); ok {
+				kept = append(kept, element)
+			}
+		}
+		return kept, true
+	}
+	return nil, false
+}
+
+// dropPaths removes the parts of value covered by node's leaves
+func dropPaths(value interface{}, node *pathNode) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, child := range node.children {
+			if child.leaf {
+				delete(value, name)
+				continue
+			}
+			if childValue, ok := value[name]; ok {
+				dropPaths(childValue, child)
+			}
+		}
+	case []interface{}:
+		for _, element := range value {
+			dropPaths(element, node)
+		}
+	}
+}
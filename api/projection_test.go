@@ -0,0 +1,135 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+const projectionRecord = `{"id": 12345678901234567890, "name": "Rick", "address": {"city": "Seattle", "zip": "98101"},` +
+	` "friends": [{"name": "Morty", "age": 14}, {"name": "Summer"}, "Birdperson"], "tags": ["a", "b"]}`
+
+func TestProjectionApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   []string
+		exclude  []string
+		expected string
+	}{
+		{
+			name:     "empty",
+			expected: projectionRecord,
+		},
+		{
+			name:     "fields",
+			fields:   []string{"id", "name"},
+			expected: `{"id":12345678901234567890,"name":"Rick"}`,
+		},
+		{
+			name:     "nested field",
+			fields:   []string{"address.city"},
+			expected: `{"address":{"city":"Seattle"}}`,
+		},
+		{
+			name:     "field and nested field",
+			fields:   []string{"address", "address.city"},
+			expected: `{"address":{"city":"Seattle","zip":"98101"}}`,
+		},
+		{
+			name:     "array elements",
+			fields:   []string{"friends.name"},
+			expected: `{"friends":[{"name":"Morty"},{"name":"Summer"}]}`,
+		},
+		{
+			name:     "marked array elements",
+			fields:   []string{"friends[].name", "tags[]"},
+			expected: `{"friends":[{"name":"Morty"},{"name":"Summer"}],"tags":["a","b"]}`,
+		},
+		{
+			name:     "missing field",
+			fields:   []string{"job", "address.country"},
+			expected: `{"address":{}}`,
+		},
+		{
+			name:     "path through a value",
+			fields:   []string{"name.first"},
+			expected: `{}`,
+		},
+		{
+			name:     "exclude",
+			exclude:  []string{"address.zip", "tags"},
+			expected: `{"address":{"city":"Seattle"},"friends":[{"age":14,"name":"Morty"},{"name":"Summer"},"Birdperson"],"id":12345678901234567890,"name":"Rick"}`,
+		},
+		{
+			name:     "exclude from array elements",
+			fields:   []string{"friends"},
+			exclude:  []string{"friends.age"},
+			expected: `{"friends":[{"name":"Morty"},{"name":"Summer"},"Birdperson"]}`,
+		},
+		{
+			name:     "exclude a kept field",
+			fields:   []string{"id", "name"},
+			exclude:  []string{"name"},
+			expected: `{"id":12345678901234567890}`,
+		},
+	}
+	for _, test := range tests {
+		projection, err := NewProjection(test.fields, test.exclude)
+		if err != nil {
+			t.Errorf("%s: could not create projection: %s", test.name, err)
+			continue
+		}
+		projected, err := projection.Apply([]byte(projectionRecord))
+		if err != nil {
+			t.Errorf("%s: could not apply projection: %s", test.name, err)
+			continue
+		}
+		if string(projected) != test.expected {
+			t.Errorf("%s: projected %s, expected %s", test.name, projected, test.expected)
+		}
+	}
+}
+
+func TestNewProjectionErrors(t *testing.T) {
+	tests := []struct {
+		fields  []string
+		exclude []string
+	}{
+		{fields: []string{"address."}},
+		{fields: []string{".city"}},
+		{exclude: []string{"address..city"}},
+		{fields: []string{"[].name"}},
+	}
+	for _, test := range tests {
+		_, err := NewProjection(test.fields, test.exclude)
+		if err == nil {
+			t.Errorf("NewProjection(%q, %q) expected an error", test.fields, test.exclude)
+		}
+	}
+}
+
+func TestProjectionParams(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{url: "/all", expected: projectionRecord},
+		{url: "/all?fields=id,name", expected: `{"id":12345678901234567890,"name":"Rick"}`},
+		{url: "/all?fields=id&fields=+address.city+,", expected: `{"address":{"city":"Seattle"},"id":12345678901234567890}`},
+		{url: "/all?fields=address&exclude=address.zip", expected: `{"address":{"city":"Seattle"}}`},
+	}
+	for _, test := range tests {
+		projection, err := projectionParams(httptest.NewRequest("GET", test.url, nil))
+		if err != nil {
+			t.Errorf("%s: could not read projection: %s", test.url, err)
+			continue
+		}
+		projected, err := projection.Apply([]byte(projectionRecord))
+		if err != nil {
+			t.Errorf("%s: could not apply projection: %s", test.url, err)
+			continue
+		}
+		if string(projected) != test.expected {
+			t.Errorf("%s: projected %s, expected %s", test.url, projected, test.expected)
+		}
+	}
+}
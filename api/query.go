@@ -0,0 +1,268 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/blevesearch/bleve/search"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zachgoldstein/datatoapi/index"
+	"github.com/zachgoldstein/datatoapi/models"
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+// Query returns the records matching a boolean query across fields, e.g.
+// /query?q=has_existential_identity_crisis:true AND total_plumbuses:>1000
+// See index.ParseQuery for the query syntax.
+func (api *API) Query(w http.ResponseWriter, r *http.Request) {
+	log.Info("API Querying for results")
+
+	limit, err := recordLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	condition, err := index.ParseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		log.WithError(err).Error("Could not parse query")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.writeConditionRecords(w, r, condition, limit)
+}
+
+// Exists returns the records holding a value other than null in a field.
+// Used for requests of the form /_exists/{field}
+func (api *API) Exists(w http.ResponseWriter, r *http.Request) {
+	log.Info("API Retrieving records with field")
+	limit, err := recordLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.writeConditionRecords(w, r, index.ExistsCondition{Field: mux.Vars(r)["field"]}, limit)
+}
+
+// Missing returns the records where a field is absent or null.
+// Used for requests of the form /_missing/{field}
+func (api *API) Missing(w http.ResponseWriter, r *http.Request) {
+	log.Info("API Retrieving records without field")
+	limit, err := recordLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.writeConditionRecords(w, r, index.MissingCondition{Field: mux.Vars(r)["field"]}, limit)
+}
+
+// writeConditionRecords writes up to limit records matching a condition
+func (api *API) writeConditionRecords(w http.ResponseWriter, r *http.Request, condition index.Condition, limit int) {
+	condition, err := api.indexStore.BindCondition(condition)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hits, err := api.indexStore.QueryHits(r.Context(), condition, limit)
+	if err != nil {
+		log.WithError(err).Error("Could not find index hits")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.WithFields(log.Fields{
+		"hits": len(hits),
+	}).Info("Retrieved hits")
+
+	records, err := api.conditionRecords(r.Context(), hits, condition, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeRecords(w, r, records)
+}
+
+// conditionRecords fetches the data block of each hit once, returning up to limit records in
+// those blocks that match the condition
+func (api *API) conditionRecords(ctx context.Context, hits search.DocumentMatchCollection, condition index.Condition, limit int) ([][]byte, error) {
+	records := [][]byte{}
+	fetched := map[string]bool{}
+	for _, hit := range hits {
+		refKey, ok := hit.Fields["RefKey"].(string)
+		if !ok || fetched[refKey] {
+			continue
+		}
+		fetched[refKey] = true
+
+		blockBytes, err := api.getDataBlockBytes(ctx, hit)
+		if err != nil {
+			log.WithError(err).Error("Could not get data block bytes")
+			return nil, err
+		}
+		records = append(records, storage.FilterRecordsInDataChunk(blockBytes, condition.Match)...)
+		if len(records) >= limit {
+			return records[:limit], nil
+		}
+	}
+	return records, nil
+}
+
+// MaxQueryBodySize bounds the size of a json query
+const MaxQueryBodySize = 1024 * 1024
+
+// QueryResponse is a page of hits returned for a json query
+type QueryResponse struct {
+	// Total counts the search index's hits, less those on this page whose records didn't match
+	// the query. Hits on later pages are only checked once they're fetched.
+	Total uint64     `json:"total"`
+	Hits  []QueryHit `json:"hits"`
+	// Cursor fetches the next page when sent with the same query, it's empty on the last page
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// QueryHit is a record matching a json query
+type QueryHit struct {
+	ID     string          `json:"id"`
+	Score  float64         `json:"score"`
+	Record json.RawMessage `json:"record"`
+}
+
+// QueryJSON returns a page of records matching a query described in the request body,
+// see index.QueryRequest for its format.
+// Used for requests of the form POST /query
+func (api *API) QueryJSON(w http.ResponseWriter, r *http.Request) {
+	log.Info("API Querying for results with json")
+
+	request := index.QueryRequest{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxQueryBodySize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+	if err != nil {
+		log.WithError(err).Error("Could not parse json query")
+		http.Error(w, fmt.Sprintf("Could not parse json query: %s", err), http.StatusBadRequest)
+		return
+	}
+	if request.Size < 0 || request.Size > DefaultRecordLimit {
+		http.Error(w, fmt.Sprintf("size should be between 1 and %d, or 0 for %d", DefaultRecordLimit, index.DefaultQuerySize), http.StatusBadRequest)
+		return
+	}
+	projection, err := NewProjection(request.Fields, request.Exclude)
+	if err == nil && projection.Empty() {
+		projection, err = projectionParams(r)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clause := index.QueryClause{}
+	if request.Query != nil {
+		clause = *request.Query
+	}
+	condition, err := clause.Condition()
+	if err == nil {
+		condition, err = api.indexStore.BindCondition(condition)
+	}
+	if err != nil {
+		log.WithError(err).Error("Could not parse json query")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results, cursor, err := api.indexStore.SearchQuery(r.Context(), request, condition)
+	if err != nil {
+		log.WithError(err).Error("Could not find index hits")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.WithFields(log.Fields{
+		"hits":  len(results.Hits),
+		"total": results.Total,
+	}).Info("Retrieved hits")
+
+	response := QueryResponse{
+		Total:  results.Total,
+		Hits:   []QueryHit{},
+		Cursor: cursor,
+	}
+	blocks := map[string]*hitBlock{}
+	for _, hit := range results.Hits {
+		record, err := api.hitRecord(r.Context(), hit, blocks, conditionFinder(condition))
+		if err != nil {
+			log.WithError(err).Error("Could not get record for hit")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The search index can match more than the condition, e.g. ignoring stop words, so
+		// hits are checked against their records. The cursor still moves past them.
+		if !recordMatchesCondition(record, condition) {
+			response.Total--
+			continue
+		}
+		record, err = projection.Apply(record)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Hits = append(response.Hits, QueryHit{
+			ID:     hit.ID,
+			Score:  hit.Score,
+			Record: record,
+		})
+	}
+	writeJSON(w, response)
+}
+
+// hitBlock is a data block fetched for the hits of a request, along with its contents
+type hitBlock struct {
+	block *models.DataBlock
+	bytes []byte
+}
+
+// hitRecord retrieves the record a search hit was indexed from. Hits are grouped by the data
+// block holding them in blocks, so each block is looked up and fetched once per request.
+// Hits indexed before record offsets were stored fall back to finding the record in its
+// block with find.
+func (api *API) hitRecord(ctx context.Context, hit *search.DocumentMatch, blocks map[string]*hitBlock, find func(blockBytes []byte) ([]byte, error)) ([]byte, error) {
+	refKey, ok := hit.Fields["RefKey"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Could not find refKey in search hit %s", hit.ID)
+	}
+	fetched, ok := blocks[refKey]
+	if !ok {
+		dataBlock, err := api.indexStore.GetDataBlock(ctx, refKey)
+		if err != nil {
+			return nil, err
+		}
+		blockBytes, err := api.realStorage.RetrieveDataBlockBytes(ctx, dataBlock)
+		if err != nil {
+			return nil, err
+		}
+		fetched = &hitBlock{block: dataBlock, bytes: blockBytes}
+		blocks[refKey] = fetched
+	}
+
+	if offset, ok := hit.Fields["Offset"].(float64); ok {
+		return storage.GetRecordAtOffset(fetched.bytes, fetched.block, int64(offset))
+	}
+	return find(fetched.bytes)
+}
+
+// recordMatchesCondition returns true if a raw json record matches a condition
+func recordMatchesCondition(record []byte, condition index.Condition) bool {
+	var decoded map[string]interface{}
+	err := json.Unmarshal(record, &decoded)
+	return err == nil && condition.Match(decoded)
+}
+
+// conditionFinder finds the first record in a block matching a condition
+func conditionFinder(condition index.Condition) func(blockBytes []byte) ([]byte, error) {
+	return func(blockBytes []byte) ([]byte, error) {
+		records := storage.FilterRecordsInDataChunk(blockBytes, condition.Match)
+		if len(records) == 0 {
+			return nil, fmt.Errorf("Could not find a record matching the query in its data block")
+		}
+		return records[0], nil
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// postQuery posts a json query to a router, returning its response
+func postQuery(t *testing.T, router *mux.Router, body string) QueryResponse {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("POST", "/query", strings.NewReader(body)))
+	response := QueryResponse{}
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Query %s returned status %d: %s", body, recorder.Code, recorder.Body.String())
+	}
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("Query %s returned %s, which isn't a query response: %s", body, recorder.Body.String(), err)
+	}
+	return response
+}
+
+// hitNames returns the name field of each hit's record
+func hitNames(hits []QueryHit) []string {
+	names := []string{}
+	for _, hit := range hits {
+		record := map[string]interface{}{}
+		json.Unmarshal(hit.Record, &record)
+		name, _ := record["name"].(string)
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestQueryJSONChecksRecords(t *testing.T) {
+	router, cleanup := newTestRouter(t,
+		`{"id": 1, "name": "Rick Sanchez"}`,
+		`{"id": 2, "name": "The Evil Rick"}`,
+		`{"id": 3, "name": "Morty Smith"}`,
+	)
+	defer cleanup()
+
+	// The search index drops the stop word, so it finds every Rick
+	query := `"query": {"term": {"field": "name", "value": "the rick"}}`
+	response := postQuery(t, router, "{"+query+"}")
+	if names := hitNames(response.Hits); response.Total != 1 || !reflect.DeepEqual(names, []string{"The Evil Rick"}) {
+		t.Errorf("Query returned %q with a total of %d, expected only The Evil Rick", names, response.Total)
+	}
+
+	names := []string{}
+	body := "{" + query + `, "size": 1}`
+	for page := 0; page < 3; page++ {
+		response := postQuery(t, router, body)
+		names = append(names, hitNames(response.Hits)...)
+		if response.Cursor == "" {
+			break
+		}
+		body = "{" + query + `, "size": 1, "cursor": "` + response.Cursor + `"}`
+	}
+	if !reflect.DeepEqual(names, []string{"The Evil Rick"}) {
+		t.Errorf("Paging through the query returned %q, expected only The Evil Rick", names)
+	}
+}
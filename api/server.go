@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// ShutdownTimeout bounds how long we wait for in-flight requests to drain on shutdown
+const ShutdownTimeout = 15 * time.Second
+
+// Server starts an http server for one or more datasets. Each dataset is mounted under
+// /datasets/{name}, and a default dataset can also be served from the root.
+type Server struct {
+	datasets   []*API
+	defaultAPI *API
+}
+
+// NewServer creates an instance of Server
+func NewServer() *Server {
+	return &Server{
+		datasets: []*API{},
+	}
+}
+
+// AddDataset mounts a dataset's api under /datasets/{name}
+func (s *Server) AddDataset(api *API) {
+	s.datasets = append(s.datasets, api)
+}
+
+// SetDefault also serves a dataset's api from the root, e.g. /{field}/{value}
+func (s *Server) SetDefault(api *API) {
+	s.defaultAPI = api
+}
+
+// Router builds the router for all datasets. Dataset routes are registered before the
+// default dataset's so /datasets/... is never mistaken for a /{field}/{value} lookup.
+func (s *Server) Router() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/datasets", s.ListDatasets)
+	for _, api := range s.datasets {
+		r.HandleFunc(fmt.Sprintf("/datasets/%s", api.Info.Name), s.datasetInfoHandler(api))
+		api.Routes(r.PathPrefix(fmt.Sprintf("/datasets/%s", api.Info.Name)).Subrouter())
+	}
+	if s.defaultAPI != nil {
+		s.defaultAPI.Routes(r)
+	}
+	return r
+}
+
+// Start creates our http server and starts listening for requests on a port.
+// It blocks until the context is cancelled, then drains in-flight requests before returning.
+func (s *Server) Start(ctx context.Context, port int) error {
+	addr := fmt.Sprintf(":%v", port)
+	log.WithFields(log.Fields{
+		"port":     addr,
+		"datasets": len(s.datasets),
+	}).Info("API Listening")
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return serve(ctx, &http.Server{Handler: s.Router()}, listener)
+}
+
+// serve accepts requests on the listener until the context is cancelled, then drains
+// in-flight requests before returning
+func serve(ctx context.Context, server *http.Server, listener net.Listener) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Info("API draining in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// ListDatasets returns a json list describing every dataset being served
+func (s *Server) ListDatasets(w http.ResponseWriter, r *http.Request) {
+	infos := []DatasetInfo{}
+	for _, api := range s.datasets {
+		infos = append(infos, api.Info)
+	}
+	writeJSON(w, infos)
+}
+
+func (s *Server) datasetInfoHandler(api *API) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, api.Info)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	response, err := json.Marshal(value)
+	if err != nil {
+		log.WithError(err).Error("Could not serialise response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, &http.Server{Handler: handler}, listener)
+	}()
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/")
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		responses <- response{body: string(body), err: err}
+	}()
+
+	<-started
+	cancel()
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned %v before the in-flight request finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	resp := <-responses
+	if resp.err != nil || resp.body != "done" {
+		t.Errorf("In-flight request returned %q, %v, expected it to finish", resp.body, resp.err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("serve returned %s after draining", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("serve did not return after draining")
+	}
+
+	_, err = http.Get("http://" + listener.Addr().String() + "/")
+	if err == nil {
+		t.Errorf("Server accepted a request after shutting down")
+	}
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zachgoldstein/datatoapi/index"
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+// NewSparseAPI creates an instance of API for a dataset indexed by its sort keys only
+func NewSparseAPI(info DatasetInfo, sparseIndexStore *index.SparseIndexStore, realStorage storage.PhysicalStorer) *API {
+	return &API{
+		Info:             info,
+		sparseIndexStore: sparseIndexStore,
+		realStorage:      realStorage,
+	}
+}
+
+// sparseRoutes registers the handlers for a sparse dataset. There's no full text index,
+// so lookups are limited to the sort keys.
+func (api *API) sparseRoutes(r *mux.Router) {
+	r.HandleFunc("/range/{field}", withTimeout(DefaultRequestTimeout, api.SparseRange))
+	r.HandleFunc("/{field}/{value}", withTimeout(DefaultRequestTimeout, api.SparseGet))
+	r.HandleFunc("/all/{field}/{value}", withTimeout(DefaultRequestTimeout, api.SparseAll))
+}
+
+// SparseGet returns the first record where a sort key equals a value.
+// Used for requests of the form /{field}/{value} on sparse datasets
+func (api *API) SparseGet(w http.ResponseWriter, r *http.Request) {
+	log.Info("API Retrieving sparse result for field:value")
+	vars := mux.Vars(r)
+	records, status, err := api.sparseRecords(r, vars["field"], vars["value"], vars["value"], 1)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if len(records) == 0 {
+		http.Error(w, "No records found", http.StatusNotFound)
+		return
+	}
+	writeRecord(w, r, records[0])
+}
+
+// SparseAll returns every record where a sort key equals a value.
+// Used for requests of the form /all/{field}/{value} on sparse datasets
+func (api *API) SparseAll(w http.ResponseWriter, r *http.Request) {
+	log.Info("API Retrieving all sparse results for field:value")
+	vars := mux.Vars(r)
+	limit, err := recordLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, status, err := api.sparseRecords(r, vars["field"], vars["value"], vars["value"], limit)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeRecords(w, r, records)
+}
+
+// SparseRange returns the records where a sort key is between the from and to query
+// parameters, inclusive. Either can be left out for an open ended range.
+// Used for requests of the form /range/{field}?from=a&to=b on sparse datasets
+func (api *API) SparseRange(w http.ResponseWriter, r *http.Request) {
+	log.Info("API Retrieving sparse results for range")
+	vars := mux.Vars(r)
+	limit, err := recordLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	records, status, err := api.sparseRecords(r, vars["field"], query.Get("from"), query.Get("to"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeRecords(w, r, records)
+}
+
+// sparseRecords fetches the blocks that may hold a range of sort key values, returning up to
+// limit matching records in storage order. An empty bound leaves that end of the range open.
+func (api *API) sparseRecords(r *http.Request, field, from, to string, limit int) ([][]byte, int, error) {
+	var fromValue, toValue interface{}
+	var err error
+	if from != "" {
+		fromValue, err = api.sparseIndexStore.ParseValue(field, from)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+	if to != "" {
+		toValue, err = api.sparseIndexStore.ParseValue(field, to)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+
+	blocks, err := api.sparseIndexStore.Blocks(field, fromValue, toValue)
+	if err != nil {
+		log.WithError(err).Error("Could not find sparse index blocks")
+		return nil, http.StatusBadRequest, err
+	}
+
+	records := [][]byte{}
+	for i := range blocks {
+		blockBytes, err := api.realStorage.RetrieveDataBlockBytes(r.Context(), &blocks[i])
+		if err != nil {
+			log.WithError(err).Error("Could not retrieve data block bytes")
+			return nil, http.StatusInternalServerError, err
+		}
+		for _, record := range storage.GetRecordsInRange(blockBytes, field, fromValue, toValue) {
+			records = append(records, record)
+			if len(records) >= limit {
+				return records, http.StatusOK, nil
+			}
+		}
+	}
+	return records, http.StatusOK, nil
+}
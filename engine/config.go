@@ -0,0 +1,282 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is prepended to the name of every environment variable that overrides config,
+// e.g. DATAPI_PORT or DATAPI_S3_FORCE_PATH_STYLE
+const EnvPrefix = "DATAPI"
+
+// Config holds everything needed to start the engine. It's built from defaults, then a config
+// file, then environment variables and finally command line flags, each overriding the last.
+type Config struct {
+	Port        int    `yaml:"port" toml:"port"`
+	IndexPath   string `yaml:"indexPath" toml:"indexPath"`
+	StoragePath string `yaml:"storagePath" toml:"storagePath"`
+	// LogType is either normal or json
+	LogType string `yaml:"logType" toml:"logType"`
+
+	// Datasets lists named datasets to serve under /datasets/{name}. When empty, the storage
+	// and index paths above are served as a single dataset from the root.
+	Datasets []DatasetConfig `yaml:"datasets" toml:"datasets"`
+
+	// Include and Exclude are glob patterns selecting which files or objects under
+	// the storage path are indexed
+	Include []string `yaml:"include" toml:"include"`
+	Exclude []string `yaml:"exclude" toml:"exclude"`
+
+	// BlockRecords and BlockBytes decide how many records go in each data block, the unit fetched
+	// from storage for every lookup. A block closes at whichever limit is reached first, a limit
+	// of zero is ignored and with neither set blocks hold storage.BLOCK_SIZE records.
+	BlockRecords int `yaml:"blockRecords" toml:"blockRecords"`
+	BlockBytes   int `yaml:"blockBytes" toml:"blockBytes"`
+
+	// IndexMode and SortKeys set how the storage path is indexed when no datasets are configured
+	IndexMode string   `yaml:"indexMode" toml:"indexMode"`
+	SortKeys  []string `yaml:"sortKeys" toml:"sortKeys"`
+	// BloomFields and BloomFalsePositiveRate set which fields of the storage path are looked up
+	// with bloom filters when no datasets are configured
+	BloomFields            []string `yaml:"bloomFields" toml:"bloomFields"`
+	BloomFalsePositiveRate float64  `yaml:"bloomFalsePositiveRate" toml:"bloomFalsePositiveRate"`
+	// NumberPrecision sets how far apart numbers of the storage path may be and still match
+	// when no datasets are configured
+	NumberPrecision float64 `yaml:"numberPrecision" toml:"numberPrecision"`
+
+	S3    S3Config    `yaml:"s3" toml:"s3"`
+	Azure AzureConfig `yaml:"azure" toml:"azure"`
+	GCS   GCSConfig   `yaml:"gcs" toml:"gcs"`
+	Swift SwiftConfig `yaml:"swift" toml:"swift"`
+	HTTP  HTTPConfig  `yaml:"http" toml:"http"`
+}
+
+// S3Config is used for s3:// and https://s3.amazonaws.com storage paths. Setting an endpoint
+// allows S3-compatible services like MinIO, Ceph RGW or DigitalOcean Spaces. Without an access
+// key the SDK's default credential chain is used.
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint" toml:"endpoint"`
+	Region          string `yaml:"region" toml:"region"`
+	ForcePathStyle  bool   `yaml:"forcePathStyle" toml:"forcePathStyle"`
+	AccessKeyID     string `yaml:"accessKeyID" toml:"accessKeyID"`
+	SecretAccessKey string `yaml:"secretAccessKey" toml:"secretAccessKey"`
+	SessionToken    string `yaml:"sessionToken" toml:"sessionToken"`
+}
+
+// AzureConfig is used for azblob:// and https://*.blob.core.windows.net storage paths.
+// The account and key default to AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY. Setting an
+// endpoint allows the Azurite emulator.
+type AzureConfig struct {
+	Account    string `yaml:"account" toml:"account"`
+	AccountKey string `yaml:"accountKey" toml:"accountKey"`
+	Endpoint   string `yaml:"endpoint" toml:"endpoint"`
+}
+
+// GCSConfig is used for gs:// storage paths. Without a credentials file the
+// standard application default credentials are used.
+type GCSConfig struct {
+	Endpoint        string `yaml:"endpoint" toml:"endpoint"`
+	CredentialsFile string `yaml:"credentialsFile" toml:"credentialsFile"`
+	Anonymous       bool   `yaml:"anonymous" toml:"anonymous"`
+}
+
+// SwiftConfig is used for swift:// storage paths. Anything left empty is read from
+// the standard OS_* environment variables.
+type SwiftConfig struct {
+	AuthURL     string `yaml:"authURL" toml:"authURL"`
+	User        string `yaml:"user" toml:"user"`
+	Key         string `yaml:"key" toml:"key"`
+	Domain      string `yaml:"domain" toml:"domain"`
+	Tenant      string `yaml:"tenant" toml:"tenant"`
+	Region      string `yaml:"region" toml:"region"`
+	AuthVersion int    `yaml:"authVersion" toml:"authVersion"`
+}
+
+// HTTPConfig is used for http(s) storage paths
+type HTTPConfig struct {
+	// Manifest treats the storage path as a manifest listing the data file urls
+	Manifest bool `yaml:"manifest" toml:"manifest"`
+}
+
+// DefaultConfig returns the config used when nothing else is set
+func DefaultConfig() Config {
+	return Config{
+		Port:        8123,
+		IndexPath:   "./datatoapi.index",
+		StoragePath: "https://s3.amazonaws.com/datatoapi/data.jsonfiles",
+		LogType:     "normal",
+		S3: S3Config{
+			Region: "us-east-1",
+		},
+	}
+}
+
+// LoadConfigFile reads a yaml (.yaml, .yml) or toml (.toml) config file on top of the defaults
+func LoadConfigFile(path string) (Config, error) {
+	config := DefaultConfig()
+	configBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(configBytes, &config)
+	case ".toml":
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(configBytes), &config)
+		if err == nil && len(meta.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", meta.Undecoded())
+		}
+	default:
+		return config, fmt.Errorf("Config file %s should end in .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return config, fmt.Errorf("Could not parse config file %s: %s", path, err)
+	}
+	return config, nil
+}
+
+// ApplyEnv overrides config with environment variables named after the yaml keys, e.g.
+// indexPath is DATAPI_INDEX_PATH and s3.accessKeyID is DATAPI_S3_ACCESS_KEY_ID.
+// Lists are comma separated. Datasets can't be set from the environment.
+func (config *Config) ApplyEnv(lookupEnv func(key string) (string, bool)) error {
+	return applyEnv(reflect.ValueOf(config).Elem(), EnvPrefix, lookupEnv)
+}
+
+func applyEnv(value reflect.Value, prefix string, lookupEnv func(key string) (string, bool)) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		tag := value.Type().Field(i).Tag.Get("yaml")
+		if tag == "" {
+			continue
+		}
+		key := prefix + "_" + envName(tag)
+
+		if field.Kind() == reflect.Struct {
+			err := applyEnv(field, key, lookupEnv)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		envValue, ok := lookupEnv(key)
+		if !ok {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(envValue)
+		case reflect.Int:
+			intValue, err := strconv.Atoi(envValue)
+			if err != nil {
+				return fmt.Errorf("%s should be a number: %s", key, err)
+			}
+			field.SetInt(int64(intValue))
+		case reflect.Float64:
+			floatValue, err := strconv.ParseFloat(envValue, 64)
+			if err != nil {
+				return fmt.Errorf("%s should be a number: %s", key, err)
+			}
+			field.SetFloat(floatValue)
+		case reflect.Bool:
+			boolValue, err := strconv.ParseBool(envValue)
+			if err != nil {
+				return fmt.Errorf("%s should be true or false: %s", key, err)
+			}
+			field.SetBool(boolValue)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("%s can't be set from the environment", key)
+			}
+			field.Set(reflect.ValueOf(SplitList(envValue)))
+		}
+	}
+	return nil
+}
+
+// envName converts a camel case yaml key to upper snake case, e.g. forcePathStyle to FORCE_PATH_STYLE
+func envName(key string) string {
+	runes := []rune(key)
+	name := []rune{}
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower {
+				name = append(name, '_')
+			}
+		}
+		name = append(name, unicode.ToUpper(r))
+	}
+	return string(name)
+}
+
+// SplitList splits a comma separated value into its non-empty parts
+func SplitList(value string) []string {
+	parts := []string{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// Validate checks the config can be used to start the engine, describing the first problem found
+func (config Config) Validate() error {
+	if config.Port <= 0 || config.Port > 65535 {
+		return fmt.Errorf("port %d should be between 1 and 65535", config.Port)
+	}
+	if config.IndexPath == "" {
+		return fmt.Errorf("indexPath must be set")
+	}
+	if config.LogType != "normal" && config.LogType != "json" {
+		return fmt.Errorf("logType '%s' should be normal or json", config.LogType)
+	}
+	if config.BlockRecords < 0 || config.BlockBytes < 0 {
+		return fmt.Errorf("blockRecords and blockBytes can't be negative")
+	}
+	if len(config.Datasets) == 0 && config.StoragePath == "" {
+		return fmt.Errorf("storagePath must be set when no datasets are configured")
+	}
+	if config.S3.AccessKeyID != "" && config.S3.SecretAccessKey == "" {
+		return fmt.Errorf("s3.secretAccessKey must be set along with s3.accessKeyID")
+	}
+	return validateDatasets(config.datasetConfigs())
+}
+
+// datasetConfigs returns the configured datasets, or a single default dataset
+// built from the top level storage and index paths
+func (config Config) datasetConfigs() []DatasetConfig {
+	if len(config.Datasets) == 0 {
+		defaultDataset := DatasetConfig{
+			Name:        DefaultDatasetName,
+			StoragePath: config.StoragePath,
+			IndexPath:   config.IndexPath,
+			Include:     config.Include,
+			Exclude:     config.Exclude,
+			IndexMode:   config.IndexMode,
+			SortKeys:    config.SortKeys,
+
+			BloomFields:            config.BloomFields,
+			BloomFalsePositiveRate: config.BloomFalsePositiveRate,
+			NumberPrecision:        config.NumberPrecision,
+		}
+		return []DatasetConfig{defaultDataset.withDefaults(config)}
+	}
+	datasetConfigs := []DatasetConfig{}
+	for _, datasetConfig := range config.Datasets {
+		datasetConfigs = append(datasetConfigs, datasetConfig.withDefaults(config))
+	}
+	return datasetConfigs
+}
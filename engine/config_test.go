@@ -0,0 +1,207 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// mapEnv looks up environment variables in a map, like os.LookupEnv
+func mapEnv(env map[string]string) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{key: "port", expected: "PORT"},
+		{key: "indexPath", expected: "INDEX_PATH"},
+		{key: "forcePathStyle", expected: "FORCE_PATH_STYLE"},
+		{key: "accessKeyID", expected: "ACCESS_KEY_ID"},
+		{key: "authURL", expected: "AUTH_URL"},
+		{key: "s3", expected: "S3"},
+		{key: "bloomFalsePositiveRate", expected: "BLOOM_FALSE_POSITIVE_RATE"},
+	}
+	for _, test := range tests {
+		name := envName(test.key)
+		if name != test.expected {
+			t.Errorf("envName(%q) = %q, expected %q", test.key, name, test.expected)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected func(config *Config)
+		err      bool
+	}{
+		{name: "nothing set", env: map[string]string{}, expected: func(config *Config) {}},
+		{
+			name: "top level",
+			env: map[string]string{
+				"DATAPI_PORT":                      "9000",
+				"DATAPI_INDEX_PATH":                "/tmp/index",
+				"DATAPI_INCLUDE":                   "*.jsonfiles, *.json",
+				"DATAPI_BLOOM_FALSE_POSITIVE_RATE": "0.05",
+			},
+			expected: func(config *Config) {
+				config.Port = 9000
+				config.IndexPath = "/tmp/index"
+				config.Include = []string{"*.jsonfiles", "*.json"}
+				config.BloomFalsePositiveRate = 0.05
+			},
+		},
+		{
+			name: "nested",
+			env: map[string]string{
+				"DATAPI_S3_FORCE_PATH_STYLE": "true",
+				"DATAPI_S3_ACCESS_KEY_ID":    "key",
+				"DATAPI_SWIFT_AUTH_VERSION":  "3",
+				"DATAPI_HTTP_MANIFEST":       "1",
+			},
+			expected: func(config *Config) {
+				config.S3.ForcePathStyle = true
+				config.S3.AccessKeyID = "key"
+				config.Swift.AuthVersion = 3
+				config.HTTP.Manifest = true
+			},
+		},
+		{name: "empty value", env: map[string]string{"DATAPI_LOG_TYPE": ""}, expected: func(config *Config) { config.LogType = "" }},
+		{name: "invalid int", env: map[string]string{"DATAPI_PORT": "eighty"}, err: true},
+		{name: "invalid float", env: map[string]string{"DATAPI_NUMBER_PRECISION": "tiny"}, err: true},
+		{name: "invalid bool", env: map[string]string{"DATAPI_S3_FORCE_PATH_STYLE": "sure"}, err: true},
+		{name: "datasets", env: map[string]string{"DATAPI_DATASETS": "a,b"}, err: true},
+	}
+	for _, test := range tests {
+		config := DefaultConfig()
+		err := config.ApplyEnv(mapEnv(test.env))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: returned error: %s", test.name, err)
+			continue
+		}
+		expected := DefaultConfig()
+		test.expected(&expected)
+		if !reflect.DeepEqual(config, expected) {
+			t.Errorf("%s: config is %+v, expected %+v", test.name, config, expected)
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Could not create config directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		file     string
+		contents string
+		expected func(config *Config)
+		err      bool
+	}{
+		{
+			file:     "config.yaml",
+			contents: "port: 9000\ns3:\n  forcePathStyle: true\ninclude: [\"*.jsonfiles\"]\n",
+			expected: func(config *Config) {
+				config.Port = 9000
+				config.S3.ForcePathStyle = true
+				config.Include = []string{"*.jsonfiles"}
+			},
+		},
+		{
+			file:     "config.toml",
+			contents: "port = 9000\n[s3]\nregion = \"eu-west-1\"\n",
+			expected: func(config *Config) {
+				config.Port = 9000
+				config.S3.Region = "eu-west-1"
+			},
+		},
+		{file: "config.yml", contents: "prot: 9000\n", err: true},
+		{file: "config.toml", contents: "prot = 9000\n", err: true},
+		{file: "config.json", contents: "{}", err: true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.file)
+		err := ioutil.WriteFile(path, []byte(test.contents), 0644)
+		if err != nil {
+			t.Fatalf("Could not write config file: %s", err)
+		}
+		config, err := LoadConfigFile(path)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: %q expected an error", test.file, test.contents)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: returned error: %s", test.file, err)
+			continue
+		}
+		expected := DefaultConfig()
+		test.expected(&expected)
+		if !reflect.DeepEqual(config, expected) {
+			t.Errorf("%s: config is %+v, expected %+v", test.file, config, expected)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(config *Config)
+		err    bool
+	}{
+		{name: "defaults", config: func(config *Config) {}},
+		{name: "port", config: func(config *Config) { config.Port = 0 }, err: true},
+		{name: "log type", config: func(config *Config) { config.LogType = "xml" }, err: true},
+		{name: "storage path", config: func(config *Config) { config.StoragePath = "" }, err: true},
+		{name: "s3 secret", config: func(config *Config) { config.S3.AccessKeyID = "key" }, err: true},
+		{name: "sparse without sort keys", config: func(config *Config) { config.IndexMode = IndexModeSparse }, err: true},
+		{name: "sparse", config: func(config *Config) {
+			config.IndexMode = IndexModeSparse
+			config.SortKeys = []string{"id"}
+		}},
+		{name: "precision with bloom fields", config: func(config *Config) {
+			config.BloomFields = []string{"id"}
+			config.NumberPrecision = 0.001
+		}, err: true},
+		{name: "negative precision", config: func(config *Config) { config.NumberPrecision = -1 }, err: true},
+		{name: "invalid pattern", config: func(config *Config) { config.Include = []string{"["} }, err: true},
+		{name: "datasets sharing an index path", config: func(config *Config) {
+			config.Datasets = []DatasetConfig{
+				{Name: "a", StoragePath: "a.jsonfiles", IndexPath: "index"},
+				{Name: "b", StoragePath: "b.jsonfiles", IndexPath: "./index"},
+			}
+		}, err: true},
+		{name: "duplicate datasets", config: func(config *Config) {
+			config.Datasets = []DatasetConfig{
+				{Name: "a", StoragePath: "a.jsonfiles"},
+				{Name: "a", StoragePath: "b.jsonfiles"},
+			}
+		}, err: true},
+	}
+	for _, test := range tests {
+		config := DefaultConfig()
+		test.config(&config)
+		err := config.Validate()
+		if test.err != (err != nil) {
+			t.Errorf("%s: Validate returned error %v, expected error: %t", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/zachgoldstein/datatoapi/models"
+)
+
+// DefaultDatasetName is used for the dataset described by the top level storage and index paths
+const DefaultDatasetName = "default"
+
+// DefaultFormat is the data format used when a dataset doesn't specify one
+const DefaultFormat = "jsonfiles"
+
+// SupportedFormats lists the data formats datasets can be stored in
+var SupportedFormats = []string{"jsonfiles"}
+
+// Index modes. Full indexes every record for search and field lookups, sparse only records
+// the range of each sort key per data block, for large data sorted by those keys.
+const (
+	IndexModeFull   = "full"
+	IndexModeSparse = "sparse"
+)
+
+// DatasetConfig describes a named dataset, served under /datasets/{name}
+type DatasetConfig struct {
+	Name        string `json:"name" yaml:"name" toml:"name"`
+	StoragePath string `json:"storagePath" yaml:"storagePath" toml:"storagePath"`
+	Format      string `json:"format" yaml:"format" toml:"format"`
+	// Schema is the path to a json file describing the dataset's fields
+	Schema string `json:"schema" yaml:"schema" toml:"schema"`
+	// IndexPath defaults to a directory named after the dataset inside the engine's index path
+	IndexPath string   `json:"indexPath" yaml:"indexPath" toml:"indexPath"`
+	Include   []string `json:"include" yaml:"include" toml:"include"`
+	Exclude   []string `json:"exclude" yaml:"exclude" toml:"exclude"`
+	// BlockRecords and BlockBytes size the data blocks fetched from storage for each lookup,
+	// defaulting to the engine's block sizes
+	BlockRecords int `json:"blockRecords" yaml:"blockRecords" toml:"blockRecords"`
+	BlockBytes   int `json:"blockBytes" yaml:"blockBytes" toml:"blockBytes"`
+	// IndexMode is full (the default) or sparse. Sparse datasets must list the SortKeys
+	// their files are sorted by, and can only be looked up by those keys.
+	IndexMode string   `json:"indexMode" yaml:"indexMode" toml:"indexMode"`
+	SortKeys  []string `json:"sortKeys" yaml:"sortKeys" toml:"sortKeys"`
+	// BloomFields are looked up with a bloom filter per data block instead of the search index,
+	// which keeps the index much smaller for high cardinality fields like ids
+	BloomFields            []string `json:"bloomFields" yaml:"bloomFields" toml:"bloomFields"`
+	BloomFalsePositiveRate float64  `json:"bloomFalsePositiveRate" yaml:"bloomFalsePositiveRate" toml:"bloomFalsePositiveRate"`
+	// NumberPrecision is how far apart two numbers may be and still match in lookups,
+	// e.g. 0.000001 to find values stored as float32 by their shortest form. Bloom filters
+	// only hold exact values, so it can't be used with BloomFields.
+	NumberPrecision float64 `json:"numberPrecision" yaml:"numberPrecision" toml:"numberPrecision"`
+}
+
+// LoadDatasets reads a json file containing a list of dataset configs
+func LoadDatasets(path string) ([]DatasetConfig, error) {
+	datasetBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	datasets := []DatasetConfig{}
+	err = json.Unmarshal(datasetBytes, &datasets)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse datasets in %s: %s", path, err)
+	}
+	return datasets, nil
+}
+
+// LoadSchema reads a json schema file describing a dataset's fields
+func LoadSchema(path string) (models.Schema, error) {
+	schemaBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	schema := models.Schema{}
+	err = json.Unmarshal(schemaBytes, &schema)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse schema in %s: %s", path, err)
+	}
+	return schema, nil
+}
+
+// withDefaults fills in the format, index path and block sizes of a dataset from the engine's config
+func (dataset DatasetConfig) withDefaults(config Config) DatasetConfig {
+	if dataset.Format == "" {
+		dataset.Format = DefaultFormat
+	}
+	if dataset.IndexMode == "" {
+		dataset.IndexMode = IndexModeFull
+	}
+	if dataset.IndexPath == "" {
+		dataset.IndexPath = filepath.Join(config.IndexPath, dataset.Name)
+	}
+	if dataset.BlockRecords == 0 && dataset.BlockBytes == 0 {
+		dataset.BlockRecords = config.BlockRecords
+		dataset.BlockBytes = config.BlockBytes
+	}
+	return dataset
+}
+
+// validateDatasets checks that every dataset can be served, and that names and index paths don't clash
+func validateDatasets(datasets []DatasetConfig) error {
+	names := map[string]bool{}
+	indexPaths := map[string]string{}
+	for _, dataset := range datasets {
+		if dataset.Name == "" || strings.ContainsAny(dataset.Name, "/?#") {
+			return fmt.Errorf("Dataset name '%s' must be non-empty and can't contain '/', '?' or '#'", dataset.Name)
+		}
+		if names[dataset.Name] {
+			return fmt.Errorf("Dataset '%s' is configured more than once", dataset.Name)
+		}
+		names[dataset.Name] = true
+
+		if dataset.StoragePath == "" {
+			return fmt.Errorf("Dataset '%s' needs a storage path", dataset.Name)
+		}
+		if !isSupportedFormat(dataset.Format) {
+			return fmt.Errorf("Dataset '%s' has unsupported format '%s', supported formats are %s",
+				dataset.Name, dataset.Format, strings.Join(SupportedFormats, ", "))
+		}
+		if dataset.IndexMode != IndexModeFull && dataset.IndexMode != IndexModeSparse {
+			return fmt.Errorf("Dataset '%s' has unsupported index mode '%s', supported modes are %s, %s",
+				dataset.Name, dataset.IndexMode, IndexModeFull, IndexModeSparse)
+		}
+		if dataset.IndexMode == IndexModeSparse && len(dataset.SortKeys) == 0 {
+			return fmt.Errorf("Dataset '%s' uses a sparse index but doesn't list any sort keys", dataset.Name)
+		}
+		if len(dataset.BloomFields) > 0 && dataset.IndexMode != IndexModeFull {
+			return fmt.Errorf("Dataset '%s' can only use bloom fields with a full index", dataset.Name)
+		}
+		if dataset.BloomFalsePositiveRate < 0 || dataset.BloomFalsePositiveRate >= 1 {
+			return fmt.Errorf("Dataset '%s' has a bloom false positive rate of %v, it should be between 0 and 1",
+				dataset.Name, dataset.BloomFalsePositiveRate)
+		}
+		if dataset.NumberPrecision < 0 {
+			return fmt.Errorf("Dataset '%s' has a negative number precision", dataset.Name)
+		}
+		if dataset.NumberPrecision > 0 && len(dataset.BloomFields) > 0 {
+			return fmt.Errorf("Dataset '%s' sets a number precision, but bloom fields can only be looked up by exact values", dataset.Name)
+		}
+		if dataset.BlockRecords < 0 || dataset.BlockBytes < 0 {
+			return fmt.Errorf("Dataset '%s' has a negative block size", dataset.Name)
+		}
+		for _, pattern := range append(append([]string{}, dataset.Include...), dataset.Exclude...) {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("Dataset '%s' has an invalid include/exclude pattern '%s': %s", dataset.Name, pattern, err)
+			}
+		}
+		indexPath := filepath.Clean(dataset.IndexPath)
+		if other, ok := indexPaths[indexPath]; ok {
+			return fmt.Errorf("Datasets '%s' and '%s' share the index path %s", other, dataset.Name, indexPath)
+		}
+		indexPaths[indexPath] = dataset.Name
+	}
+	return nil
+}
+
+func isSupportedFormat(format string) bool {
+	for _, supported := range SupportedFormats {
+		if format == supported {
+			return true
+		}
+	}
+	return false
+}
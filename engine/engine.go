@@ -1,29 +1,35 @@
 package engine
 
 import (
+	"context"
+	"os"
+	"os/signal"
 	"reflect"
-	"strings"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/zachgoldstein/datatoapi/api"
 	"github.com/zachgoldstein/datatoapi/index"
+	"github.com/zachgoldstein/datatoapi/models"
 	"github.com/zachgoldstein/datatoapi/storage"
 )
 
-// Engine uses the indexing store and the underlying storage to fulfil
-// requests for data
+// Engine uses the indexing store and the underlying storage of each dataset
+// to fulfil requests for data
 type Engine struct {
-	indexStore  *index.IndexStore
-	realStorage storage.PhysicalStorer
-	api         *api.API
-	config      Config
+	datasets []*Dataset
+	server   *api.Server
+	config   Config
 }
 
-type Config struct {
-	IndexPath   string
-	StoragePath string
-	Port        int
+// Dataset ties together the storage, indexes and api for a single dataset
+type Dataset struct {
+	Config           DatasetConfig
+	indexStore       *index.IndexStore
+	sparseIndexStore *index.SparseIndexStore
+	realStorage      storage.PhysicalStorer
+	api              *api.API
 }
 
 // NewEngine creates an instance of Engine
@@ -31,36 +37,187 @@ func NewEngine() *Engine {
 	return &Engine{}
 }
 
-// Start will start up
+// Start will start up storage, open or build the indexes and serve the api for every dataset.
+// It blocks until the process receives SIGINT or SIGTERM, then stops indexing,
+// drains in-flight requests and closes the indexes before returning.
 func (eng *Engine) Start(config Config) error {
 	eng.config = config
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handleSignals(ctx, cancel)
 
-	eng.realStorage = detectStorageType(eng.config.StoragePath)
-	eng.indexStore = index.NewIndexStore(eng.realStorage)
-	eng.api = api.NewAPI(eng.indexStore, eng.realStorage)
+	err := eng.config.Validate()
+	if err != nil {
+		return err
+	}
+	datasetConfigs := eng.config.datasetConfigs()
 
-	log.WithFields(log.Fields{
-		"storage": reflect.TypeOf(eng.realStorage),
-	}).Info("Starting engine with storage")
+	eng.server = api.NewServer()
+	defer eng.closeDatasets()
+	for _, datasetConfig := range datasetConfigs {
+		dataset, err := eng.startDataset(ctx, datasetConfig)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Info("Indexing interrupted, indexes will be rebuilt on next start")
+				return nil
+			}
+			return err
+		}
+		eng.datasets = append(eng.datasets, dataset)
+		eng.server.AddDataset(dataset.api)
+	}
+	if len(eng.config.Datasets) == 0 {
+		eng.server.SetDefault(eng.datasets[0].api)
+	}
 
-	err := eng.realStorage.Start(eng.config.StoragePath, map[string]interface{}{})
+	err = eng.server.Start(ctx, eng.config.Port)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
-	err = eng.indexStore.Start(eng.config.IndexPath)
+	log.Info("Engine shut down")
+	return nil
+}
+
+// startDataset starts a dataset's storage and opens or builds its indexes
+func (eng *Engine) startDataset(ctx context.Context, config DatasetConfig) (*Dataset, error) {
+	var schema models.Schema
+	if config.Schema != "" {
+		var err error
+		schema, err = LoadSchema(config.Schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dataset := &Dataset{
+		Config:      config,
+		realStorage: detectStorageType(config.StoragePath),
+	}
+	info := api.DatasetInfo{
+		Name:      config.Name,
+		Format:    config.Format,
+		Schema:    schema,
+		IndexMode: config.IndexMode,
+		SortKeys:  config.SortKeys,
+	}
+
+	log.WithFields(log.Fields{
+		"dataset":     config.Name,
+		"storagePath": config.StoragePath,
+		"indexPath":   config.IndexPath,
+		"indexMode":   config.IndexMode,
+		"storage":     reflect.TypeOf(dataset.realStorage),
+	}).Info("Starting dataset with storage")
+
+	err := dataset.realStorage.Start(ctx, config.StoragePath, eng.storageCredentials(config))
 	if err != nil {
-		log.Panic(err)
+		return nil, err
+	}
+
+	if config.IndexMode == IndexModeSparse {
+		dataset.sparseIndexStore = index.NewSparseIndexStore(dataset.realStorage, config.SortKeys)
+		dataset.api = api.NewSparseAPI(info, dataset.sparseIndexStore, dataset.realStorage)
+		err = dataset.sparseIndexStore.Start(ctx, config.IndexPath)
+	} else {
+		dataset.indexStore = index.NewIndexStore(dataset.realStorage, config.BloomFields, schema,
+			storage.ValueComparator{Precision: config.NumberPrecision})
+		dataset.api = api.NewAPI(info, dataset.indexStore, dataset.realStorage)
+		err = dataset.indexStore.Start(ctx, config.IndexPath)
 	}
-	err = eng.api.Start(eng.config.Port, eng.indexStore, eng.realStorage)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	return nil
+	return dataset, nil
+}
+
+// closeDatasets closes the indexes of every started dataset
+func (eng *Engine) closeDatasets() {
+	for _, dataset := range eng.datasets {
+		var err error
+		if dataset.sparseIndexStore != nil {
+			err = dataset.sparseIndexStore.Close()
+		} else {
+			err = dataset.indexStore.Close()
+		}
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"dataset": dataset.Config.Name,
+			}).Error("Could not close indexes")
+		}
+	}
+}
+
+// handleSignals cancels the engine's context when the process is asked to stop
+func handleSignals(ctx context.Context, cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case sig := <-signals:
+		log.WithFields(log.Fields{
+			"signal": sig.String(),
+		}).Info("Received signal, shutting down")
+		cancel()
+	case <-ctx.Done():
+	}
+}
+
+// storageCredentials builds the credentials map passed to a dataset's physical storage from config
+func (eng *Engine) storageCredentials(dataset DatasetConfig) map[string]interface{} {
+	credentials := map[string]interface{}{
+		storage.CredentialInclude: dataset.Include,
+		storage.CredentialExclude: dataset.Exclude,
+
+		storage.CredentialBlockRecords: dataset.BlockRecords,
+		storage.CredentialBlockBytes:   dataset.BlockBytes,
+
+		storage.CredentialEndpoint:        eng.config.S3.Endpoint,
+		storage.CredentialRegion:          eng.config.S3.Region,
+		storage.CredentialForcePathStyle:  eng.config.S3.ForcePathStyle,
+		storage.CredentialAccessKeyID:     eng.config.S3.AccessKeyID,
+		storage.CredentialSecretAccessKey: eng.config.S3.SecretAccessKey,
+		storage.CredentialSessionToken:    eng.config.S3.SessionToken,
+
+		storage.CredentialAzureAccount:    eng.config.Azure.Account,
+		storage.CredentialAzureAccountKey: eng.config.Azure.AccountKey,
+		storage.CredentialAzureEndpoint:   eng.config.Azure.Endpoint,
+
+		storage.CredentialGCSEndpoint:        eng.config.GCS.Endpoint,
+		storage.CredentialGCSCredentialsFile: eng.config.GCS.CredentialsFile,
+		storage.CredentialGCSAnonymous:       eng.config.GCS.Anonymous,
+
+		storage.CredentialSwiftAuthURL:     eng.config.Swift.AuthURL,
+		storage.CredentialSwiftUser:        eng.config.Swift.User,
+		storage.CredentialSwiftKey:         eng.config.Swift.Key,
+		storage.CredentialSwiftDomain:      eng.config.Swift.Domain,
+		storage.CredentialSwiftTenant:      eng.config.Swift.Tenant,
+		storage.CredentialSwiftRegion:      eng.config.Swift.Region,
+		storage.CredentialSwiftAuthVersion: eng.config.Swift.AuthVersion,
+
+		storage.CredentialHTTPManifest: eng.config.HTTP.Manifest,
+	}
+	// Sort key ranges are only kept on the data blocks of sparse indexes, and bloom filters on full ones
+	if dataset.IndexMode == IndexModeSparse {
+		credentials[storage.CredentialSortKeys] = dataset.SortKeys
+	} else {
+		credentials[storage.CredentialBloomFields] = dataset.BloomFields
+		credentials[storage.CredentialBloomRate] = dataset.BloomFalsePositiveRate
+	}
+	return credentials
 }
 
 func detectStorageType(storagePath string) storage.PhysicalStorer {
-	if strings.Contains(storagePath, "https://s3.amazonaws.com") {
+	if storage.IsS3Path(storagePath) {
 		return storage.NewAWSFS()
+	} else if storage.IsAzurePath(storagePath) {
+		return storage.NewAzureFS()
+	} else if storage.IsGCSPath(storagePath) {
+		return storage.NewGCSFS()
+	} else if storage.IsSwiftPath(storagePath) {
+		return storage.NewSwiftFS()
+	} else if storage.IsHTTPPath(storagePath) {
+		return storage.NewHTTPFS()
 	} else {
 		return storage.NewLocalFS()
 	}
@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zachgoldstein/datatoapi/api"
+)
+
+func TestDatasetConfigs(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		expected []DatasetConfig
+	}{
+		{
+			name:   "default dataset",
+			config: Config{StoragePath: "./data/people.jsonfiles", IndexPath: "./indexes", Include: []string{"*.jsonfiles"}},
+			expected: []DatasetConfig{
+				{Name: DefaultDatasetName, StoragePath: "./data/people.jsonfiles", Format: DefaultFormat, IndexPath: "./indexes", Include: []string{"*.jsonfiles"}, IndexMode: IndexModeFull},
+			},
+		},
+		{
+			name: "named datasets",
+			config: Config{StoragePath: "./data/people.jsonfiles", IndexPath: "./indexes", Datasets: []DatasetConfig{
+				{Name: "people", StoragePath: "s3://data/people"},
+				{Name: "places", StoragePath: "./data/places.jsonfiles", IndexPath: "/var/indexes/places"},
+			}},
+			expected: []DatasetConfig{
+				{Name: "people", StoragePath: "s3://data/people", Format: DefaultFormat, IndexPath: filepath.Join("indexes", "people"), IndexMode: IndexModeFull},
+				{Name: "places", StoragePath: "./data/places.jsonfiles", Format: DefaultFormat, IndexPath: "/var/indexes/places", IndexMode: IndexModeFull},
+			},
+		},
+	}
+	for _, test := range tests {
+		configs := test.config.datasetConfigs()
+		if !reflect.DeepEqual(configs, test.expected) {
+			t.Errorf("%s: dataset configs are %+v, expected %+v", test.name, configs, test.expected)
+		}
+	}
+}
+
+func TestValidateDatasets(t *testing.T) {
+	tests := []struct {
+		name     string
+		datasets []DatasetConfig
+		err      bool
+	}{
+		{
+			name: "valid",
+			datasets: []DatasetConfig{
+				{Name: "people", StoragePath: "./people", Format: "jsonfiles", IndexPath: "indexes/people", IndexMode: IndexModeFull},
+				{Name: "places", StoragePath: "./places", Format: "jsonfiles", IndexPath: "indexes/places", IndexMode: IndexModeFull},
+			},
+		},
+		{name: "missing name", datasets: []DatasetConfig{{StoragePath: "./people", Format: "jsonfiles", IndexPath: "indexes/a"}}, err: true},
+		{name: "name with a slash", datasets: []DatasetConfig{{Name: "a/b", StoragePath: "./people", Format: "jsonfiles", IndexPath: "indexes/a"}}, err: true},
+		{
+			name: "duplicate name",
+			datasets: []DatasetConfig{
+				{Name: "people", StoragePath: "./people", Format: "jsonfiles", IndexPath: "indexes/a"},
+				{Name: "people", StoragePath: "./places", Format: "jsonfiles", IndexPath: "indexes/b"},
+			},
+			err: true,
+		},
+		{name: "missing storage path", datasets: []DatasetConfig{{Name: "people", Format: "jsonfiles", IndexPath: "indexes/a"}}, err: true},
+		{name: "unsupported format", datasets: []DatasetConfig{{Name: "people", StoragePath: "./people", Format: "csv", IndexPath: "indexes/a"}}, err: true},
+		{
+			name: "shared index path",
+			datasets: []DatasetConfig{
+				{Name: "people", StoragePath: "./people", Format: "jsonfiles", IndexPath: "indexes/people", IndexMode: IndexModeFull},
+				{Name: "places", StoragePath: "./places", Format: "jsonfiles", IndexPath: "indexes/./people/"},
+			},
+			err: true,
+		},
+	}
+	for _, test := range tests {
+		err := validateDatasets(test.datasets)
+		if test.err != (err != nil) {
+			t.Errorf("%s: validateDatasets returned error %v, expected error: %t", test.name, err, test.err)
+		}
+	}
+}
+
+func TestDatasetRouting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datatoapi-engine")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"people.jsonfiles": "{\"name\": \"Rick\", \"age\": 70}\n{\"name\": \"Morty\", \"age\": 14}\n",
+		"places.jsonfiles": "{\"name\": \"Paris\", \"country\": \"France\"}\n",
+	}
+	for name, contents := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("Could not write test data: %s", err)
+		}
+	}
+
+	eng := &Engine{config: Config{IndexPath: filepath.Join(dir, "indexes"), Datasets: []DatasetConfig{
+		{Name: "people", StoragePath: filepath.Join(dir, "people.jsonfiles")},
+		{Name: "places", StoragePath: filepath.Join(dir, "places.jsonfiles")},
+	}}}
+	server := api.NewServer()
+	defer eng.closeDatasets()
+	for _, config := range eng.config.datasetConfigs() {
+		dataset, err := eng.startDataset(context.Background(), config)
+		if err != nil {
+			t.Fatalf("Could not start dataset %s: %s", config.Name, err)
+		}
+		eng.datasets = append(eng.datasets, dataset)
+		server.AddDataset(dataset.api)
+		if _, err := os.Stat(filepath.Join(dir, "indexes", config.Name)); err != nil {
+			t.Errorf("Dataset %s wasn't indexed in its own directory: %s", config.Name, err)
+		}
+	}
+	server.SetDefault(eng.datasets[0].api)
+	router := server.Router()
+
+	tests := []struct {
+		url    string
+		status int
+		record map[string]interface{}
+	}{
+		{url: "/datasets/people/name/Rick", status: http.StatusOK, record: map[string]interface{}{"name": "Rick", "age": 70.0}},
+		{url: "/datasets/places/name/Paris", status: http.StatusOK, record: map[string]interface{}{"name": "Paris", "country": "France"}},
+		{url: "/datasets/places/name/Rick", status: http.StatusNotFound},
+		{url: "/name/Morty", status: http.StatusOK, record: map[string]interface{}{"name": "Morty", "age": 14.0}},
+		{url: "/datasets/missing/name/Rick", status: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", test.url, nil))
+		if recorder.Code != test.status {
+			t.Errorf("%s returned status %d, expected %d", test.url, recorder.Code, test.status)
+			continue
+		}
+		if test.record == nil {
+			continue
+		}
+		record := map[string]interface{}{}
+		err := json.Unmarshal(recorder.Body.Bytes(), &record)
+		if err != nil || !reflect.DeepEqual(record, test.record) {
+			t.Errorf("%s returned %s, expected %v", test.url, recorder.Body.String(), test.record)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/datasets", nil))
+	infos := []api.DatasetInfo{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &infos)
+	if err != nil || len(infos) != 2 || infos[0].Name != "people" || infos[1].Name != "places" {
+		t.Errorf("/datasets returned %s, expected the people and places datasets", recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/datasets/places", nil))
+	info := api.DatasetInfo{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &info)
+	if err != nil || info.Name != "places" || info.Format != DefaultFormat {
+		t.Errorf("/datasets/places returned %s, expected the places dataset", recorder.Body.String())
+	}
+}
@@ -0,0 +1,231 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultFacetSize is the number of terms returned by a terms facet that doesn't set a size
+const DefaultFacetSize = 10
+
+// MaxFacetBuckets is the most terms or ranges a single facet may return
+const MaxFacetBuckets = 1000
+
+// AggregateRequest counts the records matching a query by the values of their fields, used by
+// POST /aggregate. Counts come from the search index alone, no data blocks are fetched.
+//
+//	{
+//	  "query": {"term": {"field": "has_existential_identity_crisis", "value": true}},
+//	  "facets": {
+//	    "jobs": {"terms": {"field": "job", "size": 5}},
+//	    "plumbuses": {"histogram": {"field": "total_plumbuses", "interval": 10000, "min": 0, "max": 100000}},
+//	    "distances": {"ranges": {"field": "distance", "ranges": [{"name": "near", "to": 0.5}, {"name": "far", "from": 0.5}]}},
+//	    "signups": {"dateRanges": {"field": "created", "ranges": [{"name": "2018", "start": "2018-01-01T00:00:00Z", "end": "2019-01-01T00:00:00Z"}]}}
+//	  }
+//	}
+type AggregateRequest struct {
+	Query  *QueryClause            `json:"query"`
+	Facets map[string]FacetRequest `json:"facets"`
+}
+
+// FacetRequest describes one facet. Exactly one of its members is set.
+type FacetRequest struct {
+	Terms      *TermsFacet      `json:"terms,omitempty"`
+	Ranges     *RangesFacet     `json:"ranges,omitempty"`
+	Histogram  *HistogramFacet  `json:"histogram,omitempty"`
+	DateRanges *DateRangesFacet `json:"dateRanges,omitempty"`
+}
+
+// TermsFacet counts the most common words of a text field, or the values of a bool field
+type TermsFacet struct {
+	Field string `json:"field"`
+	Size  int    `json:"size"`
+}
+
+// RangesFacet counts the values of a number field within each range
+type RangesFacet struct {
+	Field  string         `json:"field"`
+	Ranges []NumericRange `json:"ranges"`
+}
+
+// NumericRange includes From and excludes To, either can be left out for an open range
+type NumericRange struct {
+	Name string   `json:"name"`
+	From *float64 `json:"from,omitempty"`
+	To   *float64 `json:"to,omitempty"`
+}
+
+// HistogramFacet counts the values of a number field in ranges of a fixed width between min and max.
+// Each range excludes its upper bound except the last, which ends at max and includes it.
+type HistogramFacet struct {
+	Field    string  `json:"field"`
+	Interval float64 `json:"interval"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+}
+
+// DateRangesFacet counts the dates of a field within each range
+type DateRangesFacet struct {
+	Field  string      `json:"field"`
+	Ranges []DateRange `json:"ranges"`
+}
+
+// DateRange includes Start and excludes End, both RFC 3339 dates. Either can be left out for
+// an open range.
+type DateRange struct {
+	Name  string  `json:"name"`
+	Start *string `json:"start,omitempty"`
+	End   *string `json:"end,omitempty"`
+}
+
+// facetRequest converts the facet into bleve's, describing the first problem found
+func (f FacetRequest) facetRequest(name string) (string, *bleve.FacetRequest, error) {
+	set := 0
+	for _, isSet := range []bool{f.Terms != nil, f.Ranges != nil, f.Histogram != nil, f.DateRanges != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return "", nil, fmt.Errorf("Facet '%s' should set one of terms, ranges, histogram, dateRanges", name)
+	}
+
+	switch {
+	case f.Terms != nil:
+		size := f.Terms.Size
+		if size == 0 {
+			size = DefaultFacetSize
+		}
+		if size < 0 || size > MaxFacetBuckets {
+			return "", nil, fmt.Errorf("Facet '%s' size should be between 1 and %d", name, MaxFacetBuckets)
+		}
+		return f.Terms.Field, bleve.NewFacetRequest(dataField(f.Terms.Field), size), nil
+	case f.Ranges != nil:
+		if len(f.Ranges.Ranges) == 0 || len(f.Ranges.Ranges) > MaxFacetBuckets {
+			return "", nil, fmt.Errorf("Facet '%s' should have between 1 and %d ranges", name, MaxFacetBuckets)
+		}
+		facet := bleve.NewFacetRequest(dataField(f.Ranges.Field), len(f.Ranges.Ranges))
+		for _, numericRange := range f.Ranges.Ranges {
+			facet.AddNumericRange(numericRange.Name, numericRange.From, numericRange.To)
+		}
+		return f.Ranges.Field, facet, nil
+	case f.Histogram != nil:
+		h := f.Histogram
+		if h.Interval <= 0 || h.Max <= h.Min {
+			return "", nil, fmt.Errorf("Facet '%s' needs a positive interval and max above min", name)
+		}
+		buckets := int((h.Max - h.Min) / h.Interval)
+		if h.Min+float64(buckets)*h.Interval < h.Max {
+			buckets++
+		}
+		if buckets > MaxFacetBuckets {
+			return "", nil, fmt.Errorf("Facet '%s' would have more than %d buckets", name, MaxFacetBuckets)
+		}
+		facet := bleve.NewFacetRequest(dataField(h.Field), buckets)
+		for i := 0; i < buckets; i++ {
+			from, to := h.Min+float64(i)*h.Interval, h.Min+float64(i+1)*h.Interval
+			name := fmt.Sprintf("%g-%g", from, to)
+			if i == buckets-1 {
+				// bleve ranges exclude their upper bound, so the last one ends just past max
+				name = fmt.Sprintf("%g-%g", from, h.Max)
+				to = math.Nextafter(h.Max, math.Inf(1))
+			}
+			facet.AddNumericRange(name, &from, &to)
+		}
+		return h.Field, facet, nil
+	}
+
+	if len(f.DateRanges.Ranges) == 0 || len(f.DateRanges.Ranges) > MaxFacetBuckets {
+		return "", nil, fmt.Errorf("Facet '%s' should have between 1 and %d ranges", name, MaxFacetBuckets)
+	}
+	facet := bleve.NewFacetRequest(dateField(f.DateRanges.Field), len(f.DateRanges.Ranges))
+	for _, dateRange := range f.DateRanges.Ranges {
+		facet.AddDateTimeRangeString(dateRange.Name, dateRange.Start, dateRange.End)
+	}
+	return f.DateRanges.Field, facet, nil
+}
+
+// Aggregate counts the records matching a condition by each of the request's facets
+func (is *IndexStore) Aggregate(ctx context.Context, request AggregateRequest, condition Condition) (*bleve.SearchResult, error) {
+	if len(request.Facets) == 0 {
+		return nil, fmt.Errorf("Aggregations need at least one facet")
+	}
+	for _, field := range condition.Fields() {
+		if is.IsBloomField(field) {
+			return nil, fmt.Errorf("'%s' is looked up with bloom filters and isn't in the search index", field)
+		}
+	}
+
+	// Only the counts are needed, so no hits are returned
+	searchReq := bleve.NewSearchRequestOptions(condition.BleveQuery(), 0, 0, false)
+	boolFacets := []string{}
+	for name, facet := range request.Facets {
+		field, facetReq, err := facet.facetRequest(name)
+		if err != nil {
+			return nil, err
+		}
+		if field == "" {
+			return nil, fmt.Errorf("Facet '%s' needs a field", name)
+		}
+		if is.IsBloomField(field) {
+			return nil, fmt.Errorf("'%s' is looked up with bloom filters and isn't in the search index", field)
+		}
+		err = facetReq.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("Facet '%s' is invalid: %s", name, err)
+		}
+		if facet.Terms != nil {
+			// Numbers and dates are indexed as encoded terms, which aren't worth counting
+			if !is.fieldHasType(field, "text") && !is.fieldHasType(field, "boolean") {
+				return nil, fmt.Errorf("Facet '%s' counts terms, which needs a text or bool field and '%s' isn't one", name, field)
+			}
+			if is.fieldHasType(field, "boolean") {
+				boolFacets = append(boolFacets, name)
+			}
+		}
+		searchReq.AddFacet(name, facetReq)
+	}
+
+	log.WithFields(log.Fields{
+		"numFacets": len(request.Facets),
+	}).Info("Aggregating with facets")
+	searchResults, err := is.searchIndex.SearchInContext(ctx, searchReq)
+	if err != nil {
+		log.WithError(err).Error("Error finding search Index")
+		return nil, err
+	}
+	for _, name := range boolFacets {
+		renameBoolTerms(searchResults.Facets[name])
+	}
+	return searchResults, nil
+}
+
+// renameBoolTerms replaces the terms bleve indexes bools as with true and false
+func renameBoolTerms(facet *search.FacetResult) {
+	if facet == nil {
+		return
+	}
+	for _, term := range facet.Terms {
+		switch term.Term {
+		case "T":
+			term.Term = "true"
+		case "F":
+			term.Term = "false"
+		}
+	}
+}
+
+// fieldHasType returns true if a record field was mapped as fieldType when the search index was built
+func (is *IndexStore) fieldHasType(field, fieldType string) bool {
+	for _, fieldMapping := range mappedFields(is.searchIndex, field) {
+		if fieldMapping.Type == fieldType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package index
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/mapping"
+	log "github.com/sirupsen/logrus"
+	// Registers bleve's language analyzers, tokenizers and token filters so schemas can use them
+	_ "github.com/blevesearch/bleve/config"
+
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+// AnalyzerCustom is the schema analyzer building an analyzer from a field's tokenizer and token filters
+const AnalyzerCustom = "custom"
+
+// idFieldNames are field names holding identifiers, which are matched whole rather than by word
+var idFieldNames = map[string]bool{
+	"id": true, "uuid": true, "guid": true, "key": true,
+	"email": true, "username": true, "phone": true, "phone_number": true,
+}
+
+// IsIDField returns true if a field's name suggests it holds identifiers, like id, user_id,
+// userId or username. Their string values are indexed whole unless the schema says otherwise,
+// so lookups match exactly instead of on the words split out by punctuation.
+func IsIDField(field string) bool {
+	path := storage.FieldPath(field)
+	name := path[len(path)-1]
+	lowerName := strings.ToLower(name)
+	return idFieldNames[lowerName] ||
+		strings.HasSuffix(lowerName, "_id") ||
+		strings.HasSuffix(name, "Id") ||
+		strings.HasSuffix(name, "ID")
+}
+
+// fieldAnalyzer returns the analyzer a string field is indexed with, empty for the default
+func (is *IndexStore) fieldAnalyzer(field string) string {
+	field = storage.NormalizeField(field)
+	for schemaField, fieldSchema := range is.schema {
+		if storage.NormalizeField(schemaField) != field || fieldSchema.Analyzer == "" {
+			continue
+		}
+		if fieldSchema.Analyzer == AnalyzerCustom {
+			return customAnalyzerName(field)
+		}
+		return fieldSchema.Analyzer
+	}
+	if IsIDField(field) {
+		return keyword.Name
+	}
+	return ""
+}
+
+func customAnalyzerName(field string) string {
+	return fmt.Sprintf("custom_%s", field)
+}
+
+// addSchemaAnalyzers registers the schema's custom analyzers and maps every field the schema
+// sets an analyzer for, so fields missing from the records sampled for the mapping are still
+// indexed with them
+func (is *IndexStore) addSchemaAnalyzers(indexMapping *mapping.IndexMappingImpl, dataMapping *mapping.DocumentMapping) error {
+	for field, fieldSchema := range is.schema {
+		if fieldSchema.Analyzer == "" {
+			continue
+		}
+		if fieldSchema.Analyzer == AnalyzerCustom {
+			if fieldSchema.Tokenizer == "" {
+				return fmt.Errorf("Field '%s' uses a custom analyzer but has no tokenizer", field)
+			}
+			err := indexMapping.AddCustomAnalyzer(customAnalyzerName(storage.NormalizeField(field)), map[string]interface{}{
+				"type":          custom.Name,
+				"tokenizer":     fieldSchema.Tokenizer,
+				"token_filters": fieldSchema.TokenFilters,
+			})
+			if err != nil {
+				return fmt.Errorf("Could not build the custom analyzer for field '%s': %s", field, err)
+			}
+		}
+		path := storage.FieldPath(field)
+		docMapping := dataMapping
+		for _, parent := range path[:len(path)-1] {
+			docMapping = subDocumentMapping(docMapping, parent)
+		}
+		is.addValueMapping(docMapping, path, "")
+	}
+	return nil
+}
+
+// checkAnalyzers returns an error if a search index was built with different analyzers for its
+// text fields than they'd be indexed with now, including the keyword default of id fields, or
+// is missing a schema field's analyzer, as their words would need to be split again
+func (is *IndexStore) checkAnalyzers(searchIndex bleve.Index) error {
+	var err error
+	walkFieldMappings(searchIndex, func(field string, fieldMapping *mapping.FieldMapping) {
+		if fieldMapping.Type == "text" && fieldMapping.Analyzer != is.fieldAnalyzer(field) {
+			err = fmt.Errorf("Indexes were built with the '%s' analyzer for '%s'", fieldMapping.Analyzer, field)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for field, fieldSchema := range is.schema {
+		if fieldSchema.Analyzer == "" {
+			continue
+		}
+		analyzer := is.fieldAnalyzer(field)
+		found := false
+		for _, fieldMapping := range mappedFields(searchIndex, field) {
+			if fieldMapping.Type == "text" && fieldMapping.Analyzer == analyzer {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Indexes weren't built with the '%s' analyzer for '%s'", analyzer, field)
+		}
+	}
+	return nil
+}
+
+// mappedAnalyzer returns the analyzer a field's strings were indexed with, and whether they were
+// mapped as text at all. Id fields only seen after the mapping was built weren't mapped, so their
+// strings were split into words by bleve's default analyzer rather than indexed whole.
+func mappedAnalyzer(searchIndex bleve.Index, field string) (string, bool) {
+	for _, fieldMapping := range mappedFields(searchIndex, field) {
+		if fieldMapping.Type == "text" {
+			return fieldMapping.Analyzer, true
+		}
+	}
+	return "", false
+}
+
+// warnUnmappedIDFields logs the id fields of a record that weren't in the records sampled for
+// the mapping, once for each field in warned, as they can't be looked up exactly
+func warnUnmappedIDFields(searchIndex bleve.Index, record map[string]interface{}, warned map[string]bool) {
+	for field, value := range record {
+		if _, ok := value.(string); !ok || warned[field] || !IsIDField(field) {
+			continue
+		}
+		if _, ok := mappedAnalyzer(searchIndex, field); ok {
+			continue
+		}
+		warned[field] = true
+		log.WithFields(log.Fields{
+			"field": field,
+		}).Warn("Id field wasn't sampled for the mapping and is split into words, set its analyzer in the schema to match it whole")
+	}
+}
+
+// mappedFields returns the field mappings of a record field in a search index's mapping. Fields
+// only seen after the mapping was built are mapped dynamically and have none.
+func mappedFields(searchIndex bleve.Index, field string) []*mapping.FieldMapping {
+	if searchIndex == nil {
+		return nil
+	}
+	indexMapping, ok := searchIndex.Mapping().(*mapping.IndexMappingImpl)
+	if !ok || indexMapping.DefaultMapping == nil {
+		return nil
+	}
+	docMapping := indexMapping.DefaultMapping.Properties["Data"]
+	for _, name := range storage.FieldPath(field) {
+		if docMapping == nil {
+			return nil
+		}
+		docMapping = docMapping.Properties[name]
+	}
+	if docMapping == nil {
+		return nil
+	}
+	return docMapping.Fields
+}
+
+// walkFieldMappings calls fn with the path and field mappings of every record field in a search
+// index's mapping
+func walkFieldMappings(searchIndex bleve.Index, fn func(field string, fieldMapping *mapping.FieldMapping)) {
+	indexMapping, ok := searchIndex.Mapping().(*mapping.IndexMappingImpl)
+	if !ok || indexMapping.DefaultMapping == nil {
+		return
+	}
+	walkDocumentMapping(indexMapping.DefaultMapping.Properties["Data"], nil, fn)
+}
+
+func walkDocumentMapping(docMapping *mapping.DocumentMapping, path []string, fn func(field string, fieldMapping *mapping.FieldMapping)) {
+	if docMapping == nil {
+		return
+	}
+	for _, fieldMapping := range docMapping.Fields {
+		fn(strings.Join(path, "."), fieldMapping)
+	}
+	for name, subMapping := range docMapping.Properties {
+		walkDocumentMapping(subMapping, append(path[:len(path):len(path)], name), fn)
+	}
+}
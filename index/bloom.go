@@ -0,0 +1,104 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zachgoldstein/datatoapi/models"
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+// BloomIndexFile is the name of the file bloom filters are stored in, within the index path
+const BloomIndexFile = "blooms.json"
+
+// BloomIndex holds the data blocks built with bloom filters for a set of fields. Those fields
+// aren't in the search index, so lookups test every block's filter and only fetch the blocks
+// that may hold the value, trading a few wasted fetches for a much smaller index.
+type BloomIndex struct {
+	Fields     []string
+	KeyVersion int
+	Blocks     []models.DataBlock
+}
+
+// ReadBloomIndex reads the bloom index from an index path
+func ReadBloomIndex(path string) (*BloomIndex, error) {
+	indexBytes, err := ioutil.ReadFile(filepath.Join(path, BloomIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	bloomIndex := &BloomIndex{}
+	err = json.Unmarshal(indexBytes, bloomIndex)
+	if err != nil {
+		return nil, err
+	}
+	return bloomIndex, nil
+}
+
+// WriteBloomIndex writes the bloom index into an index path
+func WriteBloomIndex(path string, bloomIndex *BloomIndex) error {
+	indexBytes, err := json.Marshal(bloomIndex)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(path, BloomIndexFile), indexBytes, 0644)
+}
+
+// openBloomIndex loads the bloom index at path, checking it was built for the configured bloom
+// fields. Indexes built with different fields are missing them from the search index, so
+// they need to be rebuilt.
+func (is *IndexStore) openBloomIndex(path string) error {
+	bloomIndex, err := ReadBloomIndex(path)
+	if os.IsNotExist(err) && len(is.bloomFields) == 0 {
+		is.blooms = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !sameKeys(bloomIndex.Fields, is.bloomFields) {
+		return fmt.Errorf("Indexes were built with bloom fields %v", bloomIndex.Fields)
+	}
+	if len(is.bloomFields) > 0 && bloomIndex.KeyVersion != storage.BloomKeyVersion {
+		return fmt.Errorf("Bloom filters were built with version %d keys", bloomIndex.KeyVersion)
+	}
+	is.blooms = bloomIndex
+	return nil
+}
+
+// IsBloomField returns true if lookups on a field use bloom filters instead of the search index
+func (is *IndexStore) IsBloomField(field string) bool {
+	for _, bloomField := range is.bloomFields {
+		if field == bloomField {
+			return true
+		}
+	}
+	return false
+}
+
+// BloomBlocks returns the data blocks whose bloom filter for field may contain value
+func (is *IndexStore) BloomBlocks(field, value string) ([]models.DataBlock, error) {
+	if is.blooms == nil || !is.IsBloomField(field) {
+		return nil, fmt.Errorf("'%s' doesn't have bloom filters", field)
+	}
+	matches := []models.DataBlock{}
+	keys := storage.BloomLookupKeys(value)
+	for _, block := range is.blooms.Blocks {
+		for _, key := range keys {
+			if storage.BloomFilter(block.Blooms[field]).Test(key) {
+				matches = append(matches, block)
+				break
+			}
+		}
+	}
+	log.WithFields(log.Fields{
+		"field":     field,
+		"numBlocks": len(matches),
+		"numTested": len(is.blooms.Blocks),
+	}).Info("Found bloom filter blocks")
+	return matches, nil
+}
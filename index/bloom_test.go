@@ -0,0 +1,102 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/zachgoldstein/datatoapi/models"
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+// testBloomBlock creates a data block with a bloom filter of the values of the id field
+func testBloomBlock(key string, ids ...interface{}) models.DataBlock {
+	filter := storage.NewBloomFilter(len(ids), 0.01)
+	for _, id := range ids {
+		if bloomKey, ok := storage.BloomKey(id); ok {
+			filter.Add(bloomKey)
+		}
+	}
+	return models.DataBlock{RefKey: key, Blooms: map[string][]byte{"id": filter}}
+}
+
+func TestBloomBlocks(t *testing.T) {
+	is := NewIndexStore(nil, []string{"id"}, nil, storage.DefaultComparator)
+	is.blooms = &BloomIndex{
+		Fields:     []string{"id"},
+		KeyVersion: storage.BloomKeyVersion,
+		Blocks: []models.DataBlock{
+			testBloomBlock("b1", 1.0, 2.0, 1.5),
+			testBloomBlock("b2", 3.0, "abc"),
+			testBloomBlock("b3", "2020-01-02T10:00:00+02:00", 1.0),
+		},
+	}
+	tests := []struct {
+		field    string
+		value    string
+		expected []string
+		err      bool
+	}{
+		{field: "id", value: "1", expected: []string{"b1", "b3"}},
+		{field: "id", value: "1.50", expected: []string{"b1"}},
+		{field: "id", value: "abc", expected: []string{"b2"}},
+		{field: "id", value: "2020-01-02T08:00:00Z", expected: []string{"b3"}},
+		{field: "id", value: "42", expected: []string{}},
+		{field: "name", value: "abc", err: true},
+	}
+	for _, test := range tests {
+		blocks, err := is.BloomBlocks(test.field, test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("BloomBlocks(%q, %q) expected an error", test.field, test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("BloomBlocks(%q, %q) returned error: %s", test.field, test.value, err)
+			continue
+		}
+		keys := []string{}
+		for _, block := range blocks {
+			keys = append(keys, block.RefKey)
+		}
+		if !reflect.DeepEqual(keys, test.expected) {
+			t.Errorf("BloomBlocks(%q, %q) = %q, expected %q", test.field, test.value, keys, test.expected)
+		}
+	}
+}
+
+func TestOpenBloomIndex(t *testing.T) {
+	tests := []struct {
+		name        string
+		bloomFields []string
+		written     *BloomIndex
+		err         bool
+	}{
+		{name: "no bloom fields"},
+		{name: "missing bloom index", bloomFields: []string{"id"}, err: true},
+		{name: "same fields", bloomFields: []string{"id"}, written: &BloomIndex{Fields: []string{"id"}, KeyVersion: storage.BloomKeyVersion}},
+		{name: "different fields", bloomFields: []string{"id"}, written: &BloomIndex{Fields: []string{"email"}, KeyVersion: storage.BloomKeyVersion}, err: true},
+		{name: "bloom fields removed", written: &BloomIndex{Fields: []string{"id"}, KeyVersion: storage.BloomKeyVersion}, err: true},
+		{name: "old keys", bloomFields: []string{"id"}, written: &BloomIndex{Fields: []string{"id"}, KeyVersion: storage.BloomKeyVersion - 1}, err: true},
+	}
+	for _, test := range tests {
+		path, err := ioutil.TempDir("", "blooms")
+		if err != nil {
+			t.Fatalf("Could not create index path: %s", err)
+		}
+		defer os.RemoveAll(path)
+		if test.written != nil {
+			err = WriteBloomIndex(path, test.written)
+			if err != nil {
+				t.Fatalf("Could not write bloom index: %s", err)
+			}
+		}
+		is := NewIndexStore(nil, test.bloomFields, nil, storage.DefaultComparator)
+		err = is.openBloomIndex(path)
+		if test.err != (err != nil) {
+			t.Errorf("%s: openBloomIndex returned error %v, expected error: %t", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,573 @@
+package index
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+// DefaultQuerySize is the number of hits returned by a json query that doesn't set a size
+const DefaultQuerySize = 10
+
+// QueryRequest is a query described in json, used by POST /query
+//
+//	{
+//	  "query": {"and": [
+//	    {"term": {"field": "has_existential_identity_crisis", "value": true}},
+//	    {"range": {"field": "total_plumbuses", "gte": 1000}},
+//	    {"missing": {"field": "job"}}
+//	  ]},
+//	  "fields": ["id", "name", "address.city"],
+//	  "exclude": ["address.zip"],
+//	  "sort": ["-total_plumbuses"],
+//	  "size": 20,
+//	  "cursor": "..."
+//	}
+//
+// Fields and exclude project the records returned, see api.Projection.
+// Sort fields starting with - sort descending, and _score sorts by relevance. The cursor
+// returned with a page of hits fetches the page after it.
+type QueryRequest struct {
+	Query   *QueryClause `json:"query"`
+	Fields  []string     `json:"fields"`
+	Exclude []string     `json:"exclude"`
+	Sort    []string     `json:"sort"`
+	Size    int          `json:"size"`
+	Cursor  string       `json:"cursor"`
+}
+
+// QueryClause is a node of a json query. Exactly one of its members is set, and a clause
+// with none set matches every record.
+type QueryClause struct {
+	Term     *TermClause    `json:"term,omitempty"`
+	Range    *RangeClause   `json:"range,omitempty"`
+	Prefix   *PatternClause `json:"prefix,omitempty"`
+	Wildcard *PatternClause `json:"wildcard,omitempty"`
+	Regexp   *PatternClause `json:"regexp,omitempty"`
+	Fuzzy    *FuzzyClause   `json:"fuzzy,omitempty"`
+	Exists   *ExistsClause  `json:"exists,omitempty"`
+	Missing  *ExistsClause  `json:"missing,omitempty"`
+	And      []QueryClause  `json:"and,omitempty"`
+	Or       []QueryClause  `json:"or,omitempty"`
+	Not      *QueryClause   `json:"not,omitempty"`
+}
+
+// TermClause matches records where a field equals a value
+type TermClause struct {
+	Field string      `json:"field"`
+	Value interface{} `json:"value"`
+}
+
+// RangeClause matches records where a field is within a range. Unset bounds are open.
+type RangeClause struct {
+	Field string      `json:"field"`
+	GT    interface{} `json:"gt,omitempty"`
+	GTE   interface{} `json:"gte,omitempty"`
+	LT    interface{} `json:"lt,omitempty"`
+	LTE   interface{} `json:"lte,omitempty"`
+}
+
+// PatternClause matches records where a word of a field starts with a prefix, matches
+// a wildcard pattern using * and ?, or matches a regular expression
+type PatternClause struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+// FuzzyClause matches records where a word of a field is within Fuzziness edits of a value
+type FuzzyClause struct {
+	Field     string `json:"field"`
+	Value     string `json:"value"`
+	Fuzziness int    `json:"fuzziness"`
+}
+
+// ExistsClause matches records that hold a value in a field, or for missing clauses records
+// where the field is absent or null
+type ExistsClause struct {
+	Field string `json:"field"`
+}
+
+// Condition converts the clause into a condition, describing the first problem found
+func (c QueryClause) Condition() (Condition, error) {
+	set := 0
+	for _, isSet := range []bool{c.Term != nil, c.Range != nil, c.Prefix != nil, c.Wildcard != nil,
+		c.Regexp != nil, c.Fuzzy != nil, c.Exists != nil, c.Missing != nil, c.And != nil, c.Or != nil, c.Not != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("Query clauses should only set one of term, range, prefix, wildcard, regexp, fuzzy, exists, missing, and, or, not")
+	}
+
+	switch {
+	case c.Term != nil:
+		if c.Term.Field == "" {
+			return nil, fmt.Errorf("term clause needs a field")
+		}
+		value, err := clauseValue(c.Term.Value)
+		if err != nil {
+			return nil, err
+		}
+		return FieldCondition{Field: c.Term.Field, Op: OpEquals, Value: value}, nil
+	case c.Range != nil:
+		return c.Range.condition()
+	case c.Prefix != nil:
+		if c.Prefix.Field == "" || c.Prefix.Value == "" {
+			return nil, fmt.Errorf("prefix clause needs a field and value")
+		}
+		return PrefixCondition{Field: c.Prefix.Field, Prefix: c.Prefix.Value}, nil
+	case c.Wildcard != nil:
+		if c.Wildcard.Field == "" || c.Wildcard.Value == "" {
+			return nil, fmt.Errorf("wildcard clause needs a field and value")
+		}
+		return NewWildcardCondition(c.Wildcard.Field, c.Wildcard.Value)
+	case c.Regexp != nil:
+		if c.Regexp.Field == "" || c.Regexp.Value == "" {
+			return nil, fmt.Errorf("regexp clause needs a field and value")
+		}
+		return NewRegexpCondition(c.Regexp.Field, c.Regexp.Value)
+	case c.Fuzzy != nil:
+		if c.Fuzzy.Field == "" || c.Fuzzy.Value == "" {
+			return nil, fmt.Errorf("fuzzy clause needs a field and value")
+		}
+		if c.Fuzzy.Fuzziness < 0 {
+			return nil, fmt.Errorf("fuzzy clause fuzziness shouldn't be negative")
+		}
+		fuzziness := c.Fuzzy.Fuzziness
+		if fuzziness == 0 {
+			fuzziness = DefaultFuzziness
+		}
+		if fuzziness > MaxFuzziness {
+			fuzziness = MaxFuzziness
+		}
+		return FuzzyCondition{Field: c.Fuzzy.Field, Value: c.Fuzzy.Value, Fuzziness: fuzziness}, nil
+	case c.Exists != nil:
+		if c.Exists.Field == "" {
+			return nil, fmt.Errorf("exists clause needs a field")
+		}
+		return ExistsCondition{Field: c.Exists.Field}, nil
+	case c.Missing != nil:
+		if c.Missing.Field == "" {
+			return nil, fmt.Errorf("missing clause needs a field")
+		}
+		return MissingCondition{Field: c.Missing.Field}, nil
+	case c.And != nil:
+		conditions, err := clauseConditions(c.And)
+		if err != nil {
+			return nil, err
+		}
+		return AndCondition{Conditions: conditions}, nil
+	case c.Or != nil:
+		conditions, err := clauseConditions(c.Or)
+		if err != nil {
+			return nil, err
+		}
+		return OrCondition{Conditions: conditions}, nil
+	case c.Not != nil:
+		condition, err := c.Not.Condition()
+		if err != nil {
+			return nil, err
+		}
+		return NotCondition{Condition: condition}, nil
+	}
+	return MatchAllCondition{}, nil
+}
+
+func clauseConditions(clauses []QueryClause) ([]Condition, error) {
+	if len(clauses) == 0 {
+		return nil, fmt.Errorf("and/or clauses need at least one clause")
+	}
+	conditions := []Condition{}
+	for _, clause := range clauses {
+		condition, err := clause.Condition()
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+func (c RangeClause) condition() (Condition, error) {
+	if c.Field == "" {
+		return nil, fmt.Errorf("range clause needs a field")
+	}
+	conditions := []Condition{}
+	for _, bound := range []struct {
+		op    string
+		value interface{}
+	}{{OpGreater, c.GT}, {OpGreaterOrEqual, c.GTE}, {OpLess, c.LT}, {OpLessOrEqual, c.LTE}} {
+		if bound.value == nil {
+			continue
+		}
+		value, err := clauseValue(bound.value)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, FieldCondition{Field: c.Field, Op: bound.op, Value: value})
+	}
+	if len(conditions) == 0 {
+		return nil, fmt.Errorf("range clause on '%s' needs at least one of gt, gte, lt, lte", c.Field)
+	}
+	if len(conditions) == 1 {
+		return conditions[0], nil
+	}
+	return AndCondition{Conditions: conditions}, nil
+}
+
+// clauseValue converts a json value from a clause to the string form conditions compare with
+func clauseValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	}
+	return "", fmt.Errorf("Query values should be a string, number or bool, got %v", value)
+}
+
+// MatchAllCondition matches every record
+type MatchAllCondition struct{}
+
+// BleveQuery matches every document
+func (c MatchAllCondition) BleveQuery() query.Query {
+	return bleve.NewMatchAllQuery()
+}
+
+// Match returns true for every record
+func (c MatchAllCondition) Match(record map[string]interface{}) bool {
+	return true
+}
+
+// Fields returns no fields
+func (c MatchAllCondition) Fields() []string {
+	return []string{}
+}
+
+// bind returns the condition unchanged, it has no fields
+func (c MatchAllCondition) bind(indexing func(field string) fieldIndexing) (Condition, error) {
+	return c, nil
+}
+
+// PrefixCondition matches records where a word of a field starts with a prefix, ignoring case.
+// Keyword fields match the start of their whole values, keeping case.
+type PrefixCondition struct {
+	Field    string
+	Prefix   string
+	indexing fieldIndexing
+}
+
+// BleveQuery builds a prefix query on the prefix in the form the field's terms are indexed in
+func (c PrefixCondition) BleveQuery() query.Query {
+	q := bleve.NewPrefixQuery(c.indexing.term(c.Prefix))
+	q.SetField(dataField(c.Field))
+	return q
+}
+
+// Match returns true if a word of the field starts with the prefix
+func (c PrefixCondition) Match(record map[string]interface{}) bool {
+	prefix := c.indexing.term(c.Prefix)
+	return c.indexing.matchTerms(storage.FieldValues(record, c.Field), func(term string) bool {
+		return strings.HasPrefix(term, prefix)
+	})
+}
+
+// Fields returns the condition's field
+func (c PrefixCondition) Fields() []string {
+	return []string{c.Field}
+}
+
+// bind sets up the condition for how its field's terms were indexed
+func (c PrefixCondition) bind(indexing func(field string) fieldIndexing) (Condition, error) {
+	c.indexing = indexing(c.Field)
+	return c, nil
+}
+
+// WildcardCondition matches records where a word of a field matches a pattern,
+// where * matches any number of characters and ? matches one. Keyword fields match
+// their whole values, keeping case.
+type WildcardCondition struct {
+	Field    string
+	Pattern  string
+	regexp   *regexp.Regexp
+	indexing fieldIndexing
+}
+
+// NewWildcardCondition creates a WildcardCondition, compiling its pattern for matching records
+func NewWildcardCondition(field, pattern string) (WildcardCondition, error) {
+	c := WildcardCondition{Field: field, Pattern: pattern}
+	var err error
+	c.regexp, err = c.compile()
+	if err != nil {
+		return WildcardCondition{}, err
+	}
+	return c, nil
+}
+
+// compile converts the pattern, in the form the field's terms are indexed in, to a regexp
+func (c WildcardCondition) compile() (*regexp.Regexp, error) {
+	expr := regexp.QuoteMeta(c.indexing.term(c.Pattern))
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	return regexp.Compile("^" + expr + "$")
+}
+
+// BleveQuery builds a wildcard query on the pattern in the form the field's terms are indexed in
+func (c WildcardCondition) BleveQuery() query.Query {
+	q := bleve.NewWildcardQuery(c.indexing.term(c.Pattern))
+	q.SetField(dataField(c.Field))
+	return q
+}
+
+// Match returns true if a word of the field matches the pattern
+func (c WildcardCondition) Match(record map[string]interface{}) bool {
+	return c.indexing.matchTerms(storage.FieldValues(record, c.Field), c.regexp.MatchString)
+}
+
+// Fields returns the condition's field
+func (c WildcardCondition) Fields() []string {
+	return []string{c.Field}
+}
+
+// bind sets up the condition for how its field's terms were indexed
+func (c WildcardCondition) bind(indexing func(field string) fieldIndexing) (Condition, error) {
+	c.indexing = indexing(c.Field)
+	var err error
+	c.regexp, err = c.compile()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// FuzzyCondition matches records where a word of a field is within Fuzziness edits of a value.
+// Keyword fields compare their whole values, keeping case.
+type FuzzyCondition struct {
+	Field     string
+	Value     string
+	Fuzziness int
+	indexing  fieldIndexing
+}
+
+// BleveQuery builds a fuzzy query on the value in the form the field's terms are indexed in
+func (c FuzzyCondition) BleveQuery() query.Query {
+	q := bleve.NewFuzzyQuery(c.indexing.term(c.Value))
+	q.SetField(dataField(c.Field))
+	q.SetFuzziness(c.Fuzziness)
+	return q
+}
+
+// Match returns true if a word of the field is close enough to the value
+func (c FuzzyCondition) Match(record map[string]interface{}) bool {
+	value := c.indexing.term(c.Value)
+	return c.indexing.matchTerms(storage.FieldValues(record, c.Field), func(term string) bool {
+		return editDistance(term, value) <= c.Fuzziness
+	})
+}
+
+// Fields returns the condition's field
+func (c FuzzyCondition) Fields() []string {
+	return []string{c.Field}
+}
+
+// bind sets up the condition for how its field's terms were indexed
+func (c FuzzyCondition) bind(indexing func(field string) fieldIndexing) (Condition, error) {
+	c.indexing = indexing(c.Field)
+	return c, nil
+}
+
+// term converts a value to the form a field's terms are indexed in, whole for keyword fields
+// and lower cased for words
+func (indexing fieldIndexing) term(value string) string {
+	if indexing.keyword {
+		return value
+	}
+	return strings.ToLower(value)
+}
+
+// matchTerms calls match with each term of a field's string values, the way the search index
+// holds them. Keyword fields hold whole values, and other fields their lower cased words.
+func (indexing fieldIndexing) matchTerms(values []interface{}, match func(term string) bool) bool {
+	if !indexing.keyword {
+		return matchWords(values, match)
+	}
+	for _, value := range values {
+		if text, ok := value.(string); ok && match(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWords calls match with each lower cased word of a field's string values
+func matchWords(values []interface{}, match func(word string) bool) bool {
+	for _, value := range values {
+		text, ok := value.(string)
+		if !ok {
+			continue
+		}
+		for _, word := range splitWords(text) {
+			if match(word) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// editDistance is the levenshtein distance between two strings
+func editDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		curr := make([]int, len(br)+1)
+		curr[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, minInt(curr[j-1]+1, prev[j-1]+cost))
+		}
+		prev = curr
+	}
+	return prev[len(br)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// queryCursor is where the next page of a json query starts. Bleve can only search after a hit
+// when sorting by fields, so pages sorted by score skip the hits already returned instead.
+type queryCursor struct {
+	After []string `json:"after,omitempty"`
+	From  int      `json:"from,omitempty"`
+}
+
+// encodeCursor converts the position of the next page into a cursor
+func encodeCursor(cursor queryCursor) string {
+	cursorBytes, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(cursorBytes)
+}
+
+// decodeCursor reads the position of a page out of a cursor
+func decodeCursor(encoded string) (queryCursor, error) {
+	cursor := queryCursor{}
+	cursorBytes, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, fmt.Errorf("Cursor is invalid: %s", err)
+	}
+	err = json.Unmarshal(cursorBytes, &cursor)
+	if err != nil {
+		return cursor, fmt.Errorf("Cursor is invalid: %s", err)
+	}
+	return cursor, nil
+}
+
+// searchSort converts sort fields from a request into bleve's, adding the document id to break ties
+// so cursors never skip or repeat hits
+func searchSort(sortFields []string) []string {
+	sort := []string{}
+	for _, field := range sortFields {
+		descending := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+		if field != "_score" && field != "_id" {
+			field = dataField(field)
+		}
+		if descending {
+			field = "-" + field
+		}
+		sort = append(sort, field)
+	}
+	if len(sort) == 0 {
+		sort = append(sort, "-_score")
+	}
+	return append(sort, "_id")
+}
+
+// sortsByScore returns true if a bleve sort orders hits by relevance
+func sortsByScore(sort []string) bool {
+	for _, field := range sort {
+		if strings.TrimPrefix(field, "-") == "_score" {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchQuery runs a json query, returning a page of hits in the requested order and the cursor
+// of the page after it, which is empty on the last page.
+// Used for requests of the form POST /query
+func (is *IndexStore) SearchQuery(ctx context.Context, request QueryRequest, condition Condition) (*bleve.SearchResult, string, error) {
+	for _, field := range condition.Fields() {
+		if is.IsBloomField(field) {
+			return nil, "", fmt.Errorf("'%s' is looked up with bloom filters and isn't in the search index", field)
+		}
+	}
+	size := request.Size
+	if size == 0 {
+		size = DefaultQuerySize
+	}
+	sort := searchSort(request.Sort)
+	byScore := sortsByScore(sort)
+
+	cursor := queryCursor{}
+	if request.Cursor != "" {
+		var err error
+		cursor, err = decodeCursor(request.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if byScore != (cursor.After == nil) {
+			return nil, "", fmt.Errorf("Cursor doesn't match the query's sort")
+		}
+		if cursor.After != nil && len(cursor.After) != len(sort) {
+			return nil, "", fmt.Errorf("Cursor doesn't match the query's sort")
+		}
+	}
+
+	searchReq := bleve.NewSearchRequestOptions(condition.BleveQuery(), size, cursor.From, false)
+	searchReq.Fields = []string{"RefKey", "Offset"}
+	searchReq.SortBy(sort)
+	if cursor.After != nil {
+		searchReq.SetSearchAfter(cursor.After)
+	}
+
+	log.WithFields(log.Fields{
+		"size": size,
+		"sort": strings.Join(request.Sort, ","),
+	}).Info("Searching with json query")
+	searchResults, err := is.searchIndex.SearchInContext(ctx, searchReq)
+	if err != nil {
+		log.WithError(err).Error("Error finding search Index")
+		return nil, "", err
+	}
+	if len(searchResults.Hits) < size {
+		return searchResults, "", nil
+	}
+	next := queryCursor{From: cursor.From + size}
+	if !byScore {
+		next = queryCursor{After: searchResults.Hits[len(searchResults.Hits)-1].Sort}
+	}
+	return searchResults, encodeCursor(next), nil
+}
@@ -0,0 +1,179 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+func TestQueryClauseCondition(t *testing.T) {
+	wildcard, _ := NewWildcardCondition("name", "sm?th*")
+	regexpCondition, _ := NewRegexpCondition("name", "sm.th")
+	tests := []struct {
+		clause   string
+		expected Condition
+		err      bool
+	}{
+		{clause: `{}`, expected: MatchAllCondition{}},
+		{clause: `{"term": {"field": "job", "value": "plumber"}}`, expected: FieldCondition{Field: "job", Op: OpEquals, Value: "plumber"}},
+		{clause: `{"term": {"field": "total", "value": 1000.5}}`, expected: FieldCondition{Field: "total", Op: OpEquals, Value: "1000.5"}},
+		{clause: `{"term": {"field": "total", "value": 1e21}}`, expected: FieldCondition{Field: "total", Op: OpEquals, Value: "1000000000000000000000"}},
+		{clause: `{"term": {"field": "alive", "value": true}}`, expected: FieldCondition{Field: "alive", Op: OpEquals, Value: "true"}},
+		{clause: `{"range": {"field": "total", "gt": 10}}`, expected: FieldCondition{Field: "total", Op: OpGreater, Value: "10"}},
+		{
+			clause: `{"range": {"field": "total", "gte": 10, "lt": 20}}`,
+			expected: AndCondition{Conditions: []Condition{
+				FieldCondition{Field: "total", Op: OpGreaterOrEqual, Value: "10"},
+				FieldCondition{Field: "total", Op: OpLess, Value: "20"},
+			}},
+		},
+		{clause: `{"range": {"field": "created", "lte": "2020-01-01"}}`, expected: FieldCondition{Field: "created", Op: OpLessOrEqual, Value: "2020-01-01"}},
+		{clause: `{"prefix": {"field": "name", "value": "Sm"}}`, expected: PrefixCondition{Field: "name", Prefix: "Sm"}},
+		{clause: `{"wildcard": {"field": "name", "value": "sm?th*"}}`, expected: wildcard},
+		{clause: `{"regexp": {"field": "name", "value": "sm.th"}}`, expected: regexpCondition},
+		{clause: `{"fuzzy": {"field": "name", "value": "smyth"}}`, expected: FuzzyCondition{Field: "name", Value: "smyth", Fuzziness: DefaultFuzziness}},
+		{clause: `{"fuzzy": {"field": "name", "value": "smyth", "fuzziness": 2}}`, expected: FuzzyCondition{Field: "name", Value: "smyth", Fuzziness: 2}},
+		{clause: `{"fuzzy": {"field": "name", "value": "smyth", "fuzziness": 3}}`, expected: FuzzyCondition{Field: "name", Value: "smyth", Fuzziness: MaxFuzziness}},
+		{clause: `{"exists": {"field": "job"}}`, expected: ExistsCondition{Field: "job"}},
+		{clause: `{"missing": {"field": "job"}}`, expected: MissingCondition{Field: "job"}},
+		{
+			clause: `{"or": [{"term": {"field": "a", "value": 1}}, {"not": {"exists": {"field": "b"}}}]}`,
+			expected: OrCondition{Conditions: []Condition{
+				FieldCondition{Field: "a", Op: OpEquals, Value: "1"},
+				NotCondition{Condition: ExistsCondition{Field: "b"}},
+			}},
+		},
+		{clause: `{"and": [{}]}`, expected: AndCondition{Conditions: []Condition{MatchAllCondition{}}}},
+		{clause: `{"term": {"field": "a", "value": 1}, "exists": {"field": "a"}}`, err: true},
+		{clause: `{"term": {"value": 1}}`, err: true},
+		{clause: `{"term": {"field": "a", "value": null}}`, err: true},
+		{clause: `{"term": {"field": "a", "value": [1]}}`, err: true},
+		{clause: `{"range": {"field": "a"}}`, err: true},
+		{clause: `{"range": {"gt": 1}}`, err: true},
+		{clause: `{"prefix": {"field": "a"}}`, err: true},
+		{clause: `{"wildcard": {"value": "a*"}}`, err: true},
+		{clause: `{"regexp": {"field": "a", "value": "("}}`, err: true},
+		{clause: `{"fuzzy": {"field": "a", "value": "b", "fuzziness": -1}}`, err: true},
+		{clause: `{"exists": {}}`, err: true},
+		{clause: `{"missing": {}}`, err: true},
+		{clause: `{"and": []}`, err: true},
+		{clause: `{"or": [{"exists": {}}]}`, err: true},
+		{clause: `{"not": {"range": {"field": "a"}}}`, err: true},
+	}
+	for _, test := range tests {
+		clause := QueryClause{}
+		err := json.Unmarshal([]byte(test.clause), &clause)
+		if err != nil {
+			t.Fatalf("Could not read clause %s: %s", test.clause, err)
+		}
+		condition, err := clause.Condition()
+		if test.err {
+			if err == nil {
+				t.Errorf("%s converted to %#v, expected an error", test.clause, condition)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s returned error: %s", test.clause, err)
+			continue
+		}
+		if !reflect.DeepEqual(condition, test.expected) {
+			t.Errorf("%s converted to %#v, expected %#v", test.clause, condition, test.expected)
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	tests := []queryCursor{
+		{},
+		{From: 20},
+		{After: []string{"abc", "r1"}},
+		{After: []string{"", "id with spaces/and+symbols"}},
+	}
+	for _, cursor := range tests {
+		decoded, err := decodeCursor(encodeCursor(cursor))
+		if err != nil {
+			t.Errorf("Could not decode cursor %#v: %s", cursor, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, cursor) {
+			t.Errorf("Cursor %#v decoded to %#v", cursor, decoded)
+		}
+	}
+
+	for _, encoded := range []string{"not base64!", "bm90IGpzb24", "W10"} {
+		_, err := decodeCursor(encoded)
+		if err == nil {
+			t.Errorf("decodeCursor(%q) expected an error", encoded)
+		}
+	}
+}
+
+func TestSearchSort(t *testing.T) {
+	tests := []struct {
+		sort     []string
+		expected []string
+		byScore  bool
+	}{
+		{sort: nil, expected: []string{"-_score", "_id"}, byScore: true},
+		{sort: []string{"age"}, expected: []string{"Data.age", "_id"}},
+		{sort: []string{"-address.city", "_score"}, expected: []string{"-Data.address.city", "_score", "_id"}, byScore: true},
+		{sort: []string{"tags[]", "-_id"}, expected: []string{"Data.tags", "-_id", "_id"}},
+	}
+	for _, test := range tests {
+		sort := searchSort(test.sort)
+		if !reflect.DeepEqual(sort, test.expected) {
+			t.Errorf("searchSort(%q) = %q, expected %q", test.sort, sort, test.expected)
+		}
+		if sortsByScore(sort) != test.byScore {
+			t.Errorf("sortsByScore(%q) = %t, expected %t", sort, !test.byScore, test.byScore)
+		}
+	}
+}
+
+func TestSearchQueryPages(t *testing.T) {
+	is, _ := newTestIndexStore(t, nil, storage.ValueComparator{}, testRecords)
+	defer is.searchIndex.Close()
+
+	tests := []struct {
+		sort     []string
+		expected []string
+	}{
+		{sort: nil, expected: []string{"r1", "r2", "r3", "r4"}},
+		{sort: []string{"id"}, expected: []string{"r1", "r3", "r2", "r4"}},
+		{sort: []string{"-id"}, expected: []string{"r4", "r2", "r3", "r1"}},
+	}
+	for _, test := range tests {
+		ids := []string{}
+		request := QueryRequest{Sort: test.sort, Size: 3}
+		for page := 0; page < 3; page++ {
+			results, cursor, err := is.SearchQuery(context.Background(), request, MatchAllCondition{})
+			if err != nil {
+				t.Fatalf("Could not search with sort %q: %s", test.sort, err)
+			}
+			for _, hit := range results.Hits {
+				ids = append(ids, hit.ID)
+			}
+			if cursor == "" {
+				break
+			}
+			request.Cursor = cursor
+		}
+		if test.sort == nil {
+			// Every record scores the same, so only the records returned are checked
+			sort.Strings(ids)
+		}
+		if !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("Pages sorted by %q returned %v, expected %v", test.sort, ids, test.expected)
+		}
+	}
+
+	_, _, err := is.SearchQuery(context.Background(), QueryRequest{Sort: []string{"id"}, Cursor: encodeCursor(queryCursor{From: 3})}, MatchAllCondition{})
+	if err == nil {
+		t.Errorf("A score cursor on a query sorted by field expected an error")
+	}
+}
@@ -1,7 +1,9 @@
 package index
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -10,8 +12,10 @@ import (
 	"time"
 
 	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
 	"github.com/blevesearch/bleve/mapping"
 	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/zachgoldstein/datatoapi/models"
@@ -19,20 +23,31 @@ import (
 )
 
 type IndexStorer interface {
-	Start(path string) error
-	CreateNewIndexes(searchPath, dataPath string) (searchIndex, dataIndex bleve.Index, err error)
-	BuildDataMapping() (*mapping.IndexMappingImpl, error)
-	BuildIndexes(searchIndex, dataIndex bleve.Index) error
-	GetDataBlock(refKey string) (*models.DataBlock, error)
-	GetSearchIndex(uid string) (*models.IndexData, error)
+	Start(ctx context.Context, path string) error
+	CreateNewIndexes(ctx context.Context, searchPath, dataPath string) (searchIndex, dataIndex bleve.Index, err error)
+	BuildDataMapping(ctx context.Context) (*mapping.IndexMappingImpl, error)
+	BuildIndexes(ctx context.Context, searchIndex, dataIndex bleve.Index) error
+	RebuildIndexes(ctx context.Context, path string) (searchIndex, dataIndex bleve.Index, err error)
+	Close() error
+	GetDataBlock(ctx context.Context, refKey string) (*models.DataBlock, error)
+	GetSearchIndex(ctx context.Context, uid string) (*models.IndexData, error)
 	buildSearchRequest(field, searchString string) *bleve.SearchRequest
-	SearchHits(searchString string, params map[string][]string) (search.DocumentMatchCollection, error)
-	GetHits(field, searchString string) (search.DocumentMatchCollection, error)
+	SearchHits(ctx context.Context, textSearch TextSearch) (*bleve.SearchResult, error)
+	GetHits(ctx context.Context, field, searchString string, size int) (search.DocumentMatchCollection, error)
 }
 
 // DefaultChanSize defines the default channel size to use when processing indexes
 const DefaultChanSize = storage.BLOCK_SIZE * 2
 
+// SearchIndexDir and DataIndexDir are the directories each index is stored in, within the index path
+const (
+	SearchIndexDir = "search"
+	DataIndexDir   = "data"
+)
+
+// BuildDirSuffix is appended to the index path to name the temporary directory indexes are built in
+const BuildDirSuffix = ".building-"
+
 // IndexPrintFreq defines how frequently we should print out a message when indexing
 const IndexPrintFreq = 30
 
@@ -54,18 +69,33 @@ type IndexStore struct {
 	store       storage.PhysicalStorer
 	dataIndex   bleve.Index
 	searchIndex bleve.Index
+	bloomFields []string
+	blooms      *BloomIndex
+	schema      models.Schema
+	comparator  storage.ValueComparator
 }
 
-// NewIndexStore creates an IndexStore pointer with a storage object
-func NewIndexStore(store storage.PhysicalStorer) *IndexStore {
+// NewIndexStore creates an IndexStore pointer with a storage object, the fields looked up
+// with bloom filters rather than the search index, if any, the dataset's schema, which
+// may set how fields are analyzed, and the comparator lookups match values with
+func NewIndexStore(store storage.PhysicalStorer, bloomFields []string, schema models.Schema, comparator storage.ValueComparator) *IndexStore {
 	return &IndexStore{
-		store: store,
+		store:       store,
+		bloomFields: bloomFields,
+		schema:      schema,
+		comparator:  comparator,
 	}
 }
 
+// Comparator returns the comparator lookups match values with, which records found in data
+// blocks should be matched with too
+func (is *IndexStore) Comparator() storage.ValueComparator {
+	return is.comparator
+}
+
 // Start will open an existing index (or create one), making it available for searching
-func (is *IndexStore) Start(path string) error {
-	err := is.InitIndexes(path)
+func (is *IndexStore) Start(ctx context.Context, path string) error {
+	err := is.InitIndexes(ctx, path)
 	if err != nil {
 		return err
 	}
@@ -74,21 +104,39 @@ func (is *IndexStore) Start(path string) error {
 	return nil
 }
 
-// InitIndexes will get or create an index with a path
-func (is *IndexStore) InitIndexes(path string) error {
-	dataPath := filepath.Join(path, "data")
-	searchPath := filepath.Join(path, "search")
-	// We only check for the data index to exist.
-	// Assume either both or no indexes.
-	searchIndex, err := bleve.Open(searchPath)
-	dataIndex, err := bleve.Open(dataPath)
+// InitIndexes will open the indexes at a path, or build them if they are missing or invalid.
+// Indexes are only opened if a complete manifest exists and matches their contents, and
+// they were built with the configured bloom fields and schema analyzers.
+func (is *IndexStore) InitIndexes(ctx context.Context, path string) error {
+	err := RemoveStaleBuilds(path)
 	if err != nil {
-		log.WithFields(log.Fields{
+		return err
+	}
+
+	searchIndex, dataIndex, err := OpenIndexes(path)
+	if err == nil {
+		err = is.openBloomIndex(path)
+		if err == nil {
+			err = is.checkSearchMapping(searchIndex)
+		}
+		if err != nil {
+			searchIndex.Close()
+			dataIndex.Close()
+		}
+	}
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
 			"path": path,
-		}).Info("Could not find indexes")
+		}).Info("Could not find valid indexes")
 
-		searchIndex, dataIndex, err = is.CreateNewIndexes(searchPath, dataPath)
+		searchIndex, dataIndex, err = is.RebuildIndexes(ctx, path)
+		if err != nil {
+			return err
+		}
+		err = is.openBloomIndex(path)
 		if err != nil {
+			searchIndex.Close()
+			dataIndex.Close()
 			return err
 		}
 	} else {
@@ -101,9 +149,102 @@ func (is *IndexStore) InitIndexes(path string) error {
 	return nil
 }
 
+// OpenIndexes opens the search and data indexes at a path, validating them against the build manifest
+func OpenIndexes(path string) (searchIndex, dataIndex bleve.Index, err error) {
+	manifest, err := ReadManifest(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	searchIndex, err = bleve.Open(filepath.Join(path, SearchIndexDir))
+	if err != nil {
+		return nil, nil, err
+	}
+	dataIndex, err = bleve.Open(filepath.Join(path, DataIndexDir))
+	if err != nil {
+		searchIndex.Close()
+		return nil, nil, err
+	}
+	err = manifest.Validate(searchIndex, dataIndex)
+	if err != nil {
+		searchIndex.Close()
+		dataIndex.Close()
+		return nil, nil, err
+	}
+	return searchIndex, dataIndex, nil
+}
+
+// RebuildIndexes builds both indexes in a temporary directory next to path, writes a manifest
+// once they are complete, and only then renames the directory into place. A crash at any point
+// leaves either the previous indexes or nothing at path, never a partial build.
+func (is *IndexStore) RebuildIndexes(ctx context.Context, path string) (searchIndex, dataIndex bleve.Index, err error) {
+	buildPath := fmt.Sprintf("%s%s%d", filepath.Clean(path), BuildDirSuffix, time.Now().UnixNano())
+	log.WithFields(log.Fields{
+		"path":      path,
+		"buildPath": buildPath,
+	}).Info("Building indexes in temporary directory")
+
+	err = os.MkdirAll(buildPath, 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+	searchIndex, dataIndex, err = is.CreateNewIndexes(ctx, filepath.Join(buildPath, SearchIndexDir), filepath.Join(buildPath, DataIndexDir))
+	if err != nil {
+		os.RemoveAll(buildPath)
+		return nil, nil, err
+	}
+
+	manifest, err := NewManifest(searchIndex, dataIndex)
+	searchIndex.Close()
+	dataIndex.Close()
+	if err != nil {
+		os.RemoveAll(buildPath)
+		return nil, nil, err
+	}
+	if is.blooms != nil {
+		err = WriteBloomIndex(buildPath, is.blooms)
+		if err != nil {
+			os.RemoveAll(buildPath)
+			return nil, nil, err
+		}
+	}
+	err = WriteManifest(buildPath, manifest)
+	if err != nil {
+		os.RemoveAll(buildPath)
+		return nil, nil, err
+	}
+
+	err = os.RemoveAll(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.Rename(buildPath, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return OpenIndexes(path)
+}
+
+// RemoveStaleBuilds deletes temporary build directories left behind by interrupted builds
+func RemoveStaleBuilds(path string) error {
+	staleBuilds, err := filepath.Glob(filepath.Clean(path) + BuildDirSuffix + "*")
+	if err != nil {
+		return err
+	}
+	for _, staleBuild := range staleBuilds {
+		log.WithFields(log.Fields{
+			"buildPath": staleBuild,
+		}).Warn("Removing incomplete index build")
+		err = os.RemoveAll(staleBuild)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // CreateNewIndexes creates a new index, builds a mapping for this index and populates it with all data
-func (is *IndexStore) CreateNewIndexes(searchPath, dataPath string) (searchIndex, dataIndex bleve.Index, err error) {
-	mapping, err := is.BuildDataMapping()
+func (is *IndexStore) CreateNewIndexes(ctx context.Context, searchPath, dataPath string) (searchIndex, dataIndex bleve.Index, err error) {
+	mapping, err := is.BuildDataMapping(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -113,32 +254,58 @@ func (is *IndexStore) CreateNewIndexes(searchPath, dataPath string) (searchIndex
 		return nil, nil, err
 	}
 
+	// Reference keys contain file paths and urls, so they are indexed whole and looked up exactly
 	dataBlockMapping := bleve.NewIndexMapping()
 	dataMapping := bleve.NewDocumentMapping()
-	dataBlockMapping.AddDocumentMapping("data", dataMapping)
+	dataBlockMapping.DefaultMapping = dataMapping
 	strFieldMapping := bleve.NewTextFieldMapping()
+	strFieldMapping.Analyzer = keyword.Name
 	dataMapping.AddFieldMappingsAt("RefKey", strFieldMapping)
 
 	dataIndex, err = bleve.New(dataPath, dataBlockMapping)
 	if err != nil {
+		searchIndex.Close()
 		return nil, nil, err
 	}
 
-	err = is.BuildIndexes(searchIndex, dataIndex)
+	err = is.BuildIndexes(ctx, searchIndex, dataIndex)
 	if err != nil {
+		searchIndex.Close()
+		dataIndex.Close()
 		return nil, nil, err
 	}
 	return searchIndex, dataIndex, nil
 }
 
-// BuildDataMapping builds an index mapping with all the data sent over a channel
-func (is *IndexStore) BuildDataMapping() (*mapping.IndexMappingImpl, error) {
+// Close closes both indexes, flushing anything written to them to disk
+func (is *IndexStore) Close() error {
+	var firstErr error
+	for _, idx := range []bleve.Index{is.searchIndex, is.dataIndex} {
+		if idx == nil {
+			continue
+		}
+		err := idx.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	log.Info("Closed index store")
+	return firstErr
+}
+
+// BuildDataMapping builds an index mapping with all the data sent over a channel.
+// Scanning is cancelled once enough records have been seen to build the mapping.
+func (is *IndexStore) BuildDataMapping(ctx context.Context) (*mapping.IndexMappingImpl, error) {
 	log.Info("Building index mapping")
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	dataChan := make(chan models.IndexData, DefaultChanSize)
 	blockChan := make(chan models.DataBlock, DefaultChanSize)
 	statusChan := make(chan interface{}, DefaultChanSize)
-	go is.store.ScanDataBlocks(dataChan, blockChan)
+	defer close(statusChan)
+	go is.store.ScanDataBlocks(ctx, dataChan, blockChan)
 
 	status := &IndexingStatus{
 		Mutex:          &sync.Mutex{},
@@ -147,9 +314,16 @@ func (is *IndexStore) BuildDataMapping() (*mapping.IndexMappingImpl, error) {
 
 	go LogStatusChannel(statusChan, status)
 
+	// Records are indexed under the Data field of models.IndexData, fields not seen while
+	// building the mapping are still mapped dynamically
 	indexMapping := bleve.NewIndexMapping()
 	dataMapping := bleve.NewDocumentMapping()
-	indexMapping.AddDocumentMapping("data", dataMapping)
+	indexMapping.DefaultMapping.AddSubDocumentMapping("Data", dataMapping)
+	addPresenceMappings(indexMapping)
+	err := is.addSchemaAnalyzers(indexMapping, dataMapping)
+	if err != nil {
+		return nil, err
+	}
 
 	go func() {
 		for _ = range blockChan {
@@ -163,41 +337,17 @@ func (is *IndexStore) BuildDataMapping() (*mapping.IndexMappingImpl, error) {
 			break
 		}
 		for k, v := range data.Data {
-			_, ok := v.(string)
-			if ok {
-				strFieldMapping := bleve.NewTextFieldMapping()
-				dataMapping.AddFieldMappingsAt(k, strFieldMapping)
-				continue
-			}
-
-			_, ok = v.(int)
-			if ok {
-				intFieldMapping := bleve.NewNumericFieldMapping()
-				dataMapping.AddFieldMappingsAt(k, intFieldMapping)
-				continue
-			}
-			_, ok = v.(float32)
-			if ok {
-				floatFieldMapping := bleve.NewNumericFieldMapping()
-				dataMapping.AddFieldMappingsAt(k, floatFieldMapping)
-				continue
-			}
-			_, ok = v.(float64)
-			if ok {
-				floatFieldMapping := bleve.NewNumericFieldMapping()
-				dataMapping.AddFieldMappingsAt(k, floatFieldMapping)
-				continue
-			}
-
-			_, ok = v.(bool)
-			if ok {
-				boolFieldMapping := bleve.NewBooleanFieldMapping()
-				dataMapping.AddFieldMappingsAt(k, boolFieldMapping)
-				continue
-			}
+			is.addValueMapping(dataMapping, []string{k}, v)
 		}
 		recordsScanned++
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	err = indexMapping.Validate()
+	if err != nil {
+		return nil, err
+	}
 
 	log.WithFields(log.Fields{
 		"numIndexes": int(status.IndexesWritten),
@@ -205,6 +355,94 @@ func (is *IndexStore) BuildDataMapping() (*mapping.IndexMappingImpl, error) {
 	return indexMapping, nil
 }
 
+// addValueMapping maps a record's value at path in the document mapping holding its last field.
+// Objects are mapped as sub documents, so their fields are indexed at dotted paths like
+// Data.address.city, and arrays map each of their elements at the array's own path.
+func (is *IndexStore) addValueMapping(docMapping *mapping.DocumentMapping, path []string, value interface{}) {
+	name := path[len(path)-1]
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			is.addValueMapping(subDocumentMapping(docMapping, name), append(path[:len(path):len(path)], k), v)
+		}
+	case []interface{}:
+		for _, element := range value {
+			is.addValueMapping(docMapping, path, element)
+		}
+	case string:
+		textMapping := bleve.NewTextFieldMapping()
+		textMapping.Analyzer = is.fieldAnalyzer(strings.Join(path, "."))
+		addFieldMapping(docMapping, name, textMapping)
+		// Dates are indexed as datetimes too, so they can be counted in date ranges. They get
+		// their own field, as words and dates can't share the terms of one.
+		if isDate(value) {
+			dateMapping := bleve.NewDateTimeFieldMapping()
+			dateMapping.Name = name + DateFieldSuffix
+			dateMapping.Store = false
+			addFieldMapping(docMapping, name, dateMapping)
+		}
+	case int, float32, float64:
+		addFieldMapping(docMapping, name, bleve.NewNumericFieldMapping())
+	case bool:
+		addFieldMapping(docMapping, name, bleve.NewBooleanFieldMapping())
+	}
+}
+
+// subDocumentMapping returns the sub document mapping at name, adding one if there isn't one
+func subDocumentMapping(docMapping *mapping.DocumentMapping, name string) *mapping.DocumentMapping {
+	subMapping, ok := docMapping.Properties[name]
+	if !ok {
+		subMapping = bleve.NewDocumentMapping()
+		docMapping.AddSubDocumentMapping(name, subMapping)
+	}
+	return subMapping
+}
+
+// isDate returns true if a string is an RFC 3339 date or datetime
+func isDate(value string) bool {
+	_, ok := storage.ParseDate(value)
+	return ok
+}
+
+// checkSearchMapping returns an error if a search index was built with a mapping that lookups
+// can no longer rely on, so it needs to be rebuilt
+func (is *IndexStore) checkSearchMapping(searchIndex bleve.Index) error {
+	err := is.checkAnalyzers(searchIndex)
+	if err != nil {
+		return err
+	}
+	err = checkPresence(searchIndex)
+	if err != nil {
+		return err
+	}
+	return checkDateFields(searchIndex)
+}
+
+// checkDateFields returns an error if a search index was built with dates sharing the field of
+// their words, as date ranges and term counts on it would be wrong
+func checkDateFields(searchIndex bleve.Index) error {
+	var err error
+	walkFieldMappings(searchIndex, func(field string, fieldMapping *mapping.FieldMapping) {
+		if fieldMapping.Type == "datetime" && fieldMapping.Name == "" {
+			err = fmt.Errorf("Indexes hold the dates of '%s' with its words", field)
+		}
+	})
+	return err
+}
+
+// addFieldMapping adds a field mapping at name unless one of the same type is already there.
+// Fields holding values of several types get a mapping for each.
+func addFieldMapping(docMapping *mapping.DocumentMapping, name string, fieldMapping *mapping.FieldMapping) {
+	if subMapping, ok := docMapping.Properties[name]; ok {
+		for _, existing := range subMapping.Fields {
+			if existing.Type == fieldMapping.Type {
+				return
+			}
+		}
+	}
+	docMapping.AddFieldMappingsAt(name, fieldMapping)
+}
+
 // LogStatusChannel logs status information passed into the status channel during indexing
 func LogStatusChannel(statusChan chan interface{}, currStatus *IndexingStatus) {
 	for status := range statusChan {
@@ -224,14 +462,36 @@ func LogStatusChannel(statusChan chan interface{}, currStatus *IndexingStatus) {
 	}
 }
 
-// BuildIndexes stores indexes for data sent over the channel
-func (is *IndexStore) BuildIndexes(searchIndex, dataIndex bleve.Index) error {
+// BuildIndexes stores indexes for data sent over the channel. It returns any error
+// encountered scanning the data, including cancellation of the context.
+// Data blocks with bloom filters are collected into the store's bloom index.
+func (is *IndexStore) BuildIndexes(ctx context.Context, searchIndex, dataIndex bleve.Index) error {
 	log.Info("Building indexes")
 
 	dataChan := make(chan models.IndexData, DefaultChanSize)
 	blockChan := make(chan models.DataBlock, DefaultChanSize)
 	statusChan := make(chan interface{}, DefaultChanSize)
-	go is.store.ScanDataBlocks(dataChan, blockChan)
+	scanErrChan := make(chan error, 1)
+	go func() {
+		scanErrChan <- is.store.ScanDataBlocks(ctx, dataChan, blockChan)
+	}()
+
+	bloomIndex := &BloomIndex{
+		Fields:     is.bloomFields,
+		KeyVersion: storage.BloomKeyVersion,
+		Blocks:     []models.DataBlock{},
+	}
+	indexBlockChan := make(chan models.DataBlock, DefaultChanSize)
+	go func() {
+		defer close(indexBlockChan)
+		for block := range blockChan {
+			if len(is.bloomFields) > 0 {
+				bloomIndex.Blocks = append(bloomIndex.Blocks, block)
+				block.Blooms = nil
+			}
+			indexBlockChan <- block
+		}
+	}()
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -241,10 +501,29 @@ func (is *IndexStore) BuildIndexes(searchIndex, dataIndex bleve.Index) error {
 		IndexesWritten: uint64(0),
 	}
 
+	searchDataChan := make(chan models.IndexData, DefaultChanSize)
+	go func() {
+		defer close(searchDataChan)
+		warned := map[string]bool{}
+		for data := range dataChan {
+			warnUnmappedIDFields(searchIndex, data.Data, warned)
+			searchDataChan <- data
+		}
+	}()
+
 	go LogStatusChannel(statusChan, status)
-	go CreateIndexFromIndexDataChan(searchIndex, &wg, "mainIndex-%d", dataChan, statusChan)
-	go CreateIndexFromDataBlockChan(dataIndex, &wg, "dataBlockIndex-%d", blockChan, statusChan)
+	go CreateIndexFromIndexDataChan(searchIndex, &wg, "mainIndex-%d", searchDataChan, statusChan)
+	go CreateIndexFromDataBlockChan(dataIndex, &wg, "dataBlockIndex-%d", indexBlockChan, statusChan)
 	wg.Wait()
+	close(statusChan)
+
+	if err := <-scanErrChan; err != nil {
+		log.WithError(err).Error("Could not scan data for indexing")
+		return err
+	}
+	if len(is.bloomFields) > 0 {
+		is.blooms = bloomIndex
+	}
 
 	log.WithFields(log.Fields{
 		"numIndexes": int(status.IndexesWritten),
@@ -299,16 +578,16 @@ func CreateIndexFromChan(dataIndex bleve.Index, wg *sync.WaitGroup, idFormat str
 
 // GetDataBlock retrieves a data block pointing at cloud storage for a given reference key
 // all search indexes are created with a reference key that points at a data block key.
-func (is *IndexStore) GetDataBlock(refKey string) (*models.DataBlock, error) {
-	qs := fmt.Sprintf("RefKey:%s", refKey)
+func (is *IndexStore) GetDataBlock(ctx context.Context, refKey string) (*models.DataBlock, error) {
 	log.WithFields(log.Fields{
-		"querystring": qs,
+		"refKey": refKey,
 	}).Info("Searching for datablock")
 
-	query := bleve.NewQueryStringQuery(qs)
+	query := bleve.NewTermQuery(refKey)
+	query.SetField("RefKey")
 	search := bleve.NewSearchRequest(query)
 	search.Fields = []string{"*"}
-	searchResults, err := is.dataIndex.Search(search)
+	searchResults, err := is.dataIndex.SearchInContext(ctx, search)
 	if err != nil {
 		log.WithError(err).Error("Could not find a search index")
 		return nil, err
@@ -319,6 +598,8 @@ func (is *IndexStore) GetDataBlock(refKey string) (*models.DataBlock, error) {
 		return nil, err
 	}
 	fields := searchResults.Hits[0].Fields
+	// Indexes built before files were versioned won't have a version
+	version, _ := fields["File.Version"].(string)
 	dataBlock := &models.DataBlock{
 		RefKey: fields["RefKey"].(string),
 		Start:  int64(fields["Start"].(float64)),
@@ -326,6 +607,7 @@ func (is *IndexStore) GetDataBlock(refKey string) (*models.DataBlock, error) {
 		File: models.File{
 			Address: fields["File.Address"].(string),
 			Type:    fields["File.Type"].(string),
+			Version: version,
 		},
 	}
 
@@ -333,11 +615,11 @@ func (is *IndexStore) GetDataBlock(refKey string) (*models.DataBlock, error) {
 }
 
 // GetSearchIndex will retrieve a specific search index with it's uid
-func (is *IndexStore) GetSearchIndex(uid string) (*models.IndexData, error) {
+func (is *IndexStore) GetSearchIndex(ctx context.Context, uid string) (*models.IndexData, error) {
 	query := bleve.NewDocIDQuery([]string{uid})
 	search := bleve.NewSearchRequest(query)
 	search.Fields = []string{"*"}
-	searchResults, err := is.searchIndex.Search(search)
+	searchResults, err := is.searchIndex.SearchInContext(ctx, search)
 	if err != nil {
 		log.WithError(err).Error("Could not find a search index")
 		return nil, err
@@ -351,10 +633,8 @@ func (is *IndexStore) GetSearchIndex(uid string) (*models.IndexData, error) {
 
 	data := map[string]interface{}{}
 	for k, v := range hit.Fields {
-		if strings.Contains(k, "Data") {
-			parts := strings.Split(k, ".")
-			fieldName := parts[1]
-			data[fieldName] = v
+		if strings.HasPrefix(k, "Data.") {
+			setPath(data, strings.Split(strings.TrimPrefix(k, "Data."), "."), v)
 		}
 	}
 
@@ -369,88 +649,159 @@ func (is *IndexStore) GetSearchIndex(uid string) (*models.IndexData, error) {
 	}, nil
 }
 
+// setPath sets a value at a path of nested objects, creating the objects along the way
+func setPath(object map[string]interface{}, path []string, value interface{}) {
+	for _, name := range path[:len(path)-1] {
+		child, ok := object[name].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			object[name] = child
+		}
+		object = child
+	}
+	object[path[len(path)-1]] = value
+}
+
+// fieldIndexing describes how a field was mapped in the search index. Fields only seen after
+// the mapping was built are indexed dynamically, as analyzed text, numbers and bools, even when
+// their names would make them keywords.
+func (is *IndexStore) fieldIndexing(field string) fieldIndexing {
+	analyzer, isText := mappedAnalyzer(is.searchIndex, field)
+	return fieldIndexing{
+		keyword:  isText && analyzer == keyword.Name,
+		textOnly: isText && !is.fieldHasType(field, "number") && !is.fieldHasType(field, "boolean"),
+		date:     is.fieldHasType(field, "datetime"),
+
+		comparator: is.comparator,
+	}
+}
+
+// BindCondition sets a condition up for how its fields were indexed, so its query and the
+// records it matches in data blocks agree. Conditions should be bound before they're used.
+func (is *IndexStore) BindCondition(condition Condition) (Condition, error) {
+	return condition.bind(is.fieldIndexing)
+}
+
 func (is *IndexStore) buildSearchRequest(field, searchString string) *bleve.SearchRequest {
-	searchFloat, err := strconv.ParseFloat(searchString, 64)
+	// Fields only holding strings, like ids analyzed as keywords, are matched as strings
+	// even when the value looks like a number or bool
+	textOnly := is.fieldIndexing(field).textOnly
 	truePtr := true
-	if err == nil {
-		log.WithFields(log.Fields{
-			"searchFloat": searchFloat,
-		}).Info("Finding numeric range")
-		query := bleve.NewNumericRangeInclusiveQuery(&searchFloat, &searchFloat, &truePtr, &truePtr)
-		query.SetField(fmt.Sprintf("Data.%s", field))
-		search := bleve.NewSearchRequest(query)
+	// null finds records holding null in the field, as well as the string "null"
+	if searchString == "null" {
+		log.Info("Finding null")
+		query := bleve.NewMatchQuery(searchString)
+		query.SetField(dataField(field))
+		search := bleve.NewSearchRequest(bleve.NewDisjunctionQuery(presenceQuery(NullField, field), query))
 		search.Fields = []string{"*"}
 		return search
 	}
-	searchInt, err := strconv.ParseInt(searchString, 10, 64)
-	if err == nil {
-		searchFloat := float64(searchInt)
+	// Numbers match within the comparator's precision, the way records in data blocks are matched
+	searchFloat, err := strconv.ParseFloat(searchString, 64)
+	if err == nil && !textOnly {
+		min, max := is.comparator.NumericRange(searchFloat)
 		log.WithFields(log.Fields{
 			"searchFloat": searchFloat,
-		}).Info("Finding numeric range from int with float")
-
-		query := bleve.NewNumericRangeInclusiveQuery(&searchFloat, &searchFloat, &truePtr, &truePtr)
-		query.SetField(fmt.Sprintf("Data.%s", field))
+			"min":         min,
+			"max":         max,
+		}).Info("Finding numeric range")
+		query := bleve.NewNumericRangeInclusiveQuery(&min, &max, &truePtr, &truePtr)
+		query.SetField(dataField(field))
 		search := bleve.NewSearchRequest(query)
 		search.Fields = []string{"*"}
 		return search
 	}
 	searchBool, err := strconv.ParseBool(searchString)
-	if err == nil {
+	if err == nil && !textOnly {
 		log.WithFields(log.Fields{
 			"searchBool": searchBool,
 		}).Info("Finding bool")
 		query := bleve.NewBoolFieldQuery(searchBool)
-		query.SetField(fmt.Sprintf("Data.%s", field))
+		query.SetField(dataField(field))
+		search := bleve.NewSearchRequest(query)
+		search.Fields = []string{"*"}
+		return search
+	}
+	// Dates match the same instant written with any offset
+	searchDate, ok := storage.ParseDate(searchString)
+	if ok && is.fieldHasType(field, "datetime") {
+		log.WithFields(log.Fields{
+			"searchDate": searchDate,
+		}).Info("Finding date")
+		query := bleve.NewDateRangeInclusiveQuery(searchDate, searchDate, &truePtr, &truePtr)
+		query.SetField(dateField(field))
 		search := bleve.NewSearchRequest(query)
 		search.Fields = []string{"*"}
 		return search
 	}
 
-	searchString = strings.Replace(searchString, " ", `\ `, -1)
-	qs := fmt.Sprintf("Data.%s:%s", field, searchString)
+	// The value is analyzed like the field, so keyword fields match it whole
 	log.WithFields(log.Fields{
 		"searchString": searchString,
 	}).Info("Searching with string")
-	query := bleve.NewQueryStringQuery(qs)
+	query := bleve.NewMatchQuery(searchString)
+	query.SetField(dataField(field))
 	search := bleve.NewSearchRequest(query)
 	search.Fields = []string{"*"}
 	return search
 }
 
-// SearchHits checks all fields in all records for results that contain a search string.
+// TextSearch is a search for a phrase across the fields of every record
+type TextSearch struct {
+	Text string
+	// Fields restricts the search to some fields, all fields are searched when it's empty
+	Fields []string
+	Size   int
+	From   int
+}
+
+// SearchHits ranks the records containing a search phrase, returning a page of hits with the
+// fragments of each field that matched highlighted.
 // Used for requests of the form /search/{search}
-func (is *IndexStore) SearchHits(searchString string, params map[string][]string) (search.DocumentMatchCollection, error) {
+func (is *IndexStore) SearchHits(ctx context.Context, textSearch TextSearch) (*bleve.SearchResult, error) {
 	log.WithFields(log.Fields{
-		"searchString": searchString,
+		"searchString": textSearch.Text,
+		"fields":       strings.Join(textSearch.Fields, ","),
 	}).Info("Searching for hits")
-	searchString = strings.Replace(searchString, " ", `\ `, -1)
-	query := bleve.NewMatchPhraseQuery(searchString)
-	searchReq := bleve.NewSearchRequest(query)
-	searchReq.Fields = []string{"*"}
 
-	searchResults, err := is.searchIndex.Search(searchReq)
+	var searchQuery query.Query = bleve.NewMatchPhraseQuery(textSearch.Text)
+	highlight := bleve.NewHighlight()
+	if len(textSearch.Fields) > 0 {
+		fieldQueries := []query.Query{}
+		for _, field := range textSearch.Fields {
+			if is.IsBloomField(field) {
+				return nil, fmt.Errorf("'%s' is looked up with bloom filters and isn't in the search index", field)
+			}
+			fieldQuery := bleve.NewMatchPhraseQuery(textSearch.Text)
+			fieldQuery.SetField(dataField(field))
+			fieldQueries = append(fieldQueries, fieldQuery)
+			highlight.AddField(dataField(field))
+		}
+		searchQuery = bleve.NewDisjunctionQuery(fieldQueries...)
+	}
+	searchReq := bleve.NewSearchRequestOptions(searchQuery, textSearch.Size, textSearch.From, false)
+	searchReq.Fields = []string{"RefKey", "Offset"}
+	searchReq.Highlight = highlight
+
+	searchResults, err := is.searchIndex.SearchInContext(ctx, searchReq)
 	if err != nil {
 		log.WithError(err).Error("Error finding search Index")
 		return nil, err
 	}
-	if len(searchResults.Hits) == 0 {
-		err := fmt.Errorf("No search hits found")
-		log.WithError(err).Error("Could not find a data block index")
-		return nil, err
-	}
-	return searchResults.Hits, nil
+	return searchResults, nil
 }
 
-// GetHits will find results where a specific field matches a search string.
+// GetHits will find up to size results where a specific field matches a search string.
 // Used for requests of the form /{field}/{value}
-func (is *IndexStore) GetHits(field, searchString string) (search.DocumentMatchCollection, error) {
+func (is *IndexStore) GetHits(ctx context.Context, field, searchString string, size int) (search.DocumentMatchCollection, error) {
 	log.WithFields(log.Fields{
 		"searchString": searchString,
 		"field":        field,
+		"size":         size,
 	}).Info("Retrieving hits")
 	searchReq := is.buildSearchRequest(field, searchString)
-	searchResults, err := is.searchIndex.Search(searchReq)
+	searchReq.Size = size
+	searchResults, err := is.searchIndex.SearchInContext(ctx, searchReq)
 	if err != nil {
 		log.WithError(err).Error("Error finding search Index")
 		return nil, err
@@ -462,3 +813,25 @@ func (is *IndexStore) GetHits(field, searchString string) (search.DocumentMatchC
 	}
 	return searchResults.Hits, nil
 }
+
+// QueryHits finds up to size results matching a boolean query.
+// Used for requests of the form /query?q={query}
+func (is *IndexStore) QueryHits(ctx context.Context, condition Condition, size int) (search.DocumentMatchCollection, error) {
+	for _, field := range condition.Fields() {
+		if is.IsBloomField(field) {
+			return nil, fmt.Errorf("'%s' is looked up with bloom filters and isn't in the search index", field)
+		}
+	}
+	log.WithFields(log.Fields{
+		"size": size,
+	}).Info("Querying for hits")
+	searchReq := bleve.NewSearchRequestOptions(condition.BleveQuery(), size, 0, false)
+	searchReq.Fields = []string{"RefKey"}
+
+	searchResults, err := is.searchIndex.SearchInContext(ctx, searchReq)
+	if err != nil {
+		log.WithError(err).Error("Error finding search Index")
+		return nil, err
+	}
+	return searchResults.Hits, nil
+}
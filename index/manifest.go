@@ -0,0 +1,89 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// ManifestFile is the name of the manifest written alongside a completed index build
+const ManifestFile = "manifest.json"
+
+// Manifest records a completed index build. It is written only once both indexes are
+// fully built, so an index path without a manifest is treated as incomplete.
+type Manifest struct {
+	Complete       bool
+	SearchDocCount uint64
+	DataDocCount   uint64
+	BuiltAt        time.Time
+}
+
+// NewManifest creates a complete manifest describing the contents of both indexes
+func NewManifest(searchIndex, dataIndex bleve.Index) (*Manifest, error) {
+	searchCount, err := searchIndex.DocCount()
+	if err != nil {
+		return nil, err
+	}
+	dataCount, err := dataIndex.DocCount()
+	if err != nil {
+		return nil, err
+	}
+	if searchCount > 0 && dataCount == 0 {
+		return nil, fmt.Errorf("Search index has %d documents but data index is empty", searchCount)
+	}
+	return &Manifest{
+		Complete:       true,
+		SearchDocCount: searchCount,
+		DataDocCount:   dataCount,
+		BuiltAt:        time.Now(),
+	}, nil
+}
+
+// ReadManifest reads the manifest from an index path
+func ReadManifest(path string) (*Manifest, error) {
+	manifestBytes, err := ioutil.ReadFile(filepath.Join(path, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	err = json.Unmarshal(manifestBytes, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// WriteManifest writes the manifest into an index path
+func WriteManifest(path string, manifest *Manifest) error {
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(path, ManifestFile), manifestBytes, 0644)
+}
+
+// Validate checks that the opened indexes are complete and match the manifest
+func (m *Manifest) Validate(searchIndex, dataIndex bleve.Index) error {
+	if !m.Complete {
+		return fmt.Errorf("Index build is not complete")
+	}
+	searchCount, err := searchIndex.DocCount()
+	if err != nil {
+		return err
+	}
+	if searchCount != m.SearchDocCount {
+		return fmt.Errorf("Search index has %d documents, manifest expects %d", searchCount, m.SearchDocCount)
+	}
+	dataCount, err := dataIndex.DocCount()
+	if err != nil {
+		return err
+	}
+	if dataCount != m.DataDocCount {
+		return fmt.Errorf("Data index has %d documents, manifest expects %d", dataCount, m.DataDocCount)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+// newTestDocIndex creates an in memory index holding numDocs documents
+func newTestDocIndex(t *testing.T, numDocs int) bleve.Index {
+	docIndex, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		t.Fatalf("Could not create index: %s", err)
+	}
+	for i := 0; i < numDocs; i++ {
+		err := docIndex.Index(fmt.Sprintf("doc%d", i), map[string]interface{}{"n": i})
+		if err != nil {
+			t.Fatalf("Could not index document: %s", err)
+		}
+	}
+	return docIndex
+}
+
+func TestNewManifest(t *testing.T) {
+	tests := []struct {
+		searchDocs, dataDocs int
+		err                  bool
+	}{
+		{searchDocs: 0, dataDocs: 0},
+		{searchDocs: 10, dataDocs: 2},
+		{searchDocs: 10, dataDocs: 0, err: true},
+	}
+	for _, test := range tests {
+		searchIndex, dataIndex := newTestDocIndex(t, test.searchDocs), newTestDocIndex(t, test.dataDocs)
+		manifest, err := NewManifest(searchIndex, dataIndex)
+		if test.err {
+			if err == nil {
+				t.Errorf("NewManifest with %d search and %d data documents expected an error", test.searchDocs, test.dataDocs)
+			}
+		} else if err != nil {
+			t.Errorf("NewManifest with %d search and %d data documents returned error: %s", test.searchDocs, test.dataDocs, err)
+		} else if !manifest.Complete || manifest.SearchDocCount != uint64(test.searchDocs) || manifest.DataDocCount != uint64(test.dataDocs) {
+			t.Errorf("NewManifest with %d search and %d data documents = %+v", test.searchDocs, test.dataDocs, manifest)
+		}
+		searchIndex.Close()
+		dataIndex.Close()
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	searchIndex, dataIndex := newTestDocIndex(t, 10), newTestDocIndex(t, 2)
+	defer searchIndex.Close()
+	defer dataIndex.Close()
+
+	tests := []struct {
+		name     string
+		manifest Manifest
+		err      bool
+	}{
+		{name: "matching", manifest: Manifest{Complete: true, SearchDocCount: 10, DataDocCount: 2}},
+		{name: "incomplete", manifest: Manifest{SearchDocCount: 10, DataDocCount: 2}, err: true},
+		{name: "search documents missing", manifest: Manifest{Complete: true, SearchDocCount: 11, DataDocCount: 2}, err: true},
+		{name: "data documents missing", manifest: Manifest{Complete: true, SearchDocCount: 10, DataDocCount: 3}, err: true},
+		{name: "empty", manifest: Manifest{}, err: true},
+	}
+	for _, test := range tests {
+		path, err := ioutil.TempDir("", "manifest")
+		if err != nil {
+			t.Fatalf("Could not create index path: %s", err)
+		}
+		defer os.RemoveAll(path)
+		err = WriteManifest(path, &test.manifest)
+		if err != nil {
+			t.Fatalf("Could not write manifest: %s", err)
+		}
+		manifest, err := ReadManifest(path)
+		if err != nil {
+			t.Fatalf("Could not read manifest: %s", err)
+		}
+		err = manifest.Validate(searchIndex, dataIndex)
+		if test.err != (err != nil) {
+			t.Errorf("%s: Validate returned error %v, expected error: %t", test.name, err, test.err)
+		}
+	}
+
+	if _, err := ReadManifest(filepath.Join(os.TempDir(), "missing-manifest")); !os.IsNotExist(err) {
+		t.Errorf("Reading a missing manifest returned %v, expected a not exist error", err)
+	}
+}
@@ -0,0 +1,90 @@
+package index
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+// Match modes for field lookups, set with the match query parameter
+const (
+	MatchExact    = "exact"
+	MatchPrefix   = "prefix"
+	MatchFuzzy    = "fuzzy"
+	MatchWildcard = "wildcard"
+	MatchRegexp   = "regexp"
+)
+
+// DefaultFuzziness is the number of edits a fuzzy match allows unless it sets one
+const DefaultFuzziness = 1
+
+// MaxFuzziness is the most edits bleve's fuzzy queries allow, higher fuzziness is lowered to it
+const MaxFuzziness = 2
+
+// MatchCondition builds the condition for looking up a field's value with a match mode.
+// Exact lookups are handled by GetHits, so they have no condition.
+func MatchCondition(field, value, mode string, fuzziness int) (Condition, error) {
+	switch mode {
+	case MatchPrefix:
+		return PrefixCondition{Field: field, Prefix: value}, nil
+	case MatchFuzzy:
+		if fuzziness < 0 {
+			return nil, fmt.Errorf("fuzziness shouldn't be negative")
+		}
+		if fuzziness > MaxFuzziness {
+			fuzziness = MaxFuzziness
+		}
+		return FuzzyCondition{Field: field, Value: value, Fuzziness: fuzziness}, nil
+	case MatchWildcard:
+		return NewWildcardCondition(field, value)
+	case MatchRegexp:
+		return NewRegexpCondition(field, value)
+	}
+	return nil, fmt.Errorf("match should be one of %s, %s, %s, %s, %s", MatchExact, MatchPrefix, MatchFuzzy, MatchWildcard, MatchRegexp)
+}
+
+// RegexpCondition matches records where a whole word of a field matches a regular expression.
+// Words are indexed in lower case, so patterns should be too. Keyword fields match their whole
+// values, keeping case.
+type RegexpCondition struct {
+	Field    string
+	Pattern  string
+	regexp   *regexp.Regexp
+	indexing fieldIndexing
+}
+
+// NewRegexpCondition creates a RegexpCondition, compiling its pattern for matching records
+func NewRegexpCondition(field, pattern string) (RegexpCondition, error) {
+	compiled, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return RegexpCondition{}, fmt.Errorf("Invalid regexp: %s", err)
+	}
+	return RegexpCondition{Field: field, Pattern: pattern, regexp: compiled}, nil
+}
+
+// BleveQuery builds a regexp query, which bleve matches against whole terms
+func (c RegexpCondition) BleveQuery() query.Query {
+	q := bleve.NewRegexpQuery(c.Pattern)
+	q.SetField(dataField(c.Field))
+	return q
+}
+
+// Match returns true if a word of the field matches the pattern
+func (c RegexpCondition) Match(record map[string]interface{}) bool {
+	return c.indexing.matchTerms(storage.FieldValues(record, c.Field), c.regexp.MatchString)
+}
+
+// Fields returns the condition's field
+func (c RegexpCondition) Fields() []string {
+	return []string{c.Field}
+}
+
+// bind sets up the condition for how its field's terms were indexed
+func (c RegexpCondition) bind(indexing func(field string) fieldIndexing) (Condition, error) {
+	c.indexing = indexing(c.Field)
+	return c, nil
+}
@@ -0,0 +1,108 @@
+package index
+
+import (
+	"fmt"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/query"
+
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+// PresentField and NullField are the search index fields listing the field paths each record
+// holds a value or null in, from models.IndexData
+const (
+	PresentField = "Present"
+	NullField    = "Null"
+)
+
+// addPresenceMappings indexes the field paths of each record whole. They're left out of
+// stored fields and the _all field, so text searches don't match field names.
+func addPresenceMappings(indexMapping *mapping.IndexMappingImpl) {
+	for _, name := range []string{PresentField, NullField} {
+		fieldMapping := bleve.NewTextFieldMapping()
+		fieldMapping.Analyzer = keyword.Name
+		fieldMapping.Store = false
+		fieldMapping.IncludeInAll = false
+		indexMapping.DefaultMapping.AddFieldMappingsAt(name, fieldMapping)
+	}
+}
+
+// checkPresence returns an error if a search index was built without tracking which fields
+// records hold, as exists and missing queries would find nothing
+func checkPresence(searchIndex bleve.Index) error {
+	indexMapping, ok := searchIndex.Mapping().(*mapping.IndexMappingImpl)
+	if ok && indexMapping.DefaultMapping != nil {
+		if _, ok := indexMapping.DefaultMapping.Properties[PresentField]; ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("Indexes don't track which fields records hold")
+}
+
+// presenceQuery matches documents whose record lists field in a presence field
+func presenceQuery(presenceField, field string) query.Query {
+	q := bleve.NewTermQuery(storage.NormalizeField(field))
+	q.SetField(presenceField)
+	return q
+}
+
+// ExistsCondition matches records where a field holds a value other than null
+type ExistsCondition struct {
+	Field string
+}
+
+// BleveQuery matches documents whose record holds the field
+func (c ExistsCondition) BleveQuery() query.Query {
+	return presenceQuery(PresentField, c.Field)
+}
+
+// Match returns true if the record holds a value in the field
+func (c ExistsCondition) Match(record map[string]interface{}) bool {
+	for _, value := range storage.FieldValues(record, c.Field) {
+		if value != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Fields returns the condition's field
+func (c ExistsCondition) Fields() []string {
+	return []string{c.Field}
+}
+
+// bind returns the condition unchanged, as field presence is indexed the same way for every field
+func (c ExistsCondition) bind(indexing func(field string) fieldIndexing) (Condition, error) {
+	return c, nil
+}
+
+// MissingCondition matches records where a field is absent or null
+type MissingCondition struct {
+	Field string
+}
+
+// BleveQuery matches every document whose record doesn't hold the field
+func (c MissingCondition) BleveQuery() query.Query {
+	q := bleve.NewBooleanQuery()
+	q.AddMust(bleve.NewMatchAllQuery())
+	q.AddMustNot(presenceQuery(PresentField, c.Field))
+	return q
+}
+
+// Match returns true if the record doesn't hold a value in the field
+func (c MissingCondition) Match(record map[string]interface{}) bool {
+	return !ExistsCondition{Field: c.Field}.Match(record)
+}
+
+// Fields returns the condition's field
+func (c MissingCondition) Fields() []string {
+	return []string{c.Field}
+}
+
+// bind returns the condition unchanged, as field presence is indexed the same way for every field
+func (c MissingCondition) bind(indexing func(field string) fieldIndexing) (Condition, error) {
+	return c, nil
+}
@@ -0,0 +1,60 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/mapping"
+
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+func TestCheckPresence(t *testing.T) {
+	tests := []struct {
+		name        string
+		addPresence bool
+		err         bool
+	}{
+		{name: "tracks presence", addPresence: true},
+		{name: "built before presence was tracked", err: true},
+	}
+	for _, test := range tests {
+		indexMapping := bleve.NewIndexMapping()
+		indexMapping.DefaultMapping.AddSubDocumentMapping("Data", bleve.NewDocumentMapping())
+		if test.addPresence {
+			addPresenceMappings(indexMapping)
+		}
+		searchIndex, err := bleve.NewMemOnly(indexMapping)
+		if err != nil {
+			t.Fatalf("Could not create search index: %s", err)
+		}
+		err = checkPresence(searchIndex)
+		if test.err != (err != nil) {
+			t.Errorf("%s: checkPresence returned error %v, expected error: %t", test.name, err, test.err)
+		}
+		searchIndex.Close()
+	}
+}
+
+func TestPresenceFieldsAreNotSearchable(t *testing.T) {
+	is, _ := newTestIndexStore(t, nil, storage.DefaultComparator, testRecords)
+	defer is.searchIndex.Close()
+
+	// Field names are indexed for presence queries, but text searches shouldn't find them
+	results, err := is.searchIndex.Search(bleve.NewSearchRequest(bleve.NewMatchQuery("job")))
+	if err != nil {
+		t.Fatalf("Could not search: %s", err)
+	}
+	if results.Total != 0 {
+		t.Errorf("Searching for a field name found %d records, expected none", results.Total)
+	}
+
+	indexMapping := is.searchIndex.Mapping().(*mapping.IndexMappingImpl)
+	for _, name := range []string{PresentField, NullField} {
+		for _, fieldMapping := range indexMapping.DefaultMapping.Properties[name].Fields {
+			if fieldMapping.Store || fieldMapping.IncludeInAll {
+				t.Errorf("%s is stored or included in _all", name)
+			}
+		}
+	}
+}
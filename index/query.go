@@ -0,0 +1,617 @@
+package index
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+// Condition is a node of a boolean query over record fields. It builds the bleve query used to
+// find hits in the search index, and matches records in the data blocks those hits point at.
+type Condition interface {
+	BleveQuery() query.Query
+	Match(record map[string]interface{}) bool
+	// Fields lists every field the condition looks at
+	Fields() []string
+	// bind returns a copy of the condition set up for how its fields were indexed
+	bind(indexing func(field string) fieldIndexing) (Condition, error)
+}
+
+// fieldIndexing describes how a field's values are held in the search index. Conditions are
+// bound to it so their queries follow the field's mapping and records in data blocks are
+// matched the way the index matched them. Unbound conditions treat fields as analyzed text
+// that may also hold numbers and bools.
+type fieldIndexing struct {
+	// keyword fields index strings whole, keeping their case
+	keyword bool
+	// textOnly fields only hold strings, so values that look like numbers or bools are strings
+	textOnly bool
+	// date fields also index their dates at dateField
+	date bool
+	// comparator compares numbers with the precision lookups use
+	comparator storage.ValueComparator
+}
+
+// Comparison operators for field conditions
+const (
+	OpEquals         = ":"
+	OpGreater        = ">"
+	OpGreaterOrEqual = ">="
+	OpLess           = "<"
+	OpLessOrEqual    = "<="
+)
+
+// FieldCondition compares a field to a value. Numbers and bools compare by value, and dates
+// as instants when the field holds dates. Other strings match if every word of the value
+// appears in the field, ignoring case, like the search index, or the whole value for keyword
+// fields. Ranges on strings compare them lexically, so they need a keyword field.
+type FieldCondition struct {
+	Field    string
+	Op       string
+	Value    string
+	indexing fieldIndexing
+}
+
+// AndCondition matches records matching every one of its conditions
+type AndCondition struct {
+	Conditions []Condition
+}
+
+// OrCondition matches records matching any of its conditions
+type OrCondition struct {
+	Conditions []Condition
+}
+
+// NotCondition matches records that don't match its condition
+type NotCondition struct {
+	Condition Condition
+}
+
+// dataField converts a record field path into the field it's indexed as in the search index
+func dataField(field string) string {
+	return fmt.Sprintf("Data.%s", storage.NormalizeField(field))
+}
+
+// DateFieldSuffix is appended to a field's path for the field its dates are indexed at
+const DateFieldSuffix = "@date"
+
+// dateField converts a record field path into the field its dates are indexed as
+func dateField(field string) string {
+	return dataField(field) + DateFieldSuffix
+}
+
+// BleveQuery builds a query on the field's path in the search index
+func (c FieldCondition) BleveQuery() query.Query {
+	field := dataField(c.Field)
+	truePtr, falsePtr := true, false
+	if number, ok := c.number(); ok {
+		// Numbers within the comparator's precision are equal, so ranges start and end past them
+		min, max := c.indexing.comparator.NumericRange(number)
+		var q *query.NumericRangeQuery
+		switch c.Op {
+		case OpGreater:
+			q = bleve.NewNumericRangeInclusiveQuery(&max, nil, &falsePtr, nil)
+		case OpGreaterOrEqual:
+			q = bleve.NewNumericRangeInclusiveQuery(&min, nil, &truePtr, nil)
+		case OpLess:
+			q = bleve.NewNumericRangeInclusiveQuery(nil, &min, nil, &falsePtr)
+		case OpLessOrEqual:
+			q = bleve.NewNumericRangeInclusiveQuery(nil, &max, nil, &truePtr)
+		default:
+			q = bleve.NewNumericRangeInclusiveQuery(&min, &max, &truePtr, &truePtr)
+		}
+		q.SetField(field)
+		return q
+	}
+
+	if boolValue, ok := c.boolValue(); ok {
+		q := bleve.NewBoolFieldQuery(boolValue)
+		q.SetField(field)
+		return q
+	}
+
+	if date, ok := c.date(); ok {
+		var q *query.DateRangeQuery
+		switch c.Op {
+		case OpGreater:
+			q = bleve.NewDateRangeInclusiveQuery(date, time.Time{}, &falsePtr, nil)
+		case OpGreaterOrEqual:
+			q = bleve.NewDateRangeInclusiveQuery(date, time.Time{}, &truePtr, nil)
+		case OpLess:
+			q = bleve.NewDateRangeInclusiveQuery(time.Time{}, date, nil, &falsePtr)
+		case OpLessOrEqual:
+			q = bleve.NewDateRangeInclusiveQuery(time.Time{}, date, nil, &truePtr)
+		default:
+			q = bleve.NewDateRangeInclusiveQuery(date, date, &truePtr, &truePtr)
+		}
+		q.SetField(dateField(c.Field))
+		return q
+	}
+
+	if c.Op != OpEquals {
+		var q *query.TermRangeQuery
+		switch c.Op {
+		case OpGreater:
+			q = bleve.NewTermRangeInclusiveQuery(c.Value, "", &falsePtr, nil)
+		case OpGreaterOrEqual:
+			q = bleve.NewTermRangeInclusiveQuery(c.Value, "", &truePtr, nil)
+		case OpLess:
+			q = bleve.NewTermRangeInclusiveQuery("", c.Value, nil, &falsePtr)
+		default:
+			q = bleve.NewTermRangeInclusiveQuery("", c.Value, nil, &truePtr)
+		}
+		q.SetField(field)
+		return q
+	}
+
+	if c.indexing.keyword {
+		q := bleve.NewTermQuery(c.Value)
+		q.SetField(field)
+		return q
+	}
+	q := bleve.NewMatchQuery(c.Value)
+	q.SetField(field)
+	q.SetOperator(query.MatchQueryOperatorAnd)
+	return q
+}
+
+// number returns the condition's value if it's compared as a number
+func (c FieldCondition) number() (float64, bool) {
+	if c.indexing.textOnly {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(c.Value, 64)
+	return number, err == nil
+}
+
+// boolValue returns the condition's value if it's compared as a bool
+func (c FieldCondition) boolValue() (bool, bool) {
+	if c.indexing.textOnly || c.Op != OpEquals {
+		return false, false
+	}
+	boolValue, err := strconv.ParseBool(c.Value)
+	return boolValue, err == nil
+}
+
+// date returns the condition's value if it's compared as a date
+func (c FieldCondition) date() (time.Time, bool) {
+	if !c.indexing.date {
+		return time.Time{}, false
+	}
+	return storage.ParseDate(c.Value)
+}
+
+// Match compares the field's value in a record. Arrays match if any of their values do.
+func (c FieldCondition) Match(record map[string]interface{}) bool {
+	for _, value := range storage.FieldValues(record, c.Field) {
+		if c.matchValue(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchValue compares a value the way BleveQuery's query does, so a record only matches if the
+// search index finds it
+func (c FieldCondition) matchValue(value interface{}) bool {
+	number, isNumber := c.number()
+	boolValue, isBool := c.boolValue()
+	switch value := value.(type) {
+	case float64:
+		if !isNumber {
+			return false
+		}
+		cmp, err := c.indexing.comparator.Compare(value, number)
+		return err == nil && c.compare(cmp)
+	case bool:
+		return isBool && value == boolValue
+	case string:
+		if isNumber || isBool {
+			return false
+		}
+		if _, ok := c.date(); ok {
+			if _, ok := storage.ParseDate(value); !ok {
+				return false
+			}
+			cmp, err := c.indexing.comparator.Compare(value, c.Value)
+			return err == nil && c.compare(cmp)
+		}
+		if c.Op != OpEquals {
+			return c.compare(strings.Compare(value, c.Value))
+		}
+		if c.indexing.keyword {
+			return value == c.Value
+		}
+		return containsWords(value, c.Value)
+	}
+	return false
+}
+
+// bind sets up the condition for its field. Analyzed text is compared word by word in the
+// index, so only keyword fields can be ranged over strings.
+func (c FieldCondition) bind(indexing func(field string) fieldIndexing) (Condition, error) {
+	c.indexing = indexing(c.Field)
+	_, isNumber := c.number()
+	_, isDate := c.date()
+	if c.Op != OpEquals && !isNumber && !isDate && !c.indexing.keyword {
+		return nil, fmt.Errorf("'%s' is split into words, so it can only be ranged over numbers and dates", c.Field)
+	}
+	return c, nil
+}
+
+// compare applies the condition's operator to how the record's value compares to the condition's
+func (c FieldCondition) compare(cmp int) bool {
+	switch c.Op {
+	case OpGreater:
+		return cmp > 0
+	case OpGreaterOrEqual:
+		return cmp >= 0
+	case OpLess:
+		return cmp < 0
+	case OpLessOrEqual:
+		return cmp <= 0
+	}
+	return cmp == 0
+}
+
+// Fields returns the condition's field
+func (c FieldCondition) Fields() []string {
+	return []string{c.Field}
+}
+
+// BleveQuery builds a conjunction of its conditions' queries
+func (c AndCondition) BleveQuery() query.Query {
+	queries := []query.Query{}
+	for _, condition := range c.Conditions {
+		queries = append(queries, condition.BleveQuery())
+	}
+	return bleve.NewConjunctionQuery(queries...)
+}
+
+// Match returns true if every condition matches the record
+func (c AndCondition) Match(record map[string]interface{}) bool {
+	for _, condition := range c.Conditions {
+		if !condition.Match(record) {
+			return false
+		}
+	}
+	return true
+}
+
+// Fields lists the fields of every condition
+func (c AndCondition) Fields() []string {
+	return conditionFields(c.Conditions)
+}
+
+// BleveQuery builds a disjunction of its conditions' queries
+func (c OrCondition) BleveQuery() query.Query {
+	queries := []query.Query{}
+	for _, condition := range c.Conditions {
+		queries = append(queries, condition.BleveQuery())
+	}
+	return bleve.NewDisjunctionQuery(queries...)
+}
+
+// Match returns true if any condition matches the record
+func (c OrCondition) Match(record map[string]interface{}) bool {
+	for _, condition := range c.Conditions {
+		if condition.Match(record) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fields lists the fields of every condition
+func (c OrCondition) Fields() []string {
+	return conditionFields(c.Conditions)
+}
+
+// BleveQuery matches every document except those matching the condition
+func (c NotCondition) BleveQuery() query.Query {
+	q := bleve.NewBooleanQuery()
+	q.AddMust(bleve.NewMatchAllQuery())
+	q.AddMustNot(c.Condition.BleveQuery())
+	return q
+}
+
+// Match returns true if the condition doesn't match the record
+func (c NotCondition) Match(record map[string]interface{}) bool {
+	return !c.Condition.Match(record)
+}
+
+// Fields lists the fields of the condition
+func (c NotCondition) Fields() []string {
+	return c.Condition.Fields()
+}
+
+func bindConditions(conditions []Condition, indexing func(field string) fieldIndexing) ([]Condition, error) {
+	bound := []Condition{}
+	for _, condition := range conditions {
+		condition, err := condition.bind(indexing)
+		if err != nil {
+			return nil, err
+		}
+		bound = append(bound, condition)
+	}
+	return bound, nil
+}
+
+// bind sets up every condition for its fields
+func (c AndCondition) bind(indexing func(field string) fieldIndexing) (Condition, error) {
+	conditions, err := bindConditions(c.Conditions, indexing)
+	if err != nil {
+		return nil, err
+	}
+	return AndCondition{Conditions: conditions}, nil
+}
+
+// bind sets up every condition for its fields
+func (c OrCondition) bind(indexing func(field string) fieldIndexing) (Condition, error) {
+	conditions, err := bindConditions(c.Conditions, indexing)
+	if err != nil {
+		return nil, err
+	}
+	return OrCondition{Conditions: conditions}, nil
+}
+
+// bind sets up the condition for its fields
+func (c NotCondition) bind(indexing func(field string) fieldIndexing) (Condition, error) {
+	condition, err := c.Condition.bind(indexing)
+	if err != nil {
+		return nil, err
+	}
+	return NotCondition{Condition: condition}, nil
+}
+
+func conditionFields(conditions []Condition) []string {
+	fields := []string{}
+	for _, condition := range conditions {
+		fields = append(fields, condition.Fields()...)
+	}
+	return fields
+}
+
+// containsWords returns true if every word of search appears in text, ignoring case
+func containsWords(text, search string) bool {
+	textWords := map[string]bool{}
+	for _, word := range splitWords(text) {
+		textWords[word] = true
+	}
+	searchWords := splitWords(search)
+	if len(searchWords) == 0 {
+		return strings.EqualFold(text, search)
+	}
+	for _, word := range searchWords {
+		if !textWords[word] {
+			return false
+		}
+	}
+	return true
+}
+
+func splitWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// ParseQuery parses a boolean query like
+//
+//	has_existential_identity_crisis:true AND (total_plumbuses:>1000 OR NOT job:plumber)
+//
+// Conditions are field:value, or field:>value, field:>=value, field:<value and field:<=value
+// for ranges. Values with spaces are quoted, e.g. name:"Name 1". _exists_:field matches records
+// holding a value in a field, and _missing_:field those where it's absent or null.
+// AND binds tighter than OR, conditions next to each other are ANDed, and NOT or - negates
+// the condition after it.
+func ParseQuery(q string) (Condition, error) {
+	tokens, err := tokenizeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("Query is empty")
+	}
+	parser := &queryParser{tokens: tokens}
+	condition, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("Unexpected '%s' in query", parser.tokens[parser.pos])
+	}
+	return condition, nil
+}
+
+// tokenizeQuery splits a query into parentheses and words, keeping quoted values in one word
+func tokenizeQuery(q string) ([]string, error) {
+	tokens := []string{}
+	current := []rune{}
+	inQuotes := false
+	escaped := false
+	flush := func() {
+		if len(current) > 0 {
+			tokens = append(tokens, string(current))
+			current = []rune{}
+		}
+	}
+	for _, r := range q {
+		switch {
+		case inQuotes:
+			current = append(current, r)
+			if escaped {
+				escaped = false
+			} else if r == '\\' {
+				escaped = true
+			} else if r == '"' {
+				inQuotes = false
+			}
+		case r == '"':
+			current = append(current, r)
+			inQuotes = true
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			current = append(current, r)
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("Query has an unterminated quote")
+	}
+	flush()
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *queryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *queryParser) parseOr() (Condition, error) {
+	conditions := []Condition{}
+	for {
+		condition, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+		if p.peek() != "OR" {
+			break
+		}
+		p.pos++
+	}
+	if len(conditions) == 1 {
+		return conditions[0], nil
+	}
+	return OrCondition{Conditions: conditions}, nil
+}
+
+func (p *queryParser) parseAnd() (Condition, error) {
+	conditions := []Condition{}
+	for {
+		condition, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+		next := p.peek()
+		if next == "AND" {
+			p.pos++
+		} else if next == "" || next == "OR" || next == ")" {
+			break
+		}
+	}
+	if len(conditions) == 1 {
+		return conditions[0], nil
+	}
+	return AndCondition{Conditions: conditions}, nil
+}
+
+func (p *queryParser) parseNot() (Condition, error) {
+	token := p.peek()
+	if token == "NOT" {
+		p.pos++
+		condition, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return NotCondition{Condition: condition}, nil
+	}
+	if strings.HasPrefix(token, "-") && len(token) > 1 {
+		p.tokens[p.pos] = token[1:]
+		condition, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return NotCondition{Condition: condition}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (Condition, error) {
+	token := p.peek()
+	switch token {
+	case "":
+		return nil, fmt.Errorf("Query ends unexpectedly")
+	case "(":
+		p.pos++
+		condition, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("Query is missing a closing ')'")
+		}
+		p.pos++
+		return condition, nil
+	case ")", "AND", "OR":
+		return nil, fmt.Errorf("Unexpected '%s' in query", token)
+	}
+	p.pos++
+	return parseFieldCondition(token)
+}
+
+// Field presence conditions are written as _exists_:field and _missing_:field
+const (
+	ExistsPrefix  = "_exists_"
+	MissingPrefix = "_missing_"
+)
+
+// parseFieldCondition parses a single field:value condition
+func parseFieldCondition(token string) (Condition, error) {
+	parts := strings.SplitN(token, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, fmt.Errorf("'%s' should be in the form field:value", token)
+	}
+	switch parts[0] {
+	case ExistsPrefix, MissingPrefix:
+		if parts[1] == "" {
+			return nil, fmt.Errorf("'%s' is missing a field", token)
+		}
+		if parts[0] == ExistsPrefix {
+			return ExistsCondition{Field: parts[1]}, nil
+		}
+		return MissingCondition{Field: parts[1]}, nil
+	}
+	condition := FieldCondition{
+		Field: parts[0],
+		Op:    OpEquals,
+		Value: parts[1],
+	}
+	for _, op := range []string{OpGreaterOrEqual, OpLessOrEqual, OpGreater, OpLess} {
+		if strings.HasPrefix(condition.Value, op) {
+			condition.Op = op
+			condition.Value = strings.TrimPrefix(condition.Value, op)
+			break
+		}
+	}
+	if strings.HasPrefix(condition.Value, `"`) {
+		value, err := strconv.Unquote(condition.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read quoted value in '%s': %s", token, err)
+		}
+		condition.Value = value
+	}
+	if condition.Value == "" {
+		return nil, fmt.Errorf("'%s' is missing a value", token)
+	}
+	return condition, nil
+}
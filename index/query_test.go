@@ -0,0 +1,384 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+
+	"github.com/zachgoldstein/datatoapi/models"
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected Condition
+		err      bool
+	}{
+		{query: "job:plumber", expected: FieldCondition{Field: "job", Op: OpEquals, Value: "plumber"}},
+		{query: "total_plumbuses:>1000", expected: FieldCondition{Field: "total_plumbuses", Op: OpGreater, Value: "1000"}},
+		{query: "total_plumbuses:>=1000", expected: FieldCondition{Field: "total_plumbuses", Op: OpGreaterOrEqual, Value: "1000"}},
+		{query: "total_plumbuses:<1000", expected: FieldCondition{Field: "total_plumbuses", Op: OpLess, Value: "1000"}},
+		{query: "total_plumbuses:<=1000", expected: FieldCondition{Field: "total_plumbuses", Op: OpLessOrEqual, Value: "1000"}},
+		{query: `name:"Name 1"`, expected: FieldCondition{Field: "name", Op: OpEquals, Value: "Name 1"}},
+		{query: `name:"say \"hi\""`, expected: FieldCondition{Field: "name", Op: OpEquals, Value: `say "hi"`}},
+		{query: "address.city:Seattle", expected: FieldCondition{Field: "address.city", Op: OpEquals, Value: "Seattle"}},
+		{query: "time:12:30", expected: FieldCondition{Field: "time", Op: OpEquals, Value: "12:30"}},
+		{query: "_exists_:job", expected: ExistsCondition{Field: "job"}},
+		{query: "_missing_:job", expected: MissingCondition{Field: "job"}},
+		{
+			query: "a:1 AND b:2",
+			expected: AndCondition{Conditions: []Condition{
+				FieldCondition{Field: "a", Op: OpEquals, Value: "1"},
+				FieldCondition{Field: "b", Op: OpEquals, Value: "2"},
+			}},
+		},
+		{
+			query: "a:1 b:2",
+			expected: AndCondition{Conditions: []Condition{
+				FieldCondition{Field: "a", Op: OpEquals, Value: "1"},
+				FieldCondition{Field: "b", Op: OpEquals, Value: "2"},
+			}},
+		},
+		{
+			query: "a:1 OR b:2 AND c:3",
+			expected: OrCondition{Conditions: []Condition{
+				FieldCondition{Field: "a", Op: OpEquals, Value: "1"},
+				AndCondition{Conditions: []Condition{
+					FieldCondition{Field: "b", Op: OpEquals, Value: "2"},
+					FieldCondition{Field: "c", Op: OpEquals, Value: "3"},
+				}},
+			}},
+		},
+		{
+			query: "(a:1 OR b:2) AND NOT c:3",
+			expected: AndCondition{Conditions: []Condition{
+				OrCondition{Conditions: []Condition{
+					FieldCondition{Field: "a", Op: OpEquals, Value: "1"},
+					FieldCondition{Field: "b", Op: OpEquals, Value: "2"},
+				}},
+				NotCondition{Condition: FieldCondition{Field: "c", Op: OpEquals, Value: "3"}},
+			}},
+		},
+		{
+			query: "-a:1 NOT NOT b:2",
+			expected: AndCondition{Conditions: []Condition{
+				NotCondition{Condition: FieldCondition{Field: "a", Op: OpEquals, Value: "1"}},
+				NotCondition{Condition: NotCondition{Condition: FieldCondition{Field: "b", Op: OpEquals, Value: "2"}}},
+			}},
+		},
+		{query: "", err: true},
+		{query: "   ", err: true},
+		{query: "plumber", err: true},
+		{query: ":plumber", err: true},
+		{query: "job:", err: true},
+		{query: "total:>", err: true},
+		{query: `name:"Name 1`, err: true},
+		{query: "(a:1 OR b:2", err: true},
+		{query: "a:1)", err: true},
+		{query: "a:1 AND", err: true},
+		{query: "OR a:1", err: true},
+		{query: "NOT", err: true},
+		{query: "_exists_:", err: true},
+	}
+	for _, test := range tests {
+		condition, err := ParseQuery(test.query)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseQuery(%q) = %#v, expected an error", test.query, condition)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseQuery(%q) returned error: %s", test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(condition, test.expected) {
+			t.Errorf("ParseQuery(%q) = %#v, expected %#v", test.query, condition, test.expected)
+		}
+	}
+}
+
+func TestTokenizeQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{query: "a:1", expected: []string{"a:1"}},
+		{query: "  a:1   b:2 ", expected: []string{"a:1", "b:2"}},
+		{query: "(a:1 OR b:2)", expected: []string{"(", "a:1", "OR", "b:2", ")"}},
+		{query: `name:"Name (1) OR 2"`, expected: []string{`name:"Name (1) OR 2"`}},
+		{query: `name:"a \" b" c:1`, expected: []string{`name:"a \" b"`, "c:1"}},
+		{query: "", expected: []string{}},
+	}
+	for _, test := range tests {
+		tokens, err := tokenizeQuery(test.query)
+		if err != nil {
+			t.Errorf("tokenizeQuery(%q) returned error: %s", test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(tokens, test.expected) {
+			t.Errorf("tokenizeQuery(%q) = %q, expected %q", test.query, tokens, test.expected)
+		}
+	}
+}
+
+func TestBindFieldConditionRange(t *testing.T) {
+	text := func(field string) fieldIndexing { return fieldIndexing{textOnly: true} }
+	keywords := func(field string) fieldIndexing { return fieldIndexing{keyword: true, textOnly: true} }
+	dates := func(field string) fieldIndexing { return fieldIndexing{textOnly: true, date: true} }
+	tests := []struct {
+		condition FieldCondition
+		indexing  func(field string) fieldIndexing
+		err       bool
+	}{
+		{condition: FieldCondition{Field: "name", Op: OpGreater, Value: "m"}, indexing: text, err: true},
+		{condition: FieldCondition{Field: "name", Op: OpGreater, Value: "m"}, indexing: keywords},
+		{condition: FieldCondition{Field: "name", Op: OpEquals, Value: "m"}, indexing: text},
+		{condition: FieldCondition{Field: "count", Op: OpGreater, Value: "10"}, indexing: func(field string) fieldIndexing { return fieldIndexing{} }},
+		{condition: FieldCondition{Field: "created", Op: OpLess, Value: "2020-01-01"}, indexing: dates},
+		{condition: FieldCondition{Field: "created", Op: OpLess, Value: "soon"}, indexing: dates, err: true},
+	}
+	for _, test := range tests {
+		_, err := test.condition.bind(test.indexing)
+		if test.err != (err != nil) {
+			t.Errorf("Binding %#v returned error %v, expected error: %t", test.condition, err, test.err)
+		}
+	}
+}
+
+// testRecords are indexed by newTestIndexStore, under the ids r1, r2...
+var testRecords = []string{
+	`{"id": "A-1", "name": "Rick Sanchez", "age": 70, "alive": true, "created": "2020-01-02T10:00:00Z", "tags": ["scientist", "grandpa"], "address": {"city": "Seattle"}}`,
+	`{"id": "a-2", "name": "Morty Smith", "age": 14, "alive": true, "created": "2020-03-04T10:00:00+02:00", "tags": ["student"], "address": {"city": "Seattle"}, "job": null}`,
+	`{"id": "B-3", "name": "Summer Smith", "age": 17.5, "alive": false, "created": "2021-05-06T00:00:00Z", "job": "intern"}`,
+	`{"id": "b-4", "name": "Birdperson", "age": "unknown", "created": "2019-12-31T23:59:59Z", "address": {"city": "Bird World"}}`,
+}
+
+// newTestIndexStore indexes records in memory, mapped the way BuildDataMapping maps them
+func newTestIndexStore(t *testing.T, schema models.Schema, comparator storage.ValueComparator, records []string) (*IndexStore, map[string]map[string]interface{}) {
+	is := NewIndexStore(nil, nil, schema, comparator)
+	indexMapping := bleve.NewIndexMapping()
+	dataMapping := bleve.NewDocumentMapping()
+	indexMapping.DefaultMapping.AddSubDocumentMapping("Data", dataMapping)
+	addPresenceMappings(indexMapping)
+	err := is.addSchemaAnalyzers(indexMapping, dataMapping)
+	if err != nil {
+		t.Fatalf("Could not add schema analyzers: %s", err)
+	}
+
+	decoded := map[string]map[string]interface{}{}
+	for i, recordJSON := range records {
+		record := map[string]interface{}{}
+		err := json.Unmarshal([]byte(recordJSON), &record)
+		if err != nil {
+			t.Fatalf("Could not read test record: %s", err)
+		}
+		for k, v := range record {
+			is.addValueMapping(dataMapping, []string{k}, v)
+		}
+		decoded[fmt.Sprintf("r%d", i+1)] = record
+	}
+
+	is.searchIndex, err = bleve.NewMemOnly(indexMapping)
+	if err != nil {
+		t.Fatalf("Could not create search index: %s", err)
+	}
+	for uid, record := range decoded {
+		indexData := models.IndexData{UID: uid, Data: record}
+		indexData.Present, indexData.Null = storage.FieldPresence(record)
+		err := is.searchIndex.Index(uid, indexData)
+		if err != nil {
+			t.Fatalf("Could not index test record: %s", err)
+		}
+	}
+	return is, decoded
+}
+
+// searchIDs returns the ids of the documents matching a condition's bleve query
+func searchIDs(t *testing.T, is *IndexStore, condition Condition) []string {
+	searchReq := bleve.NewSearchRequestOptions(condition.BleveQuery(), 100, 0, false)
+	results, err := is.searchIndex.SearchInContext(context.Background(), searchReq)
+	if err != nil {
+		t.Fatalf("Could not search for %#v: %s", condition, err)
+	}
+	ids := []string{}
+	for _, hit := range results.Hits {
+		ids = append(ids, hit.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// matchIDs returns the ids of the records a condition matches
+func matchIDs(condition Condition, records map[string]map[string]interface{}) []string {
+	ids := []string{}
+	for id, record := range records {
+		if condition.Match(record) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestConditionsMatchSearchIndex(t *testing.T) {
+	is, records := newTestIndexStore(t, nil, storage.ValueComparator{Precision: 0.01}, testRecords)
+	defer is.searchIndex.Close()
+	exactIs, _ := newTestIndexStore(t, nil, storage.DefaultComparator, testRecords)
+	defer exactIs.searchIndex.Close()
+
+	parsed := func(q string) Condition {
+		condition, err := ParseQuery(q)
+		if err != nil {
+			t.Fatalf("Could not parse %q: %s", q, err)
+		}
+		return condition
+	}
+	wildcard, _ := NewWildcardCondition("id", "b-?")
+	textWildcard, _ := NewWildcardCondition("name", "sm?th")
+	regexpCondition, _ := NewRegexpCondition("id", "[AB]-[0-9]")
+	textRegexp, _ := NewRegexpCondition("name", "s.*")
+
+	tests := []struct {
+		name      string
+		condition Condition
+		expected  []string
+		// exact compares numbers without a precision
+		exact bool
+	}{
+		{name: "number", condition: parsed("age:14"), expected: []string{"r2"}},
+		{name: "number within precision", condition: parsed("age:17.505"), expected: []string{"r3"}},
+		{name: "number greater", condition: parsed("age:>17.5"), expected: []string{"r1"}},
+		{name: "number greater or equal", condition: parsed("age:>=17.5"), expected: []string{"r1", "r3"}},
+		{name: "number less", condition: parsed("age:<17.5"), expected: []string{"r2"}},
+		{name: "number less or equal", condition: parsed("age:<=17.5"), expected: []string{"r2", "r3"}},
+		{name: "bool", condition: parsed("alive:false"), expected: []string{"r3"}},
+		{name: "words", condition: parsed("name:smith"), expected: []string{"r2", "r3"}},
+		{name: "every word", condition: parsed(`name:"SUMMER smith"`), expected: []string{"r3"}},
+		{name: "string in mixed field", condition: parsed("age:unknown"), expected: []string{"r4"}},
+		{name: "keyword", condition: parsed("id:A-1"), expected: []string{"r1"}},
+		{name: "keyword keeps case", condition: parsed("id:a-1"), expected: []string{}},
+		{name: "keyword range", condition: parsed("id:>=b"), expected: []string{"r4"}},
+		{name: "keyword range upper", condition: parsed("id:<a"), expected: []string{"r1", "r3"}},
+		{name: "date", condition: parsed("created:2020-03-04T08:00:00Z"), expected: []string{"r2"}},
+		{name: "date range", condition: parsed("created:>2020-02-01T00:00:00Z"), expected: []string{"r2", "r3"}},
+		{name: "date range with offset", condition: parsed("created:<2020-01-02T12:00:00+02:00"), expected: []string{"r4"}},
+		{name: "array", condition: parsed("tags:student"), expected: []string{"r2"}},
+		{name: "nested", condition: parsed("address.city:seattle"), expected: []string{"r1", "r2"}},
+		{name: "exists", condition: parsed("_exists_:job"), expected: []string{"r3"}},
+		{name: "missing", condition: parsed("_missing_:job"), expected: []string{"r1", "r2", "r4"}},
+		{name: "missing nested", condition: parsed("_missing_:address.city"), expected: []string{"r3"}},
+		{name: "not", condition: parsed("NOT name:smith"), expected: []string{"r1", "r4"}},
+		{name: "and or", condition: parsed("(name:rick OR age:<15) AND alive:true"), expected: []string{"r1", "r2"}},
+		{name: "negated nested", condition: parsed("-address.city:seattle"), expected: []string{"r3", "r4"}},
+		{name: "prefix", condition: PrefixCondition{Field: "name", Prefix: "SM"}, expected: []string{"r2", "r3"}},
+		{name: "keyword prefix", condition: PrefixCondition{Field: "id", Prefix: "b"}, expected: []string{"r4"}},
+		{name: "wildcard", condition: textWildcard, expected: []string{"r2", "r3"}},
+		{name: "keyword wildcard", condition: wildcard, expected: []string{"r4"}},
+		{name: "fuzzy", condition: FuzzyCondition{Field: "name", Value: "smyth", Fuzziness: 1}, expected: []string{"r2", "r3"}},
+		{name: "keyword fuzzy", condition: FuzzyCondition{Field: "id", Value: "A-2", Fuzziness: 1}, expected: []string{"r1", "r2"}},
+		{name: "regexp", condition: textRegexp, expected: []string{"r1", "r2", "r3"}},
+		{name: "keyword regexp", condition: regexpCondition, expected: []string{"r1", "r3"}},
+		{name: "exact number greater", condition: parsed("age:>17.5"), expected: []string{"r1"}, exact: true},
+		{name: "exact number less", condition: parsed("age:<17.5"), expected: []string{"r2"}, exact: true},
+		{name: "exact number equal", condition: parsed("age:17.505"), expected: []string{}, exact: true},
+		{name: "exact date greater", condition: parsed("created:>2021-05-06T00:00:00Z"), expected: []string{}, exact: true},
+		{name: "exact date less", condition: parsed("created:<2019-12-31T23:59:59Z"), expected: []string{}, exact: true},
+		{name: "exact keyword greater", condition: parsed("id:>b-4"), expected: []string{}, exact: true},
+		{name: "exact keyword less", condition: parsed("id:<A-1"), expected: []string{}, exact: true},
+	}
+	for _, test := range tests {
+		is := is
+		if test.exact {
+			is = exactIs
+		}
+		condition, err := is.BindCondition(test.condition)
+		if err != nil {
+			t.Errorf("%s: could not bind condition: %s", test.name, err)
+			continue
+		}
+		searched := searchIDs(t, is, condition)
+		matched := matchIDs(condition, records)
+		if !reflect.DeepEqual(searched, matched) {
+			t.Errorf("%s: search index found %v, but records matched %v", test.name, searched, matched)
+		}
+		if !reflect.DeepEqual(matched, test.expected) {
+			t.Errorf("%s: matched %v, expected %v", test.name, matched, test.expected)
+		}
+	}
+}
+
+func TestFieldIndexing(t *testing.T) {
+	schema := models.Schema{"name": models.FieldSchema{Analyzer: "keyword"}}
+	is, _ := newTestIndexStore(t, schema, storage.ValueComparator{}, testRecords)
+	defer is.searchIndex.Close()
+
+	tests := []struct {
+		field    string
+		expected fieldIndexing
+	}{
+		{field: "id", expected: fieldIndexing{keyword: true, textOnly: true}},
+		{field: "name", expected: fieldIndexing{keyword: true, textOnly: true}},
+		{field: "tags", expected: fieldIndexing{textOnly: true}},
+		{field: "tags[]", expected: fieldIndexing{textOnly: true}},
+		{field: "age", expected: fieldIndexing{}},
+		{field: "alive", expected: fieldIndexing{}},
+		{field: "created", expected: fieldIndexing{textOnly: true, date: true}},
+		{field: "address.city", expected: fieldIndexing{textOnly: true}},
+		{field: "unmapped", expected: fieldIndexing{}},
+	}
+	for _, test := range tests {
+		indexing := is.fieldIndexing(test.field)
+		if indexing != test.expected {
+			t.Errorf("fieldIndexing(%q) = %+v, expected %+v", test.field, indexing, test.expected)
+		}
+	}
+}
+
+func TestFieldIndexingUnmappedIDFields(t *testing.T) {
+	schema := models.Schema{"order_id": models.FieldSchema{Analyzer: "keyword"}}
+	is, records := newTestIndexStore(t, schema, storage.ValueComparator{}, testRecords)
+	defer is.searchIndex.Close()
+
+	// Neither field was in the records the mapping was built from, only the schema names order_id
+	late := map[string]interface{}{"user_id": "ABC-123", "order_id": "XYZ-9"}
+	err := is.searchIndex.Index("late", models.IndexData{UID: "late", Data: late})
+	if err != nil {
+		t.Fatalf("Could not index test record: %s", err)
+	}
+	records["late"] = late
+
+	tests := []struct {
+		field     string
+		condition string
+		keyword   bool
+	}{
+		{field: "user_id", condition: "user_id:ABC-123", keyword: false},
+		{field: "order_id", condition: "order_id:XYZ-9", keyword: true},
+		{field: "order_id", condition: "order_id:>XYZ", keyword: true},
+	}
+	for _, test := range tests {
+		if indexing := is.fieldIndexing(test.field); indexing.keyword != test.keyword {
+			t.Errorf("fieldIndexing(%q) = %+v, expected keyword to be %t", test.field, indexing, test.keyword)
+		}
+		condition, err := ParseQuery(test.condition)
+		if err == nil {
+			condition, err = is.BindCondition(condition)
+		}
+		if err != nil {
+			t.Errorf("Could not bind %s: %s", test.condition, err)
+			continue
+		}
+		searched := searchIDs(t, is, condition)
+		matched := matchIDs(condition, records)
+		if !reflect.DeepEqual(searched, []string{"late"}) || !reflect.DeepEqual(matched, []string{"late"}) {
+			t.Errorf("%s: search index found %v and records matched %v, expected the late record", test.condition, searched, matched)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zachgoldstein/datatoapi/models"
+	"github.com/zachgoldstein/datatoapi/storage"
+)
+
+// SparseIndexFile is the name of the file a sparse index is stored in, within the index path
+const SparseIndexFile = "sparse.json"
+
+// SparseIndex lists every data block with the range of each sort key it holds. It's written
+// only once scanning completes, so an index path without one is treated as incomplete.
+type SparseIndex struct {
+	Complete bool
+	SortKeys []string
+	Blocks   []models.DataBlock
+	BuiltAt  time.Time
+}
+
+// SparseIndexStore answers lookups on data sorted by one or more keys without indexing every
+// record. Only the smallest and largest value of each sort key is kept per data block, and
+// lookups binary search the blocks of each file for the ones that could hold a value.
+type SparseIndexStore struct {
+	store    storage.PhysicalStorer
+	sortKeys []string
+	index    *SparseIndex
+	// keyBlocks holds, for each sort key, the blocks of every file that have a range for the key
+	keyBlocks map[string][][]models.DataBlock
+}
+
+// NewSparseIndexStore creates a SparseIndexStore pointer with a storage object and the keys data is sorted by
+func NewSparseIndexStore(store storage.PhysicalStorer, sortKeys []string) *SparseIndexStore {
+	return &SparseIndexStore{
+		store:    store,
+		sortKeys: sortKeys,
+	}
+}
+
+// Start will open an existing sparse index (or build one), making it available for lookups.
+// Indexes built with different sort keys are rebuilt.
+func (ss *SparseIndexStore) Start(ctx context.Context, path string) error {
+	err := RemoveStaleBuilds(filepath.Join(path, SparseIndexFile))
+	if err != nil {
+		return err
+	}
+
+	sparseIndex, err := ReadSparseIndex(path)
+	if err == nil && !sameKeys(sparseIndex.SortKeys, ss.sortKeys) {
+		err = fmt.Errorf("Index was built with sort keys %v", sparseIndex.SortKeys)
+	}
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"path": path,
+		}).Info("Could not find valid sparse index")
+
+		sparseIndex, err = ss.BuildSparseIndex(ctx)
+		if err != nil {
+			return err
+		}
+		err = WriteSparseIndex(path, sparseIndex)
+		if err != nil {
+			return err
+		}
+	} else {
+		log.WithFields(log.Fields{
+			"path": path,
+		}).Info("Found sparse index")
+	}
+
+	ss.index = sparseIndex
+	ss.keyBlocks = groupBlocksByKey(sparseIndex)
+	log.WithFields(log.Fields{
+		"numBlocks": len(sparseIndex.Blocks),
+		"sortKeys":  strings.Join(ss.sortKeys, ","),
+	}).Info("Started sparse index store")
+	return nil
+}
+
+// Close releases the sparse index. It's held in memory, so there is nothing to flush.
+func (ss *SparseIndexStore) Close() error {
+	ss.index = nil
+	ss.keyBlocks = nil
+	log.Info("Closed sparse index store")
+	return nil
+}
+
+// BuildSparseIndex scans the data, keeping only the data blocks and their sort key ranges.
+// Within each file every sort key must never decrease, otherwise lookups would miss records.
+func (ss *SparseIndexStore) BuildSparseIndex(ctx context.Context) (*SparseIndex, error) {
+	log.Info("Building sparse index")
+
+	dataChan := make(chan models.IndexData, DefaultChanSize)
+	blockChan := make(chan models.DataBlock, DefaultChanSize)
+	scanErrChan := make(chan error, 1)
+	go func() {
+		scanErrChan <- ss.store.ScanDataBlocks(ctx, dataChan, blockChan)
+	}()
+	go func() {
+		for _ = range dataChan {
+			continue
+		}
+	}()
+
+	sparseIndex := &SparseIndex{
+		SortKeys: ss.sortKeys,
+		Blocks:   []models.DataBlock{},
+	}
+	var sortErr error
+	lastRanges := map[string]models.KeyRange{}
+	lastAddress := ""
+	for block := range blockChan {
+		if sortErr != nil {
+			continue
+		}
+		if block.File.Address != lastAddress {
+			lastRanges = map[string]models.KeyRange{}
+			lastAddress = block.File.Address
+		}
+		for key, keyRange := range block.Ranges {
+			if last, ok := lastRanges[key]; ok {
+				cmp, err := storage.CompareValues(last.Max, keyRange.Min)
+				if err != nil || cmp > 0 {
+					sortErr = fmt.Errorf("%s is not sorted by '%s' around byte %d", block.File.Address, key, block.Start)
+				}
+			}
+			lastRanges[key] = keyRange
+		}
+		block.RefKey = ""
+		sparseIndex.Blocks = append(sparseIndex.Blocks, block)
+		if len(sparseIndex.Blocks)%(IndexPrintFreq*100) == 0 {
+			log.WithFields(log.Fields{
+				"numBlocks": len(sparseIndex.Blocks),
+			}).Info("Writing sparse index...")
+		}
+	}
+
+	if err := <-scanErrChan; err != nil {
+		log.WithError(err).Error("Could not scan data for indexing")
+		return nil, err
+	}
+	if sortErr != nil {
+		log.WithError(sortErr).Error("Could not build sparse index")
+		return nil, sortErr
+	}
+
+	sparseIndex.Complete = true
+	sparseIndex.BuiltAt = time.Now()
+	log.WithFields(log.Fields{
+		"numBlocks": len(sparseIndex.Blocks),
+	}).Info("Built sparse index")
+	return sparseIndex, nil
+}
+
+// ReadSparseIndex reads a complete sparse index from an index path
+func ReadSparseIndex(path string) (*SparseIndex, error) {
+	indexBytes, err := ioutil.ReadFile(filepath.Join(path, SparseIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	sparseIndex := &SparseIndex{}
+	err = json.Unmarshal(indexBytes, sparseIndex)
+	if err != nil {
+		return nil, err
+	}
+	if !sparseIndex.Complete {
+		return nil, fmt.Errorf("Sparse index build is not complete")
+	}
+	return sparseIndex, nil
+}
+
+// WriteSparseIndex writes a sparse index into an index path. It's written to a temporary
+// file first and renamed into place, so a crash never leaves a partial index behind.
+func WriteSparseIndex(path string, sparseIndex *SparseIndex) error {
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return err
+	}
+	indexBytes, err := json.Marshal(sparseIndex)
+	if err != nil {
+		return err
+	}
+	buildPath := fmt.Sprintf("%s%s%d", filepath.Join(path, SparseIndexFile), BuildDirSuffix, time.Now().UnixNano())
+	err = ioutil.WriteFile(buildPath, indexBytes, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(buildPath, filepath.Join(path, SparseIndexFile))
+	if err != nil {
+		os.Remove(buildPath)
+		return err
+	}
+	return nil
+}
+
+// groupBlocksByKey splits the blocks of a sparse index into runs of blocks from the same file,
+// for each sort key, keeping only the blocks that hold the key
+func groupBlocksByKey(sparseIndex *SparseIndex) map[string][][]models.DataBlock {
+	keyBlocks := map[string][][]models.DataBlock{}
+	for _, key := range sparseIndex.SortKeys {
+		files := [][]models.DataBlock{}
+		lastAddress := ""
+		for _, block := range sparseIndex.Blocks {
+			if _, ok := block.Ranges[key]; !ok {
+				continue
+			}
+			if len(files) == 0 || block.File.Address != lastAddress {
+				files = append(files, []models.DataBlock{})
+				lastAddress = block.File.Address
+			}
+			files[len(files)-1] = append(files[len(files)-1], block)
+		}
+		keyBlocks[key] = files
+	}
+	return keyBlocks
+}
+
+// IsSortKey returns true if field is one of the keys the data is sorted by
+func (ss *SparseIndexStore) IsSortKey(field string) bool {
+	_, ok := ss.keyBlocks[field]
+	return ok
+}
+
+// ParseValue converts a value from a request into the type a sort key is stored as
+func (ss *SparseIndexStore) ParseValue(field, value string) (interface{}, error) {
+	for _, blocks := range ss.keyBlocks[field] {
+		if _, ok := blocks[0].Ranges[field].Min.(float64); ok {
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("'%s' should be a number: %s", field, err)
+			}
+			return number, nil
+		}
+		break
+	}
+	return value, nil
+}
+
+// Blocks returns the data blocks that may hold records where field is between from and to, inclusive.
+// A nil bound leaves that end of the range open.
+func (ss *SparseIndexStore) Blocks(field string, from, to interface{}) ([]models.DataBlock, error) {
+	files, ok := ss.keyBlocks[field]
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not a sort key, sparse indexes can only look up %s", field, strings.Join(ss.sortKeys, ", "))
+	}
+
+	matches := []models.DataBlock{}
+	for _, blocks := range files {
+		// Blocks are sorted, so skip every block that ends before the range starts
+		first := 0
+		if from != nil {
+			first = sort.Search(len(blocks), func(i int) bool {
+				cmp, err := storage.CompareValues(blocks[i].Ranges[field].Max, from)
+				return err == nil && cmp >= 0
+			})
+		}
+		for _, block := range blocks[first:] {
+			if to != nil {
+				cmp, err := storage.CompareValues(block.Ranges[field].Min, to)
+				if err != nil || cmp > 0 {
+					break
+				}
+			}
+			matches = append(matches, block)
+		}
+	}
+	log.WithFields(log.Fields{
+		"field":     field,
+		"numBlocks": len(matches),
+	}).Info("Found sparse index blocks")
+	return matches, nil
+}
+
+func sameKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/zachgoldstein/datatoapi/models"
+)
+
+// testSparseBlock creates a data block of a file holding id from min to max
+func testSparseBlock(uid, file string, min, max interface{}) models.DataBlock {
+	return models.DataBlock{
+		UID:    uid,
+		File:   models.File{Address: file},
+		Ranges: map[string]models.KeyRange{"id": {Min: min, Max: max}},
+	}
+}
+
+// newTestSparseIndexStore writes a sparse index and reads it back, the way Start loads one
+func newTestSparseIndexStore(t *testing.T, blocks []models.DataBlock) *SparseIndexStore {
+	path, err := ioutil.TempDir("", "sparse")
+	if err != nil {
+		t.Fatalf("Could not create index path: %s", err)
+	}
+	defer os.RemoveAll(path)
+	err = WriteSparseIndex(path, &SparseIndex{Complete: true, SortKeys: []string{"id"}, Blocks: blocks})
+	if err != nil {
+		t.Fatalf("Could not write sparse index: %s", err)
+	}
+	sparseIndex, err := ReadSparseIndex(path)
+	if err != nil {
+		t.Fatalf("Could not read sparse index: %s", err)
+	}
+	ss := NewSparseIndexStore(nil, []string{"id"})
+	ss.index = sparseIndex
+	ss.keyBlocks = groupBlocksByKey(sparseIndex)
+	return ss
+}
+
+func TestSparseBlocks(t *testing.T) {
+	ss := newTestSparseIndexStore(t, []models.DataBlock{
+		testSparseBlock("a1", "a.json", 1.0, 10.0),
+		testSparseBlock("a2", "a.json", 10.0, 20.0),
+		testSparseBlock("a3", "a.json", 21.0, 30.0),
+		{UID: "a4", File: models.File{Address: "a.json"}},
+		testSparseBlock("b1", "b.json", 5.0, 15.0),
+		testSparseBlock("b2", "b.json", 40.0, 50.0),
+	})
+	tests := []struct {
+		from, to interface{}
+		expected []string
+	}{
+		{from: 10.0, to: 10.0, expected: []string{"a1", "a2", "b1"}},
+		{from: 20.5, to: 20.5, expected: []string{}},
+		{from: 25.0, to: nil, expected: []string{"a3", "b2"}},
+		{from: nil, to: 4.0, expected: []string{"a1"}},
+		{from: nil, to: nil, expected: []string{"a1", "a2", "a3", "b1", "b2"}},
+		{from: 16.0, to: 45.0, expected: []string{"a2", "a3", "b2"}},
+		{from: 60.0, to: 70.0, expected: []string{}},
+		{from: 0.0, to: 0.5, expected: []string{}},
+	}
+	for _, test := range tests {
+		blocks, err := ss.Blocks("id", test.from, test.to)
+		if err != nil {
+			t.Errorf("Blocks(%v, %v) returned error: %s", test.from, test.to, err)
+			continue
+		}
+		uids := []string{}
+		for _, block := range blocks {
+			uids = append(uids, block.UID)
+		}
+		if !reflect.DeepEqual(uids, test.expected) {
+			t.Errorf("Blocks(%v, %v) = %q, expected %q", test.from, test.to, uids, test.expected)
+		}
+	}
+
+	if ss.IsSortKey("name") {
+		t.Errorf("name isn't a sort key")
+	}
+	if _, err := ss.Blocks("name", "a", "b"); err == nil {
+		t.Errorf("Looking up blocks by a field that isn't a sort key expected an error")
+	}
+}
+
+func TestSparseParseValue(t *testing.T) {
+	tests := []struct {
+		blocks   []models.DataBlock
+		value    string
+		expected interface{}
+		err      bool
+	}{
+		{blocks: []models.DataBlock{testSparseBlock("a1", "a.json", 1.0, 10.0)}, value: "5.5", expected: 5.5},
+		{blocks: []models.DataBlock{testSparseBlock("a1", "a.json", 1.0, 10.0)}, value: "five", err: true},
+		{blocks: []models.DataBlock{testSparseBlock("a1", "a.json", "a", "m")}, value: "5.5", expected: "5.5"},
+		{blocks: []models.DataBlock{}, value: "5.5", expected: "5.5"},
+	}
+	for _, test := range tests {
+		ss := newTestSparseIndexStore(t, test.blocks)
+		value, err := ss.ParseValue("id", test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseValue(%q) = %#v, expected an error", test.value, value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseValue(%q) returned error: %s", test.value, err)
+			continue
+		}
+		if value != test.expected {
+			t.Errorf("ParseValue(%q) = %#v, expected %#v", test.value, value, test.expected)
+		}
+	}
+}
+
+func TestReadIncompleteSparseIndex(t *testing.T) {
+	path, err := ioutil.TempDir("", "sparse")
+	if err != nil {
+		t.Fatalf("Could not create index path: %s", err)
+	}
+	defer os.RemoveAll(path)
+	err = WriteSparseIndex(path, &SparseIndex{SortKeys: []string{"id"}})
+	if err != nil {
+		t.Fatalf("Could not write sparse index: %s", err)
+	}
+	if _, err := ReadSparseIndex(path); err == nil {
+		t.Errorf("Reading an incomplete sparse index expected an error")
+	}
+}
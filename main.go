@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/zachgoldstein/datatoapi/engine"
@@ -19,30 +20,151 @@ const TitleASCII = `
 
 `
 
-func main() {
+// loadConfig builds the config from the defaults, the config file set with -config, environment
+// variables and then the command line flags in args, each overriding the last
+func loadConfig(args []string, lookupEnv func(key string) (string, bool)) (engine.Config, error) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	var configPath = flags.String("config", "", "Path to a yaml or toml config file, see the readme for its format")
+	var port = flags.Int("port", 8123, "What port will Datapi run on?")
+	var indexPath = flags.String("index", "./datatoapi.index", "Where will indexes be stored?")
+	var storagePath = flags.String("storage", "https://s3.amazonaws.com/datatoapi/data.jsonfiles", "Where is the data you'd like to expose stored?")
+	var datasets = flags.String("datasets", "", "Path to a json file listing named datasets to serve under /datasets/{name}")
+	var logType = flags.String("logType", "normal", "What type of logs should datapi output? Options are normal, json")
+	var include = flags.String("include", "", "Comma separated glob patterns of files to index under the storage path, e.g. '*.jsonfiles'")
+	var exclude = flags.String("exclude", "", "Comma separated glob patterns of files to skip under the storage path")
+	var blockRecords = flags.Int("blockRecords", 0, "How many records go in each data block fetched from storage, defaults to 50 when blockBytes isn't set")
+	var blockBytes = flags.Int("blockBytes", 0, "Close data blocks once they reach this many bytes, keeping each fetch from storage roughly the same size")
+	var indexMode = flags.String("indexMode", "full", "How to index the storage path. Options are full, sparse")
+	var sortKeys = flags.String("sortKeys", "", "Comma separated fields the data is sorted by, needed for sparse indexes")
+	var bloomFields = flags.String("bloomFields", "", "Comma separated fields to look up with per block bloom filters instead of the search index")
+	var bloomRate = flags.Float64("bloomFalsePositiveRate", 0.01, "How often a bloom filter lookup may fetch a block that doesn't hold the value")
+	var numberPrecision = flags.Float64("numberPrecision", 0, "How far apart numbers may be and still match in lookups, e.g. 0.000001 for values stored as float32")
+	var s3Endpoint = flags.String("s3Endpoint", "", "Custom endpoint for S3-compatible storage (MinIO, Ceph, Spaces)")
+	var s3Region = flags.String("s3Region", "us-east-1", "What region is the S3 bucket in?")
+	var s3PathStyle = flags.Bool("s3PathStyle", false, "Use path-style S3 addressing (needed by most S3-compatible storage)")
+	var azureAccount = flags.String("azureAccount", "", "Azure storage account name, defaults to AZURE_STORAGE_ACCOUNT")
+	var azureEndpoint = flags.String("azureEndpoint", "", "Custom blob service endpoint, e.g. for the Azurite emulator")
+	var gcsEndpoint = flags.String("gcsEndpoint", "", "Custom GCS endpoint, e.g. for fake-gcs-server")
+	var gcsCredentialsFile = flags.String("gcsCredentialsFile", "", "Service account file for GCS, defaults to application default credentials")
+	var gcsAnonymous = flags.Bool("gcsAnonymous", false, "Access GCS without credentials (public buckets, fake-gcs-server)")
+	var swiftAuthURL = flags.String("swiftAuthURL", "", "Keystone auth url for swift, defaults to OS_AUTH_URL")
+	var swiftUser = flags.String("swiftUser", "", "Swift user name, defaults to OS_USERNAME")
+	var swiftDomain = flags.String("swiftDomain", "", "Swift user domain, defaults to OS_USER_DOMAIN_NAME")
+	var swiftTenant = flags.String("swiftTenant", "", "Swift project/tenant name, defaults to OS_PROJECT_NAME")
+	var swiftRegion = flags.String("swiftRegion", "", "Swift region, defaults to OS_REGION_NAME")
+	var httpManifest = flags.Bool("httpManifest", false, "Treat an http(s) storage path as a manifest listing data file urls")
 
-	var port = flag.Int("port", 8123, "What port will Datapi run on?")
-	var indexPath = flag.String("index", "./datatoapi.index", "Where will indexes be stored?")
-	var storagePath = flag.String("storage", "https://s3.amazonaws.com/datatoapi/data.jsonfiles", "Where is the data you'd like to expose stored?")
-	var logType = flag.String("logType", "normal", "What type of logs should datapi output? Options are normal, json")
+	err := flags.Parse(args)
+	if err != nil {
+		return engine.Config{}, err
+	}
 
-	flag.Parse()
-	if *logType == "json" {
-		log.SetFormatter(&log.JSONFormatter{})
+	config := engine.DefaultConfig()
+	if *configPath != "" {
+		config, err = engine.LoadConfigFile(*configPath)
+		if err != nil {
+			return config, err
+		}
+	}
+	err = config.ApplyEnv(lookupEnv)
+	if err != nil {
+		return config, fmt.Errorf("Could not read config from the environment: %s", err)
 	}
 
-	config := engine.Config{
-		IndexPath:   *indexPath,
-		StoragePath: *storagePath,
-		Port:        *port,
+	// Only flags that were set on the command line override the config file and environment
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			config.Port = *port
+		case "index":
+			config.IndexPath = *indexPath
+		case "storage":
+			config.StoragePath = *storagePath
+		case "logType":
+			config.LogType = *logType
+		case "include":
+			config.Include = engine.SplitList(*include)
+		case "exclude":
+			config.Exclude = engine.SplitList(*exclude)
+		case "blockRecords":
+			config.BlockRecords = *blockRecords
+		case "blockBytes":
+			config.BlockBytes = *blockBytes
+		case "indexMode":
+			config.IndexMode = *indexMode
+		case "sortKeys":
+			config.SortKeys = engine.SplitList(*sortKeys)
+		case "bloomFields":
+			config.BloomFields = engine.SplitList(*bloomFields)
+		case "bloomFalsePositiveRate":
+			config.BloomFalsePositiveRate = *bloomRate
+		case "numberPrecision":
+			config.NumberPrecision = *numberPrecision
+		case "datasets":
+			var datasetConfigs []engine.DatasetConfig
+			datasetConfigs, err = engine.LoadDatasets(*datasets)
+			if err != nil {
+				err = fmt.Errorf("Could not load datasets: %s", err)
+			}
+			config.Datasets = datasetConfigs
+		case "s3Endpoint":
+			config.S3.Endpoint = *s3Endpoint
+		case "s3Region":
+			config.S3.Region = *s3Region
+		case "s3PathStyle":
+			config.S3.ForcePathStyle = *s3PathStyle
+		case "azureAccount":
+			config.Azure.Account = *azureAccount
+		case "azureEndpoint":
+			config.Azure.Endpoint = *azureEndpoint
+		case "gcsEndpoint":
+			config.GCS.Endpoint = *gcsEndpoint
+		case "gcsCredentialsFile":
+			config.GCS.CredentialsFile = *gcsCredentialsFile
+		case "gcsAnonymous":
+			config.GCS.Anonymous = *gcsAnonymous
+		case "swiftAuthURL":
+			config.Swift.AuthURL = *swiftAuthURL
+		case "swiftUser":
+			config.Swift.User = *swiftUser
+		case "swiftDomain":
+			config.Swift.Domain = *swiftDomain
+		case "swiftTenant":
+			config.Swift.Tenant = *swiftTenant
+		case "swiftRegion":
+			config.Swift.Region = *swiftRegion
+		case "httpManifest":
+			config.HTTP.Manifest = *httpManifest
+		}
+	})
+	return config, err
+}
+
+func main() {
+	config, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if err != nil {
+		log.WithError(err).Fatal("Could not load config")
 	}
-	fmt.Println(TitleASCII)
+
+	if config.LogType == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+	err = config.Validate()
+	if err != nil {
+		log.WithError(err).Fatal("Invalid config")
+	}
+
+	fmt.Print(TitleASCII)
 	log.WithFields(log.Fields{
 		"indexPath":   config.IndexPath,
 		"storagePath": config.StoragePath,
 		"port":        config.Port,
+		"datasets":    len(config.Datasets),
 	}).Info("Starting Datatoapi")
 
 	datatoapiEngine := engine.NewEngine()
-	datatoapiEngine.Start(config)
+	err = datatoapiEngine.Start(config)
+	if err != nil {
+		log.WithError(err).Fatal("Datatoapi stopped with an error")
+	}
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zachgoldstein/datatoapi/engine"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("Could not create config directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config.yaml")
+	err = ioutil.WriteFile(configPath, []byte("port: 9000\nindexPath: /file/index\ninclude: [\"*.json\"]\ns3:\n  region: eu-west-1\n"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write config file: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		expected func(config *engine.Config)
+	}{
+		{name: "defaults", expected: func(config *engine.Config) {}},
+		{
+			name: "config file",
+			args: []string{"-config", configPath},
+			expected: func(config *engine.Config) {
+				config.Port = 9000
+				config.IndexPath = "/file/index"
+				config.Include = []string{"*.json"}
+				config.S3.Region = "eu-west-1"
+			},
+		},
+		{
+			name: "environment over config file",
+			args: []string{"-config", configPath},
+			env:  map[string]string{"DATAPI_PORT": "9100", "DATAPI_S3_REGION": "us-west-2"},
+			expected: func(config *engine.Config) {
+				config.Port = 9100
+				config.IndexPath = "/file/index"
+				config.Include = []string{"*.json"}
+				config.S3.Region = "us-west-2"
+			},
+		},
+		{
+			name: "flags over environment",
+			args: []string{"-config", configPath, "-port", "9200", "-include", "*.jsonfiles,*.ndjson"},
+			env:  map[string]string{"DATAPI_PORT": "9100", "DATAPI_S3_REGION": "us-west-2"},
+			expected: func(config *engine.Config) {
+				config.Port = 9200
+				config.IndexPath = "/file/index"
+				config.Include = []string{"*.jsonfiles", "*.ndjson"}
+				config.S3.Region = "us-west-2"
+			},
+		},
+		{
+			name: "flags left at their defaults don't override",
+			args: []string{"-config", configPath, "-logType", "json"},
+			env:  map[string]string{"DATAPI_S3_REGION": "us-west-2"},
+			expected: func(config *engine.Config) {
+				config.Port = 9000
+				config.IndexPath = "/file/index"
+				config.Include = []string{"*.json"}
+				config.S3.Region = "us-west-2"
+				config.LogType = "json"
+			},
+		},
+	}
+	for _, test := range tests {
+		config, err := loadConfig(test.args, func(key string) (string, bool) {
+			value, ok := test.env[key]
+			return value, ok
+		})
+		if err != nil {
+			t.Errorf("%s: returned error: %s", test.name, err)
+			continue
+		}
+		expected := engine.DefaultConfig()
+		test.expected(&expected)
+		if !reflect.DeepEqual(config, expected) {
+			t.Errorf("%s: config is %+v, expected %+v", test.name, config, expected)
+		}
+	}
+
+	_, err = loadConfig([]string{"-config", filepath.Join(dir, "missing.yaml")}, func(key string) (string, bool) { return "", false })
+	if err == nil {
+		t.Errorf("A missing config file expected an error")
+	}
+	_, err = loadConfig(nil, func(key string) (string, bool) { return "eighty", key == "DATAPI_PORT" })
+	if err == nil {
+		t.Errorf("An invalid environment variable expected an error")
+	}
+}
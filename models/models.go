@@ -6,15 +6,48 @@ type DataBlock struct {
 	Start  int64
 	End    int64
 	File   File
+	// Ranges holds the smallest and largest value of each sort key in the block, for sparse indexes
+	Ranges map[string]KeyRange `json:",omitempty"`
+	// Blooms holds a bloom filter of each bloom field's values in the block
+	Blooms map[string][]byte `json:",omitempty"`
+}
+
+// KeyRange is the smallest and largest value of a sort key within a data block
+type KeyRange struct {
+	Min interface{}
+	Max interface{}
 }
 
 type File struct {
 	Address string
 	Type    string
+	// Version identifies the revision of the file that was indexed, e.g. an http ETag
+	Version string
 }
 
 type IndexData struct {
 	UID    string
 	Data   map[string]interface{}
 	RefKey string
+	// Offset is where the record starts in its file, used to find it within its data block
+	Offset int64
+	// Present and Null list the field paths of the record holding a value and holding null,
+	// so records can be found by the fields they're missing
+	Present []string
+	Null    []string
+}
+
+// Schema describes the fields of a dataset's records
+type Schema map[string]FieldSchema
+
+type FieldSchema struct {
+	Searchable bool   `json:"searchable"`
+	Optional   bool   `json:"optional"`
+	Type       string `json:"type"`
+	// Analyzer is how string values are split into words in the search index. keyword indexes
+	// whole values, standard splits them into words, a language like en also stems the words,
+	// and custom builds an analyzer from Tokenizer and TokenFilters.
+	Analyzer     string   `json:"analyzer,omitempty"`
+	Tokenizer    string   `json:"tokenizer,omitempty"`
+	TokenFilters []string `json:"tokenFilters,omitempty"`
 }
@@ -1,52 +1,129 @@
 package storage
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
 	"strings"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/zachgoldstein/datatoapi/models"
 )
 
-const ReqTimeout = time.Duration(10000000000) // 10 seconds
+// S3URLPrefix and S3SchemePrefix are the storage path prefixes handled by AWSFS.
+// s3:// paths can point at any S3-compatible service (MinIO, Ceph RGW, DigitalOcean Spaces)
+// by setting an endpoint.
+const (
+	S3URLPrefix    = "https://s3.amazonaws.com/"
+	S3SchemePrefix = "s3://"
+)
+
+// DefaultAWSRegion is used when no region is configured
+const DefaultAWSRegion = "us-east-1"
+
+// Keys read from the credentials map passed to AWSFS.Start
+const (
+	CredentialEndpoint        = "endpoint"
+	CredentialRegion          = "region"
+	CredentialForcePathStyle  = "forcePathStyle"
+	CredentialAccessKeyID     = "accessKeyID"
+	CredentialSecretAccessKey = "secretAccessKey"
+	CredentialSessionToken    = "sessionToken"
+)
 
 type AWSFS struct {
 	FSLocation string
 	FilePaths  []string
+	Config     AWSConfig
+	Filter     PathFilter
+	Blocks     BlockConfig
 	awsClient  *s3.S3
+	sess       *session.Session
+}
+
+// AWSConfig holds the settings used to connect to S3 or an S3-compatible service
+type AWSConfig struct {
+	Endpoint        string
+	Region          string
+	ForcePathStyle  bool
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
 }
 
 func NewAWSFS() *AWSFS {
 	return &AWSFS{}
 }
 
-func (awsfs *AWSFS) getSession() *session.Session {
-	// Initial credentials loaded from SDK's default credential chain. Such as
-	// the environment, shared credentials (~/.aws/credentials), or EC2 Instance
-	// Role. These credentials will be used to to make the STS Assume Role API.
-	return session.Must(session.NewSession(&aws.Config{
-		Region: aws.String("us-east-1")}))
+// NewAWSConfig reads S3 connection settings out of a credentials map, falling back to defaults
+func NewAWSConfig(credentials map[string]interface{}) AWSConfig {
+	config := AWSConfig{
+		Endpoint:        credentialString(credentials, CredentialEndpoint),
+		Region:          credentialString(credentials, CredentialRegion),
+		ForcePathStyle:  credentialBool(credentials, CredentialForcePathStyle),
+		AccessKeyID:     credentialString(credentials, CredentialAccessKeyID),
+		SecretAccessKey: credentialString(credentials, CredentialSecretAccessKey),
+		SessionToken:    credentialString(credentials, CredentialSessionToken),
+	}
+	if config.Region == "" {
+		config.Region = DefaultAWSRegion
+	}
+	return config
+}
+
+func (awsfs *AWSFS) getSession() (*session.Session, error) {
+	awsConfig := &aws.Config{
+		Region:           aws.String(awsfs.Config.Region),
+		S3ForcePathStyle: aws.Bool(awsfs.Config.ForcePathStyle),
+	}
+	if awsfs.Config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(awsfs.Config.Endpoint)
+	}
+	// Without static credentials, credentials are loaded from SDK's default credential chain.
+	// Such as the environment, shared credentials (~/.aws/credentials), or EC2 Instance Role.
+	if awsfs.Config.AccessKeyID != "" {
+		awsConfig.Credentials = awscredentials.NewStaticCredentials(
+			awsfs.Config.AccessKeyID,
+			awsfs.Config.SecretAccessKey,
+			awsfs.Config.SessionToken,
+		)
+	}
+	return session.NewSession(awsConfig)
 }
 
-func (awsfs *AWSFS) Start(path string, credentials map[string]interface{}) error {
-	sess := awsfs.getSession()
+func (awsfs *AWSFS) Start(ctx context.Context, path string, credentials map[string]interface{}) error {
+	awsfs.Config = NewAWSConfig(credentials)
+	awsfs.Filter = NewPathFilter(credentials)
+	awsfs.Blocks = NewBlockConfig(credentials)
+	sess, err := awsfs.getSession()
+	if err != nil {
+		log.WithError(err).Error("Could not create aws session")
+		return err
+	}
+	log.WithFields(log.Fields{
+		"endpoint":       awsfs.Config.Endpoint,
+		"region":         awsfs.Config.Region,
+		"forcePathStyle": awsfs.Config.ForcePathStyle,
+	}).Info("Connecting to S3")
+	awsfs.sess = sess
 	awsfs.awsClient = s3.New(sess)
 	awsfs.FSLocation = path
-	return awsfs.TestData()
+	return awsfs.TestData(ctx)
+}
+
+// IsS3Path returns true for storage paths that should be served by AWSFS
+func IsS3Path(storagePath string) bool {
+	return strings.HasPrefix(storagePath, S3SchemePrefix) || strings.HasPrefix(storagePath, S3URLPrefix)
 }
 
 func getPathDetails(awsURL string) (bucket, key string) {
-	awsURL = strings.Replace(awsURL, "https://s3.amazonaws.com/", "", -1)
+	awsURL = strings.TrimPrefix(awsURL, S3URLPrefix)
+	awsURL = strings.TrimPrefix(awsURL, S3SchemePrefix)
 	urlParts := strings.SplitN(awsURL, "/", 2)
 	if len(urlParts) == 1 {
 		return urlParts[0], ""
@@ -54,130 +131,123 @@ func getPathDetails(awsURL string) (bucket, key string) {
 	return urlParts[0], urlParts[1]
 }
 
-func (awsfs *AWSFS) TestData() error {
-	bucket, _ := getPathDetails(awsfs.FSLocation)
+func (awsfs *AWSFS) TestData(ctx context.Context) error {
 	log.Info("Testing data access")
-	objs, err := ListObjects(bucket, awsfs.awsClient)
+	numObjects := 0
+	err := awsfs.walkDataObjects(ctx, func(obj *s3.Object) error {
+		numObjects++
+		return nil
+	})
 	if err != nil {
 		log.WithError(err).Error("Could not access data")
 		return err
 	}
+	if numObjects == 0 {
+		err = fmt.Errorf("No objects found at %s", awsfs.FSLocation)
+		log.WithError(err).Error("Could not access data")
+		return err
+	}
 
 	log.WithFields(log.Fields{
-		"numObjects": len(objs),
+		"numObjects": numObjects,
 	}).Info("Data is accessible")
 	return nil
 }
 
-func ListObjects(bucket string, client *s3.S3) ([]*s3.Object, error) {
-	ctx := context.Background()
-	var cancelFn func()
-	ctx, cancelFn = context.WithTimeout(ctx, ReqTimeout)
-	defer cancelFn()
-	result, err := client.ListObjectsWithContext(ctx, &s3.ListObjectsInput{
+// WalkObjects lists the objects in a bucket with keys starting with prefix, one page of
+// up to 1000 keys at a time, calling walkFn for each object. Listing stops at the first error.
+// Cancelling the context aborts the request.
+func WalkObjects(ctx context.Context, bucket, prefix string, client *s3.S3, walkFn func(obj *s3.Object) error) error {
+	var walkErr error
+	err := client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			walkErr = walkFn(obj)
+			if walkErr != nil {
+				return false
+			}
+		}
+		return true
 	})
 	if err != nil {
 		log.WithError(err).Error("Could not list objects")
-		return nil, err
-	}
-	return result.Contents, nil
-}
-
-// DownloadObjectsIntoDataChansIterator implements the BatchDownloadIterator interface and allows for batched
-// download of objects, sending downloaded data to an interface chan
-type DownloadObjectsIntoDataChansIterator struct {
-	dataChan  chan<- models.IndexData
-	blockChan chan<- models.DataBlock
-	Objects   []s3manager.BatchDownloadObject
-	index     int
-	inc       bool
-}
-
-// Next will increment the default iterator's index and and ensure that there
-// is another object to iterator to. It will also attempt to scan the last loaded object into the chans
-func (batcher *DownloadObjectsIntoDataChansIterator) Next() bool {
-	lastObject := batcher.Objects[batcher.index]
-	writer := lastObject.Writer.(*aws.WriteAtBuffer)
-	writtenBytes := writer.Bytes()
-	if len(writtenBytes) > 0 {
-		scanner := bufio.NewScanner(bytes.NewReader(writtenBytes))
-		err := WriteJSONToDataChans(*lastObject.Object.Key, scanner, batcher.dataChan, batcher.blockChan)
-		if err != nil {
-			log.WithError(err).Error("Could not write to data chans")
-			batcher.inc = false
-			return false
-		}
+		return err
 	}
+	return walkErr
+}
 
-	if batcher.inc {
-		batcher.index++
-	} else {
-		batcher.inc = true
+// ListObjects lists all objects in a bucket with keys starting with prefix
+func ListObjects(ctx context.Context, bucket, prefix string, client *s3.S3) ([]*s3.Object, error) {
+	objs := []*s3.Object{}
+	err := WalkObjects(ctx, bucket, prefix, client, func(obj *s3.Object) error {
+		objs = append(objs, obj)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return batcher.index < len(batcher.Objects)
+	return objs, nil
 }
 
-// DownloadObject will return the BatchDownloadObject at the current batched index.
-func (batcher *DownloadObjectsIntoDataChansIterator) DownloadObject() s3manager.BatchDownloadObject {
-	object := batcher.Objects[batcher.index]
-	return object
+// walkDataObjects walks the objects the storage path refers to, see InStoragePath
+func (awsfs *AWSFS) walkDataObjects(ctx context.Context, walkFn func(obj *s3.Object) error) error {
+	bucket, key := getPathDetails(awsfs.FSLocation)
+	return WalkObjects(ctx, bucket, key, awsfs.awsClient, func(obj *s3.Object) error {
+		if !InStoragePath(*obj.Key, key, awsfs.Filter) {
+			return nil
+		}
+		return walkFn(obj)
+	})
 }
 
-// Err will return an error. Since this is just used to satisfy the BatchDeleteIterator interface
-// this will only return nil.
-func (batcher *DownloadObjectsIntoDataChansIterator) Err() error {
-	return nil
-}
+// ScanDataBlocks streams each object under the storage path, sending records and data blocks on channels.
+// Objects are read through the response body as they are listed, so memory use doesn't grow with
+// object or bucket size. Channels are always closed when scanning stops.
+func (awsfs *AWSFS) ScanDataBlocks(ctx context.Context, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+	defer close(blockChan)
+	defer close(dataChan)
 
-func (awsfs *AWSFS) ScanDataBlocks(dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
 	log.Info("Scanning aws data into channels")
 	bucket, _ := getPathDetails(awsfs.FSLocation)
-	objs, err := ListObjects(bucket, awsfs.awsClient)
+	err := awsfs.walkDataObjects(ctx, func(obj *s3.Object) error {
+		return ScanObject(ctx, bucket, *obj.Key, awsfs.awsClient, awsfs.Blocks, dataChan, blockChan)
+	})
 	if err != nil {
-		log.WithError(err).Error("Could not list objects for scanning")
+		log.WithError(err).Error("Could not scan objects")
 		return err
 	}
-	downloadObjs := []s3manager.BatchDownloadObject{}
-	for _, obj := range objs {
-		newIOWriter := aws.NewWriteAtBuffer([]byte{})
-		downloadObjs = append(downloadObjs, s3manager.BatchDownloadObject{
-			Object: &s3.GetObjectInput{
-				Bucket: aws.String(bucket),
-				Key:    obj.Key,
-			},
-			Writer: newIOWriter,
-		})
-	}
+	log.Info("Finished scanning aws data into channels")
+	return nil
+}
 
-	sess := awsfs.getSession()
-	svc := s3manager.NewDownloader(sess)
-	iter := &DownloadObjectsIntoDataChansIterator{
-		Objects:   downloadObjs,
-		dataChan:  dataChan,
-		blockChan: blockChan,
-	}
-	if err := svc.DownloadWithIterator(aws.BackgroundContext(), iter); err != nil {
-		log.WithError(err).Error("Could not download data")
+// ScanObject streams a single object's body into the data chans, sizing data blocks by blocks
+func ScanObject(ctx context.Context, bucket, key string, client *s3.S3, blocks BlockConfig, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+	result, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"objectKey": key,
+		}).Error("Could not download object")
 		return err
 	}
-	close(iter.blockChan)
-	close(iter.dataChan)
-	log.Info("Finished scanning aws data into channels")
-	return nil
+	defer result.Body.Close()
+
+	scanner := NewRecordScanner(result.Body)
+	return WriteJSONToDataChans(ctx, key, scanner, blocks, dataChan, blockChan)
 }
 
-func (awsfs *AWSFS) RetrieveDataBlockBytes(block *models.DataBlock) ([]byte, error) {
+// RetrieveDataBlockBytes fetches the byte range for a data block from S3
+func (awsfs *AWSFS) RetrieveDataBlockBytes(ctx context.Context, block *models.DataBlock) ([]byte, error) {
 	bucket, _ := getPathDetails(awsfs.FSLocation)
-	return GetObjectBytes(bucket, block.File.Address, awsfs.awsClient, block.Start, block.End)
+	return GetObjectBytes(ctx, bucket, block.File.Address, awsfs.awsClient, block.Start, block.End)
 }
 
-func GetObjectBytes(bucket string, key string, client *s3.S3, start, end int64) ([]byte, error) {
-	ctx := context.Background()
-	var cancelFn func()
-	ctx, cancelFn = context.WithTimeout(ctx, ReqTimeout)
-	// Ensure the context is canceled to prevent leaking.
-	defer cancelFn()
+// GetObjectBytes retrieves a range of bytes from an object. Cancelling the context aborts the request.
+func GetObjectBytes(ctx context.Context, bucket string, key string, client *s3.S3, start, end int64) ([]byte, error) {
 	result, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
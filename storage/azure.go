@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zachgoldstein/datatoapi/models"
+)
+
+// AzureSchemePrefix and AzureHostSuffix identify storage paths handled by AzureFS.
+// azblob://container/prefix paths use the configured account or endpoint, while
+// https://account.blob.core.windows.net/container/prefix paths carry the account in the host.
+const (
+	AzureSchemePrefix = "azblob://"
+	AzureHostSuffix   = ".blob.core.windows.net"
+)
+
+// AzureMaxRetryRequests is how many times a blob download will be resumed after a dropped connection
+const AzureMaxRetryRequests = 3
+
+// Keys read from the credentials map passed to AzureFS.Start
+const (
+	CredentialAzureAccount    = "azureAccount"
+	CredentialAzureAccountKey = "azureAccountKey"
+	CredentialAzureEndpoint   = "azureEndpoint"
+)
+
+type AzureFS struct {
+	FSLocation   string
+	Config       AzureConfig
+	Filter       PathFilter
+	Blocks       BlockConfig
+	containerURL azblob.ContainerURL
+	prefix       string
+}
+
+// AzureConfig holds the settings used to connect to Azure Blob Storage or the Azurite emulator
+type AzureConfig struct {
+	Account    string
+	AccountKey string
+	// Endpoint overrides the blob service url, e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite
+	Endpoint string
+}
+
+// NewAzureFS creates an instance of AzureFS
+func NewAzureFS() *AzureFS {
+	return &AzureFS{}
+}
+
+// NewAzureConfig reads Azure connection settings out of a credentials map, falling back
+// to the AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY environment variables
+func NewAzureConfig(credentials map[string]interface{}) AzureConfig {
+	config := AzureConfig{
+		Account:    credentialString(credentials, CredentialAzureAccount),
+		AccountKey: credentialString(credentials, CredentialAzureAccountKey),
+		Endpoint:   credentialString(credentials, CredentialAzureEndpoint),
+	}
+	if config.Account == "" {
+		config.Account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+	if config.AccountKey == "" {
+		config.AccountKey = os.Getenv("AZURE_STORAGE_KEY")
+	}
+	return config
+}
+
+// IsAzurePath returns true for storage paths that should be served by AzureFS
+func IsAzurePath(storagePath string) bool {
+	if strings.HasPrefix(storagePath, AzureSchemePrefix) {
+		return true
+	}
+	parsedURL, err := url.Parse(storagePath)
+	return err == nil && strings.HasSuffix(parsedURL.Host, AzureHostSuffix)
+}
+
+// getAzurePathDetails splits a storage path into the blob service endpoint, container and blob prefix
+func getAzurePathDetails(storagePath string, config AzureConfig) (endpoint, container, prefix string, err error) {
+	var path string
+	if strings.HasPrefix(storagePath, AzureSchemePrefix) {
+		path = strings.TrimPrefix(storagePath, AzureSchemePrefix)
+		endpoint = config.Endpoint
+		if endpoint == "" {
+			if config.Account == "" {
+				return "", "", "", fmt.Errorf("An azure account or endpoint is needed for %s", storagePath)
+			}
+			endpoint = fmt.Sprintf("https://%s%s", config.Account, AzureHostSuffix)
+		}
+	} else {
+		parsedURL, err := url.Parse(storagePath)
+		if err != nil {
+			return "", "", "", err
+		}
+		path = strings.TrimPrefix(parsedURL.Path, "/")
+		endpoint = fmt.Sprintf("%s://%s", parsedURL.Scheme, parsedURL.Host)
+	}
+
+	pathParts := strings.SplitN(path, "/", 2)
+	if pathParts[0] == "" {
+		return "", "", "", fmt.Errorf("No container found in %s", storagePath)
+	}
+	if len(pathParts) == 1 {
+		return strings.TrimSuffix(endpoint, "/"), pathParts[0], "", nil
+	}
+	return strings.TrimSuffix(endpoint, "/"), pathParts[0], pathParts[1], nil
+}
+
+func (azfs *AzureFS) getCredential(endpoint string) (azblob.Credential, error) {
+	if azfs.Config.AccountKey == "" {
+		log.Info("No azure account key set, using anonymous access")
+		return azblob.NewAnonymousCredential(), nil
+	}
+	account := azfs.Config.Account
+	if account == "" {
+		// https://account.blob.core.windows.net
+		parsedURL, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		account = strings.TrimSuffix(parsedURL.Hostname(), AzureHostSuffix)
+	}
+	return azblob.NewSharedKeyCredential(account, azfs.Config.AccountKey)
+}
+
+// Start connects to the container, testing to make sure the data is accessible
+func (azfs *AzureFS) Start(ctx context.Context, path string, credentials map[string]interface{}) error {
+	azfs.FSLocation = path
+	azfs.Config = NewAzureConfig(credentials)
+	azfs.Filter = NewPathFilter(credentials)
+	azfs.Blocks = NewBlockConfig(credentials)
+
+	endpoint, container, prefix, err := getAzurePathDetails(path, azfs.Config)
+	if err != nil {
+		log.WithError(err).Error("Could not parse azure storage path")
+		return err
+	}
+	credential, err := azfs.getCredential(endpoint)
+	if err != nil {
+		log.WithError(err).Error("Could not create azure credentials")
+		return err
+	}
+	containerURL, err := url.Parse(fmt.Sprintf("%s/%s", endpoint, container))
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"endpoint":  endpoint,
+		"container": container,
+		"prefix":    prefix,
+	}).Info("Connecting to azure blob storage")
+
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	azfs.containerURL = azblob.NewContainerURL(*containerURL, pipeline)
+	azfs.prefix = prefix
+	return azfs.TestData(ctx)
+}
+
+// TestData makes sure we can list blobs under the storage path
+func (azfs *AzureFS) TestData(ctx context.Context) error {
+	log.Info("Testing data access")
+	numBlobs := 0
+	err := azfs.walkDataBlobs(ctx, func(name string) error {
+		numBlobs++
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("Could not access data")
+		return err
+	}
+	if numBlobs == 0 {
+		err = fmt.Errorf("No blobs found at %s", azfs.FSLocation)
+		log.WithError(err).Error("Could not access data")
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"numBlobs": numBlobs,
+	}).Info("Data is accessible")
+	return nil
+}
+
+// walkDataBlobs lists blobs under the storage path one segment at a time, calling walkFn
+// with the name of each blob that belongs to the dataset, see InStoragePath
+func (azfs *AzureFS) walkDataBlobs(ctx context.Context, walkFn func(name string) error) error {
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listing, err := azfs.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix: azfs.prefix,
+		})
+		if err != nil {
+			log.WithError(err).Error("Could not list blobs")
+			return err
+		}
+		marker = listing.NextMarker
+
+		for _, blob := range listing.Segment.BlobItems {
+			if !InStoragePath(blob.Name, azfs.prefix, azfs.Filter) {
+				continue
+			}
+			err = walkFn(blob.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ScanDataBlocks streams each blob under the storage path, sending records and data blocks on channels.
+// Channels are always closed when scanning stops.
+func (azfs *AzureFS) ScanDataBlocks(ctx context.Context, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+	defer close(blockChan)
+	defer close(dataChan)
+
+	log.Info("Scanning azure data into channels")
+	err := azfs.walkDataBlobs(ctx, func(name string) error {
+		return azfs.scanBlob(ctx, name, dataChan, blockChan)
+	})
+	if err != nil {
+		log.WithError(err).Error("Could not scan blobs")
+		return err
+	}
+	log.Info("Finished scanning azure data into channels")
+	return nil
+}
+
+// scanBlob streams a single blob's body into the data chans
+func (azfs *AzureFS) scanBlob(ctx context.Context, name string, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+	blobURL := azfs.containerURL.NewBlobURL(name)
+	resp, err := blobURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"blob": name,
+		}).Error("Could not download blob")
+		return err
+	}
+	body := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: AzureMaxRetryRequests})
+	defer body.Close()
+
+	scanner := NewRecordScanner(body)
+	return WriteJSONToDataChans(ctx, name, scanner, azfs.Blocks, dataChan, blockChan)
+}
+
+// RetrieveDataBlockBytes fetches the byte range for a data block with a ranged blob read
+func (azfs *AzureFS) RetrieveDataBlockBytes(ctx context.Context, block *models.DataBlock) ([]byte, error) {
+	blobURL := azfs.containerURL.NewBlobURL(block.File.Address)
+	resp, err := blobURL.Download(ctx, block.Start, block.End-block.Start, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		log.WithError(err).Error("Could not access data")
+		return nil, err
+	}
+	body := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: AzureMaxRetryRequests})
+	defer body.Close()
+
+	bytes, err := ioutil.ReadAll(body)
+	if err != nil {
+		log.WithError(err).Error("Could read body data")
+		return nil, err
+	}
+	return bytes, nil
+}
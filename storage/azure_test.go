@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/zachgoldstein/datatoapi/models"
+)
+
+func TestIsAzurePath(t *testing.T) {
+	tests := []struct {
+		storagePath string
+		expected    bool
+	}{
+		{storagePath: "azblob://data/people", expected: true},
+		{storagePath: "https://account.blob.core.windows.net/data/people", expected: true},
+		{storagePath: "https://s3.amazonaws.com/data/people", expected: false},
+		{storagePath: "gs://data/people", expected: false},
+		{storagePath: "./data/people", expected: false},
+	}
+	for _, test := range tests {
+		if IsAzurePath(test.storagePath) != test.expected {
+			t.Errorf("IsAzurePath(%q) = %t, expected %t", test.storagePath, !test.expected, test.expected)
+		}
+	}
+}
+
+func TestGetAzurePathDetails(t *testing.T) {
+	tests := []struct {
+		storagePath                 string
+		config                      AzureConfig
+		endpoint, container, prefix string
+		err                         bool
+	}{
+		{
+			storagePath: "azblob://data/people/2020",
+			config:      AzureConfig{Account: "account"},
+			endpoint:    "https://account.blob.core.windows.net", container: "data", prefix: "people/2020",
+		},
+		{
+			storagePath: "azblob://data",
+			config:      AzureConfig{Account: "account"},
+			endpoint:    "https://account.blob.core.windows.net", container: "data",
+		},
+		{
+			storagePath: "azblob://data/people/",
+			config:      AzureConfig{Account: "account", Endpoint: "http://127.0.0.1:10000/devstoreaccount1/"},
+			endpoint:    "http://127.0.0.1:10000/devstoreaccount1", container: "data", prefix: "people/",
+		},
+		{storagePath: "azblob://data/people", err: true},
+		{storagePath: "azblob:///people", config: AzureConfig{Account: "account"}, err: true},
+		{
+			storagePath: "https://account.blob.core.windows.net/data/people.jsonfiles",
+			endpoint:    "https://account.blob.core.windows.net", container: "data", prefix: "people.jsonfiles",
+		},
+		{
+			storagePath: "https://account.blob.core.windows.net/data",
+			config:      AzureConfig{Endpoint: "http://127.0.0.1:10000/devstoreaccount1"},
+			endpoint:    "https://account.blob.core.windows.net", container: "data",
+		},
+		{storagePath: "https://account.blob.core.windows.net/", err: true},
+	}
+	for _, test := range tests {
+		endpoint, container, prefix, err := getAzurePathDetails(test.storagePath, test.config)
+		if test.err {
+			if err == nil {
+				t.Errorf("getAzurePathDetails(%q, %+v) expected an error", test.storagePath, test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("getAzurePathDetails(%q, %+v) returned error: %s", test.storagePath, test.config, err)
+			continue
+		}
+		if endpoint != test.endpoint || container != test.container || prefix != test.prefix {
+			t.Errorf("getAzurePathDetails(%q, %+v) = %q, %q, %q, expected %q, %q, %q", test.storagePath, test.config,
+				endpoint, container, prefix, test.endpoint, test.container, test.prefix)
+		}
+	}
+}
+
+// newTestBlobService serves a single container's blobs through the parts of the blob service
+// api AzureFS uses, listing a page of two blobs at a time
+func newTestBlobService(t *testing.T, container string, blobs map[string]string) *httptest.Server {
+	names := []string{}
+	for name := range blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if path[0] != container {
+			w.Header().Set("x-ms-error-code", "ContainerNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query := r.URL.Query()
+		if len(path) == 1 && query.Get("comp") == "list" {
+			listed := []string{}
+			for _, name := range names {
+				if strings.HasPrefix(name, query.Get("prefix")) && name > query.Get("marker") {
+					listed = append(listed, name)
+				}
+			}
+			nextMarker := ""
+			if len(listed) > 2 {
+				listed = listed[:2]
+				nextMarker = listed[1]
+			}
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="%s"><Blobs>`, container)
+			for _, name := range listed {
+				fmt.Fprintf(w, `<Blob><Name>%s</Name><Properties><Last-Modified>Mon, 04 May 2020 10:00:00 GMT</Last-Modified>`+
+					`<Content-Length>%d</Content-Length></Properties></Blob>`, name, len(blobs[name]))
+			}
+			fmt.Fprintf(w, `</Blobs><NextMarker>%s</NextMarker></EnumerationResults>`, nextMarker)
+			return
+		}
+
+		blob, ok := blobs[path[len(path)-1]]
+		if len(path) == 1 || !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		blobRange := r.Header.Get("x-ms-range")
+		if blobRange == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			w.Write([]byte(blob))
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(blobRange, "bytes=%d-%d", &start, &end); err != nil {
+			t.Errorf("Could not read blob range %q: %s", blobRange, err)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(blob[start : end+1]))
+	}))
+}
+
+func TestAzureFS(t *testing.T) {
+	blobs := map[string]string{
+		"people/a.jsonfiles":     "{\"id\": 1}\n{\"id\": 2}\n",
+		"people/b.jsonfiles":     "{\"id\": 3}\n",
+		"people/c.tmp":           "{\"id\": 4}\n",
+		"people/2020/d.jsonfile": "{\"id\": 5}\n",
+		"peoplex/e.jsonfiles":    "{\"id\": 6}\n",
+		"places/f.jsonfiles":     "{\"id\": 7}\n",
+	}
+	server := newTestBlobService(t, "data", blobs)
+	defer server.Close()
+	credentials := map[string]interface{}{
+		CredentialAzureEndpoint: server.URL,
+		CredentialExclude:       "*.tmp",
+	}
+
+	azfs := NewAzureFS()
+	err := azfs.Start(context.Background(), "azblob://data/people", credentials)
+	if err != nil {
+		t.Fatalf("Could not start azure storage: %s", err)
+	}
+	names := []string{}
+	err = azfs.walkDataBlobs(context.Background(), func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not list blobs: %s", err)
+	}
+	expected := []string{"people/2020/d.jsonfile", "people/a.jsonfiles", "people/b.jsonfiles"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("Listed %q, expected %q", names, expected)
+	}
+
+	dataChan := make(chan models.IndexData, 10)
+	blockChan := make(chan models.DataBlock, 10)
+	err = azfs.ScanDataBlocks(context.Background(), dataChan, blockChan)
+	if err != nil {
+		t.Fatalf("Could not scan blobs: %s", err)
+	}
+	records := 0
+	for range dataChan {
+		records++
+	}
+	if records != 4 {
+		t.Errorf("Scanned %d records, expected 4", records)
+	}
+	for block := range blockChan {
+		data, err := azfs.RetrieveDataBlockBytes(context.Background(), &block)
+		if err != nil {
+			t.Errorf("Could not retrieve block %+v: %s", block, err)
+			continue
+		}
+		expected := blobs[block.File.Address][block.Start:block.End]
+		if string(data) != expected {
+			t.Errorf("Retrieved %q for block %+v, expected %q", data, block, expected)
+		}
+	}
+
+	err = NewAzureFS().Start(context.Background(), "azblob://missing/people", credentials)
+	if err == nil {
+		t.Errorf("Starting with a missing container expected an error")
+	}
+	err = NewAzureFS().Start(context.Background(), "azblob://data/nobody", credentials)
+	if err == nil {
+		t.Errorf("Starting with no blobs under the path expected an error")
+	}
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+	"time"
+)
+
+// DefaultBloomFalsePositiveRate is the share of lookups for a missing value that still fetch a
+// block, used when a dataset doesn't set one
+const DefaultBloomFalsePositiveRate = 0.01
+
+// BloomFilter is a compact set of values that never misses a value that was added, but may
+// report values that weren't. It's stored as a single byte holding the number of hashes
+// followed by the filter's bits.
+type BloomFilter []byte
+
+// NewBloomFilter creates a bloom filter sized for numValues values at a false positive rate
+func NewBloomFilter(numValues int, falsePositiveRate float64) BloomFilter {
+	if numValues < 1 {
+		numValues = 1
+	}
+	numBits := math.Ceil(-float64(numValues) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	numHashes := math.Round(numBits / float64(numValues) * math.Ln2)
+	numHashes = math.Max(1, math.Min(numHashes, 255))
+
+	filter := make(BloomFilter, 1+int(math.Ceil(numBits/8)))
+	filter[0] = byte(numHashes)
+	return filter
+}
+
+// Add adds a value to the filter
+func (filter BloomFilter) Add(value string) {
+	numBits, h1, h2 := filter.hashes(value)
+	for i := uint64(0); i < uint64(filter[0]); i++ {
+		bit := (h1 + i*h2) % numBits
+		filter[1+bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Test returns false if the value was definitely never added, and true if it may have been
+func (filter BloomFilter) Test(value string) bool {
+	if len(filter) < 2 {
+		return false
+	}
+	numBits, h1, h2 := filter.hashes(value)
+	for i := uint64(0); i < uint64(filter[0]); i++ {
+		bit := (h1 + i*h2) % numBits
+		if filter[1+bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hashes derives the filter's two base hashes from a 64 bit fnv hash. Fnv barely changes for
+// values differing in their last byte, like sequential ids, so it's mixed before use.
+func (filter BloomFilter) hashes(value string) (numBits, h1, h2 uint64) {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	sum := hash.Sum64()
+	return uint64(len(filter)-1) * 8, mix64(sum), mix64(sum^0x9e3779b97f4a7c15) | 1
+}
+
+// mix64 is the murmur3 finaliser, spreading every input bit across the whole output
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// BloomKeyVersion changes whenever BloomKey formats values differently, as filters built
+// with other keys can't be tested with the new ones
+const BloomKeyVersion = 3
+
+// BloomKey converts a json value to the string added to bloom filters. Values equal to the
+// DefaultComparator share a key: numbers are formatted in their shortest form and dates as
+// UTC RFC 3339 datetimes. Bloom lookups can't match numbers within a precision, so they
+// find exact values only. Objects, arrays and nulls have no key.
+func BloomKey(value interface{}) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		if date, ok := ParseDate(value); ok {
+			return date.UTC().Format(time.RFC3339Nano), true
+		}
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// BloomLookupKeys returns the keys a value from a request may have been added to bloom filters
+// as. Dates are looked up in UTC, and numbers like 1.50 also in their shortest form, 1.5.
+func BloomLookupKeys(value string) []string {
+	key, _ := BloomKey(value)
+	keys := []string{key}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		if numberKey, _ := BloomKey(number); numberKey != key {
+			keys = append(keys, numberKey)
+		}
+	}
+	return keys
+}
+
+// buildBlooms creates a bloom filter for each field from the values seen in a block
+func buildBlooms(values map[string][]string, falsePositiveRate float64) map[string][]byte {
+	blooms := map[string][]byte{}
+	for field, fieldValues := range values {
+		filter := NewBloomFilter(len(fieldValues), falsePositiveRate)
+		for _, value := range fieldValues {
+			filter.Add(value)
+		}
+		blooms[field] = filter
+	}
+	return blooms
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	tests := []struct {
+		numValues         int
+		falsePositiveRate float64
+	}{
+		{numValues: 1, falsePositiveRate: 0.01},
+		{numValues: 1000, falsePositiveRate: 0.01},
+		{numValues: 1000, falsePositiveRate: 0.1},
+		{numValues: 10000, falsePositiveRate: 0.001},
+	}
+	for _, test := range tests {
+		filter := NewBloomFilter(test.numValues, test.falsePositiveRate)
+		for i := 0; i < test.numValues; i++ {
+			filter.Add(fmt.Sprintf("%d", 1000000+i))
+		}
+		for i := 0; i < test.numValues; i++ {
+			if !filter.Test(fmt.Sprintf("%d", 1000000+i)) {
+				t.Errorf("Filter for %d values is missing value %d", test.numValues, 1000000+i)
+				break
+			}
+		}
+
+		const lookups = 100000
+		falsePositives := 0
+		for i := 0; i < lookups; i++ {
+			if filter.Test(fmt.Sprintf("missing-%d", i)) {
+				falsePositives++
+			}
+		}
+		rate := float64(falsePositives) / lookups
+		if rate > test.falsePositiveRate*2 {
+			t.Errorf("Filter for %d values has a false positive rate of %g, expected about %g", test.numValues, rate, test.falsePositiveRate)
+		}
+	}
+
+	if (BloomFilter{}).Test("a") || (BloomFilter{1}).Test("a") {
+		t.Errorf("Empty filters should contain nothing")
+	}
+	if NewBloomFilter(0, 0.01).Test("a") {
+		t.Errorf("A filter nothing was added to should contain nothing")
+	}
+}
+
+func TestBloomKey(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected string
+		ok       bool
+	}{
+		{value: "Rick", expected: "Rick", ok: true},
+		{value: "1.50", expected: "1.50", ok: true},
+		{value: 1.5, expected: "1.5", ok: true},
+		{value: 1000000.0, expected: "1000000", ok: true},
+		{value: 1e21, expected: "1000000000000000000000", ok: true},
+		{value: true, expected: "true", ok: true},
+		{value: "2020-01-02T10:00:00+02:00", expected: "2020-01-02T08:00:00Z", ok: true},
+		{value: "2020-01-02", expected: "2020-01-02T00:00:00Z", ok: true},
+		{value: "2020-01-02T08:00:00.5Z", expected: "2020-01-02T08:00:00.5Z", ok: true},
+		{value: nil},
+		{value: []interface{}{"a"}},
+		{value: map[string]interface{}{"a": "b"}},
+	}
+	for _, test := range tests {
+		key, ok := BloomKey(test.value)
+		if key != test.expected || ok != test.ok {
+			t.Errorf("BloomKey(%#v) = %q, %t, expected %q, %t", test.value, key, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestBloomLookupKeys(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []string
+	}{
+		{value: "Rick", expected: []string{"Rick"}},
+		{value: "1.5", expected: []string{"1.5"}},
+		{value: "1.50", expected: []string{"1.50", "1.5"}},
+		{value: "1e6", expected: []string{"1e6", "1000000"}},
+		{value: "true", expected: []string{"true"}},
+		{value: "2020-01-02T10:00:00+02:00", expected: []string{"2020-01-02T08:00:00Z"}},
+	}
+	for _, test := range tests {
+		keys := BloomLookupKeys(test.value)
+		if !reflect.DeepEqual(keys, test.expected) {
+			t.Errorf("BloomLookupKeys(%q) = %q, expected %q", test.value, keys, test.expected)
+		}
+	}
+}
+
+func TestBuildBlooms(t *testing.T) {
+	config := BlockConfig{BloomFields: []string{"id", "email"}, BloomRate: 0.01}
+	records := []map[string]interface{}{
+		{"id": 1.0, "email": "rick@example.com", "name": "Rick"},
+		{"id": 2.0, "email": "morty@example.com", "name": "Morty"},
+		{"id": 3.0, "name": "Summer"},
+		{"id": 4.0, "email": nil, "name": "Beth"},
+	}
+	values := map[string][]string{}
+	for _, record := range records {
+		config.addToBlooms(values, record)
+		if _, ok := record["id"]; ok {
+			t.Errorf("Bloom field id was left in record %v", record)
+		}
+		if _, ok := record["email"]; ok {
+			t.Errorf("Bloom field email was left in record %v", record)
+		}
+	}
+	blooms := buildBlooms(values, config.BloomRate)
+
+	tests := []struct {
+		field    string
+		value    string
+		expected bool
+	}{
+		{field: "id", value: "1", expected: true},
+		{field: "id", value: "4", expected: true},
+		{field: "id", value: "5", expected: false},
+		{field: "email", value: "morty@example.com", expected: true},
+		{field: "email", value: "null", expected: false},
+		{field: "name", value: "Rick", expected: false},
+	}
+	for _, test := range tests {
+		found := BloomFilter(blooms[test.field]).Test(test.value)
+		if found != test.expected {
+			t.Errorf("Bloom filter for %s tested %q as %t, expected %t", test.field, test.value, found, test.expected)
+		}
+	}
+}
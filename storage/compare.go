@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateLayouts are the formats strings are parsed with to be compared as dates
+var DateLayouts = []string{time.RFC3339Nano, "2006-01-02"}
+
+// ValueComparator compares json values by type, used both to look up values in the search index
+// and to find their records in data blocks, so every record the index finds is found in its block.
+// Numbers are compared numerically and equal when they're within Precision of each other, which
+// lets values written as float32 be found with their shortest form, e.g. 0.873794 for
+// 0.8737940192222595. Strings that are both dates are compared as times, other strings lexically.
+// Bools order false before true and null only equals null.
+type ValueComparator struct {
+	Precision float64
+}
+
+// DefaultComparator compares numbers exactly
+var DefaultComparator = ValueComparator{}
+
+// ParseDate parses an RFC 3339 date or datetime
+func ParseDate(value string) (time.Time, bool) {
+	for _, layout := range DateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Compare compares two json values, returning -1, 0 or 1, or an error if they're of different types
+func (c ValueComparator) Compare(a, b interface{}) (int, error) {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			if math.Abs(a-b) <= c.Precision {
+				return 0, nil
+			} else if a < b {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			aDate, aOk := ParseDate(a)
+			bDate, bOk := ParseDate(b)
+			if aOk && bOk {
+				if aDate.Before(bDate) {
+					return -1, nil
+				} else if aDate.After(bDate) {
+					return 1, nil
+				}
+				return 0, nil
+			}
+			return strings.Compare(a, b), nil
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			if a == b {
+				return 0, nil
+			} else if !a {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	case nil:
+		if b == nil {
+			return 0, nil
+		}
+	}
+	return 0, fmt.Errorf("Can't compare %v (%T) with %v (%T)", a, a, b, b)
+}
+
+// ParseAs converts a value from a request into the type of a json value, so they can be compared.
+// A request for null is only parsed as null when compared with one.
+func ParseAs(value interface{}, searchString string) (interface{}, error) {
+	switch value.(type) {
+	case float64:
+		return strconv.ParseFloat(searchString, 64)
+	case bool:
+		return strconv.ParseBool(searchString)
+	case nil:
+		if searchString != "null" {
+			return nil, fmt.Errorf("'%s' isn't null", searchString)
+		}
+		return nil, nil
+	}
+	return searchString, nil
+}
+
+// Matches returns true if a json value equals a value from a request
+func (c ValueComparator) Matches(value interface{}, searchString string) bool {
+	search, err := ParseAs(value, searchString)
+	if err != nil {
+		return false
+	}
+	cmp, err := c.Compare(value, search)
+	return err == nil && cmp == 0
+}
+
+// NumericRange returns the smallest and largest numbers equal to n
+func (c ValueComparator) NumericRange(n float64) (min, max float64) {
+	return n - c.Precision, n + c.Precision
+}
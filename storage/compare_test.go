@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValueComparatorCompare(t *testing.T) {
+	exact := ValueComparator{}
+	approximate := ValueComparator{Precision: 0.000001}
+	tests := []struct {
+		comparator ValueComparator
+		a, b       interface{}
+		expected   int
+		err        bool
+	}{
+		{comparator: exact, a: 1.0, b: 2.0, expected: -1},
+		{comparator: exact, a: 2.0, b: 1.0, expected: 1},
+		{comparator: exact, a: 1.5, b: 1.5, expected: 0},
+		{comparator: exact, a: 0.8737940192222595, b: 0.873794, expected: 1},
+		{comparator: approximate, a: 0.8737940192222595, b: 0.873794, expected: 0},
+		{comparator: approximate, a: 0.873796, b: 0.873794, expected: 1},
+		{comparator: exact, a: "abc", b: "abd", expected: -1},
+		{comparator: exact, a: "B", b: "a", expected: -1},
+		{comparator: exact, a: "abc", b: "abc", expected: 0},
+		{comparator: exact, a: "2020-01-02T10:00:00+02:00", b: "2020-01-02T08:00:00Z", expected: 0},
+		{comparator: exact, a: "2020-01-02T10:00:00+02:00", b: "2020-01-02T09:00:00Z", expected: -1},
+		{comparator: exact, a: "2020-01-02", b: "2020-01-01T23:59:59Z", expected: 1},
+		{comparator: exact, a: "2020-01-02", b: "tomorrow", expected: -1},
+		{comparator: exact, a: false, b: true, expected: -1},
+		{comparator: exact, a: true, b: false, expected: 1},
+		{comparator: exact, a: true, b: true, expected: 0},
+		{comparator: exact, a: nil, b: nil, expected: 0},
+		{comparator: exact, a: nil, b: "null", err: true},
+		{comparator: exact, a: 1.0, b: "1", err: true},
+		{comparator: exact, a: "true", b: true, err: true},
+		{comparator: exact, a: map[string]interface{}{}, b: map[string]interface{}{}, err: true},
+	}
+	for _, test := range tests {
+		cmp, err := test.comparator.Compare(test.a, test.b)
+		if test.err {
+			if err == nil {
+				t.Errorf("Compare(%#v, %#v) = %d, expected an error", test.a, test.b, cmp)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Compare(%#v, %#v) returned error: %s", test.a, test.b, err)
+			continue
+		}
+		if cmp != test.expected {
+			t.Errorf("Compare(%#v, %#v) with precision %g = %d, expected %d", test.a, test.b, test.comparator.Precision, cmp, test.expected)
+		}
+	}
+}
+
+func TestParseAs(t *testing.T) {
+	tests := []struct {
+		value        interface{}
+		searchString string
+		expected     interface{}
+		err          bool
+	}{
+		{value: 1.0, searchString: "1.5", expected: 1.5},
+		{value: 1.0, searchString: "one", err: true},
+		{value: true, searchString: "false", expected: false},
+		{value: true, searchString: "yes", err: true},
+		{value: nil, searchString: "null", expected: nil},
+		{value: nil, searchString: "", err: true},
+		{value: "text", searchString: "1.5", expected: "1.5"},
+		{value: []interface{}{}, searchString: "a", expected: "a"},
+	}
+	for _, test := range tests {
+		parsed, err := ParseAs(test.value, test.searchString)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseAs(%#v, %q) = %#v, expected an error", test.value, test.searchString, parsed)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseAs(%#v, %q) returned error: %s", test.value, test.searchString, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, test.expected) {
+			t.Errorf("ParseAs(%#v, %q) = %#v, expected %#v", test.value, test.searchString, parsed, test.expected)
+		}
+	}
+}
+
+func TestValueComparatorMatches(t *testing.T) {
+	exact := ValueComparator{}
+	approximate := ValueComparator{Precision: 0.000001}
+	tests := []struct {
+		comparator   ValueComparator
+		value        interface{}
+		searchString string
+		expected     bool
+	}{
+		{comparator: exact, value: 1000000.0, searchString: "1000000", expected: true},
+		{comparator: exact, value: 1000000.0, searchString: "1e6", expected: true},
+		{comparator: exact, value: 0.8737940192222595, searchString: "0.873794", expected: false},
+		{comparator: approximate, value: 0.8737940192222595, searchString: "0.873794", expected: true},
+		{comparator: exact, value: true, searchString: "true", expected: true},
+		{comparator: exact, value: true, searchString: "1", expected: true},
+		{comparator: exact, value: false, searchString: "true", expected: false},
+		{comparator: exact, value: nil, searchString: "null", expected: true},
+		{comparator: exact, value: "null", searchString: "null", expected: true},
+		{comparator: exact, value: "Rick", searchString: "rick", expected: false},
+		{comparator: exact, value: "2020-01-02T10:00:00+02:00", searchString: "2020-01-02T08:00:00Z", expected: true},
+		{comparator: exact, value: "1", searchString: "1.0", expected: false},
+	}
+	for _, test := range tests {
+		matches := test.comparator.Matches(test.value, test.searchString)
+		if matches != test.expected {
+			t.Errorf("Matches(%#v, %q) with precision %g = %t, expected %t", test.value, test.searchString, test.comparator.Precision, matches, test.expected)
+		}
+	}
+}
+
+func TestNumericRange(t *testing.T) {
+	tests := []struct {
+		comparator ValueComparator
+		n          float64
+		min, max   float64
+	}{
+		{comparator: ValueComparator{}, n: 5, min: 5, max: 5},
+		{comparator: ValueComparator{Precision: 0.5}, n: 5, min: 4.5, max: 5.5},
+		{comparator: ValueComparator{Precision: 0.5}, n: -5, min: -5.5, max: -4.5},
+	}
+	for _, test := range tests {
+		min, max := test.comparator.NumericRange(test.n)
+		if min != test.min || max != test.max {
+			t.Errorf("NumericRange(%g) with precision %g = %g, %g, expected %g, %g", test.n, test.comparator.Precision, min, max, test.min, test.max)
+		}
+	}
+}
+
+func TestGetRecordsInDataChunk(t *testing.T) {
+	chunk := []byte(strings.Join([]string{
+		`{"id": 1, "score": 0.8737940192222595, "tags": ["a", "b"]}`,
+		`{"id": 2, "score": 0.873794, "address": {"city": "Seattle"}}`,
+		`{"id": 3, "score": null, "tags": ["c"], "address": {"city": "Portland"}}`,
+		`not json`,
+	}, "\n"))
+	tests := []struct {
+		comparator   ValueComparator
+		field        string
+		searchString string
+		expected     []string
+	}{
+		{field: "score", searchString: "0.873794", expected: []string{`{"id": 2, "score": 0.873794, "address": {"city": "Seattle"}}`}},
+		{comparator: ValueComparator{Precision: 0.000001}, field: "score", searchString: "0.873794", expected: []string{
+			`{"id": 1, "score": 0.8737940192222595, "tags": ["a", "b"]}`,
+			`{"id": 2, "score": 0.873794, "address": {"city": "Seattle"}}`,
+		}},
+		{field: "score", searchString: "null", expected: []string{`{"id": 3, "score": null, "tags": ["c"], "address": {"city": "Portland"}}`}},
+		{field: "tags", searchString: "b", expected: []string{`{"id": 1, "score": 0.8737940192222595, "tags": ["a", "b"]}`}},
+		{field: "address.city", searchString: "Portland", expected: []string{`{"id": 3, "score": null, "tags": ["c"], "address": {"city": "Portland"}}`}},
+		{field: "id", searchString: "4", expected: []string{}},
+	}
+	for _, test := range tests {
+		records := []string{}
+		for _, record := range GetRecordsInDataChunk(chunk, test.field, test.searchString, test.comparator) {
+			records = append(records, string(record))
+		}
+		if !reflect.DeepEqual(records, test.expected) {
+			t.Errorf("GetRecordsInDataChunk(%q, %q) with precision %g = %q, expected %q", test.field, test.searchString, test.comparator.Precision, records, test.expected)
+		}
+	}
+}
+
+func TestGetRecordsInRange(t *testing.T) {
+	chunk := []byte(strings.Join([]string{
+		`{"id": 1, "name": "a"}`,
+		`{"id": 5, "name": "m"}`,
+		`{"id": 10}`,
+		`{"id": "10", "name": "z"}`,
+		`{"name": null}`,
+	}, "\n"))
+	tests := []struct {
+		field    string
+		from, to interface{}
+		expected []string
+	}{
+		{field: "id", from: 1.0, to: 5.0, expected: []string{`{"id": 1, "name": "a"}`, `{"id": 5, "name": "m"}`}},
+		{field: "id", from: 5.0, to: nil, expected: []string{`{"id": 5, "name": "m"}`, `{"id": 10}`}},
+		{field: "id", from: nil, to: nil, expected: []string{`{"id": 1, "name": "a"}`, `{"id": 5, "name": "m"}`, `{"id": 10}`, `{"id": "10", "name": "z"}`}},
+		{field: "id", from: "1", to: "2", expected: []string{`{"id": "10", "name": "z"}`}},
+		{field: "name", from: "b", to: "z", expected: []string{`{"id": 5, "name": "m"}`, `{"id": "10", "name": "z"}`}},
+		{field: "id", from: 11.0, to: 20.0, expected: []string{}},
+	}
+	for _, test := range tests {
+		records := []string{}
+		for _, record := range GetRecordsInRange(chunk, test.field, test.from, test.to) {
+			records = append(records, string(record))
+		}
+		if !reflect.DeepEqual(records, test.expected) {
+			t.Errorf("GetRecordsInRange(%q, %v, %v) = %q, expected %q", test.field, test.from, test.to, records, test.expected)
+		}
+	}
+}
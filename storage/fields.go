@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+)
+
+// FieldPath splits a dotted field path like address.city into the names of each level.
+// Arrays are searched through, so tags[].name and tags.name are the same path.
+func FieldPath(field string) []string {
+	path := strings.Split(field, ".")
+	for i, name := range path {
+		path[i] = strings.TrimSuffix(name, "[]")
+	}
+	return path
+}
+
+// NormalizeField converts a field path to the dotted form used in the search index
+func NormalizeField(field string) string {
+	return strings.Join(FieldPath(field), ".")
+}
+
+// FieldValues returns every value at a field path in a record. Arrays along the path, or
+// holding the final values, contribute each of their elements.
+func FieldValues(record map[string]interface{}, field string) []interface{} {
+	return appendFieldValues(nil, record, FieldPath(field))
+}
+
+func appendFieldValues(values []interface{}, value interface{}, path []string) []interface{} {
+	if elements, ok := value.([]interface{}); ok {
+		for _, element := range elements {
+			values = appendFieldValues(values, element, path)
+		}
+		return values
+	}
+	if len(path) == 0 {
+		return append(values, value)
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return values
+	}
+	child, ok := object[path[0]]
+	if !ok {
+		return values
+	}
+	return appendFieldValues(values, child, path[1:])
+}
+
+// FieldPresence returns the dotted paths of every field in a record holding a value, including
+// objects, and of those holding null. Empty arrays hold no value, and arrays holding both nulls
+// and values are in both.
+func FieldPresence(record map[string]interface{}) (present, null []string) {
+	presentPaths, nullPaths := map[string]bool{}, map[string]bool{}
+	for name, value := range record {
+		addPresence(presentPaths, nullPaths, name, value)
+	}
+	return sortedKeys(presentPaths), sortedKeys(nullPaths)
+}
+
+func addPresence(present, null map[string]bool, path string, value interface{}) {
+	switch value := value.(type) {
+	case nil:
+		null[path] = true
+	case []interface{}:
+		for _, element := range value {
+			addPresence(present, null, path, element)
+		}
+	case map[string]interface{}:
+		present[path] = true
+		for name, child := range value {
+			addPresence(present, null, path+"."+name, child)
+		}
+	default:
+		present[path] = true
+	}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
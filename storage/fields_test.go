@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func testRecord(t *testing.T, recordJSON string) map[string]interface{} {
+	record := map[string]interface{}{}
+	err := json.Unmarshal([]byte(recordJSON), &record)
+	if err != nil {
+		t.Fatalf("Could not read test record: %s", err)
+	}
+	return record
+}
+
+func TestFieldPath(t *testing.T) {
+	tests := []struct {
+		field      string
+		expected   []string
+		normalized string
+	}{
+		{field: "name", expected: []string{"name"}, normalized: "name"},
+		{field: "address.city", expected: []string{"address", "city"}, normalized: "address.city"},
+		{field: "tags[]", expected: []string{"tags"}, normalized: "tags"},
+		{field: "friends[].name", expected: []string{"friends", "name"}, normalized: "friends.name"},
+	}
+	for _, test := range tests {
+		path := FieldPath(test.field)
+		if !reflect.DeepEqual(path, test.expected) {
+			t.Errorf("FieldPath(%q) = %q, expected %q", test.field, path, test.expected)
+		}
+		normalized := NormalizeField(test.field)
+		if normalized != test.normalized {
+			t.Errorf("NormalizeField(%q) = %q, expected %q", test.field, normalized, test.normalized)
+		}
+	}
+}
+
+func TestFieldValues(t *testing.T) {
+	record := testRecord(t, `{
+		"name": "Rick",
+		"age": 70,
+		"job": null,
+		"address": {"city": "Seattle", "geo": {"lat": 47.6}},
+		"tags": ["a", "b"],
+		"friends": [{"name": "Morty", "tags": ["c"]}, {"name": "Summer", "tags": ["d", "e"]}, {"age": 17}],
+		"matrix": [[1, 2], [3]]
+	}`)
+	tests := []struct {
+		field    string
+		expected []interface{}
+	}{
+		{field: "name", expected: []interface{}{"Rick"}},
+		{field: "age", expected: []interface{}{70.0}},
+		{field: "job", expected: []interface{}{nil}},
+		{field: "missing", expected: nil},
+		{field: "address.city", expected: []interface{}{"Seattle"}},
+		{field: "address.geo.lat", expected: []interface{}{47.6}},
+		{field: "address.country", expected: nil},
+		{field: "name.first", expected: nil},
+		{field: "address", expected: []interface{}{map[string]interface{}{"city": "Seattle", "geo": map[string]interface{}{"lat": 47.6}}}},
+		{field: "tags", expected: []interface{}{"a", "b"}},
+		{field: "tags[]", expected: []interface{}{"a", "b"}},
+		{field: "friends.name", expected: []interface{}{"Morty", "Summer"}},
+		{field: "friends[].name", expected: []interface{}{"Morty", "Summer"}},
+		{field: "friends.tags", expected: []interface{}{"c", "d", "e"}},
+		{field: "friends.age", expected: []interface{}{17.0}},
+		{field: "matrix", expected: []interface{}{1.0, 2.0, 3.0}},
+	}
+	for _, test := range tests {
+		values := FieldValues(record, test.field)
+		if !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("FieldValues(%q) = %#v, expected %#v", test.field, values, test.expected)
+		}
+	}
+}
+
+func TestFieldPresence(t *testing.T) {
+	tests := []struct {
+		record  string
+		present []string
+		null    []string
+	}{
+		{record: `{}`, present: []string{}, null: []string{}},
+		{record: `{"name": "Rick", "age": 70, "alive": false, "job": null}`, present: []string{"age", "alive", "name"}, null: []string{"job"}},
+		{record: `{"name": ""}`, present: []string{"name"}, null: []string{}},
+		{record: `{"address": {"city": "Seattle", "zip": null}}`, present: []string{"address", "address.city"}, null: []string{"address.zip"}},
+		{record: `{"address": {}}`, present: []string{"address"}, null: []string{}},
+		{record: `{"tags": []}`, present: []string{}, null: []string{}},
+		{record: `{"tags": [null]}`, present: []string{}, null: []string{"tags"}},
+		{record: `{"tags": ["a", null]}`, present: []string{"tags"}, null: []string{"tags"}},
+		{record: `{"friends": [{"name": "Morty"}, {"name": null, "age": 17}]}`, present: []string{"friends", "friends.age", "friends.name"}, null: []string{"friends.name"}},
+	}
+	for _, test := range tests {
+		present, null := FieldPresence(testRecord(t, test.record))
+		if !reflect.DeepEqual(present, test.present) || !reflect.DeepEqual(null, test.null) {
+			t.Errorf("FieldPresence(%s) = %q, %q, expected %q, %q", test.record, present, null, test.present, test.null)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	gcs "cloud.google.com/go/storage"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/zachgoldstein/datatoapi/models"
+)
+
+// GCSSchemePrefix identifies storage paths handled by GCSFS, in the form gs://bucket/prefix
+const GCSSchemePrefix = "gs://"
+
+// Keys read from the credentials map passed to GCSFS.Start
+const (
+	CredentialGCSEndpoint        = "gcsEndpoint"
+	CredentialGCSCredentialsFile = "gcsCredentialsFile"
+	CredentialGCSAnonymous       = "gcsAnonymous"
+)
+
+type GCSFS struct {
+	FSLocation string
+	Config     GCSConfig
+	Filter     PathFilter
+	Blocks     BlockConfig
+	client     *gcs.Client
+	bucket     *gcs.BucketHandle
+	prefix     string
+}
+
+// GCSConfig holds the settings used to connect to Google Cloud Storage or a local fake-gcs-server.
+// Without a credentials file, credentials come from the standard application default sources.
+type GCSConfig struct {
+	Endpoint        string
+	CredentialsFile string
+	Anonymous       bool
+}
+
+// NewGCSFS creates an instance of GCSFS
+func NewGCSFS() *GCSFS {
+	return &GCSFS{}
+}
+
+// NewGCSConfig reads GCS connection settings out of a credentials map
+func NewGCSConfig(credentials map[string]interface{}) GCSConfig {
+	return GCSConfig{
+		Endpoint:        credentialString(credentials, CredentialGCSEndpoint),
+		CredentialsFile: credentialString(credentials, CredentialGCSCredentialsFile),
+		Anonymous:       credentialBool(credentials, CredentialGCSAnonymous),
+	}
+}
+
+// IsGCSPath returns true for storage paths that should be served by GCSFS
+func IsGCSPath(storagePath string) bool {
+	return strings.HasPrefix(storagePath, GCSSchemePrefix)
+}
+
+// getGCSPathDetails splits a gs:// storage path into its bucket and object prefix
+func getGCSPathDetails(storagePath string) (bucket, prefix string) {
+	path := strings.TrimPrefix(storagePath, GCSSchemePrefix)
+	pathParts := strings.SplitN(path, "/", 2)
+	if len(pathParts) == 1 {
+		return pathParts[0], ""
+	}
+	return pathParts[0], pathParts[1]
+}
+
+func (gcsfs *GCSFS) clientOptions() []option.ClientOption {
+	opts := []option.ClientOption{}
+	if gcsfs.Config.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(gcsfs.Config.Endpoint))
+	}
+	if gcsfs.Config.Anonymous {
+		opts = append(opts, option.WithoutAuthentication())
+	} else if gcsfs.Config.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(gcsfs.Config.CredentialsFile))
+	}
+	return opts
+}
+
+// Start connects to the bucket, testing to make sure the data is accessible
+func (gcsfs *GCSFS) Start(ctx context.Context, path string, credentials map[string]interface{}) error {
+	gcsfs.FSLocation = path
+	gcsfs.Config = NewGCSConfig(credentials)
+	gcsfs.Filter = NewPathFilter(credentials)
+	gcsfs.Blocks = NewBlockConfig(credentials)
+
+	client, err := gcs.NewClient(ctx, gcsfs.clientOptions()...)
+	if err != nil {
+		log.WithError(err).Error("Could not create gcs client")
+		return err
+	}
+	bucket, prefix := getGCSPathDetails(path)
+	log.WithFields(log.Fields{
+		"endpoint": gcsfs.Config.Endpoint,
+		"bucket":   bucket,
+		"prefix":   prefix,
+	}).Info("Connecting to google cloud storage")
+
+	gcsfs.client = client
+	gcsfs.bucket = client.Bucket(bucket)
+	gcsfs.prefix = prefix
+	return gcsfs.TestData(ctx)
+}
+
+// TestData makes sure we can list objects under the storage path
+func (gcsfs *GCSFS) TestData(ctx context.Context) error {
+	log.Info("Testing data access")
+	numObjects := 0
+	err := gcsfs.walkDataObjects(ctx, func(name string) error {
+		numObjects++
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("Could not access data")
+		return err
+	}
+	if numObjects == 0 {
+		err = fmt.Errorf("No objects found at %s", gcsfs.FSLocation)
+		log.WithError(err).Error("Could not access data")
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"numObjects": numObjects,
+	}).Info("Data is accessible")
+	return nil
+}
+
+// walkDataObjects lists objects under the storage path page by page, calling walkFn
+// with the name of each object that belongs to the dataset, see InStoragePath
+func (gcsfs *GCSFS) walkDataObjects(ctx context.Context, walkFn func(name string) error) error {
+	objs := gcsfs.bucket.Objects(ctx, &gcs.Query{
+		Prefix: gcsfs.prefix,
+	})
+	for {
+		attrs, err := objs.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			log.WithError(err).Error("Could not list objects")
+			return err
+		}
+		if !InStoragePath(attrs.Name, gcsfs.prefix, gcsfs.Filter) {
+			continue
+		}
+		err = walkFn(attrs.Name)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ScanDataBlocks streams each object under the storage path, sending records and data blocks on channels.
+// Channels are always closed when scanning stops.
+func (gcsfs *GCSFS) ScanDataBlocks(ctx context.Context, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+	defer close(blockChan)
+	defer close(dataChan)
+
+	log.Info("Scanning gcs data into channels")
+	err := gcsfs.walkDataObjects(ctx, func(name string) error {
+		return gcsfs.scanObject(ctx, name, dataChan, blockChan)
+	})
+	if err != nil {
+		log.WithError(err).Error("Could not scan objects")
+		return err
+	}
+	log.Info("Finished scanning gcs data into channels")
+	return nil
+}
+
+// scanObject streams a single object into the data chans
+func (gcsfs *GCSFS) scanObject(ctx context.Context, name string, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+	reader, err := gcsfs.bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"objectKey": name,
+		}).Error("Could not download object")
+		return err
+	}
+	defer reader.Close()
+
+	scanner := NewRecordScanner(reader)
+	return WriteJSONToDataChans(ctx, name, scanner, gcsfs.Blocks, dataChan, blockChan)
+}
+
+// RetrieveDataBlockBytes fetches the byte range for a data block with a ranged object read
+func (gcsfs *GCSFS) RetrieveDataBlockBytes(ctx context.Context, block *models.DataBlock) ([]byte, error) {
+	reader, err := gcsfs.bucket.Object(block.File.Address).NewRangeReader(ctx, block.Start, block.End-block.Start)
+	if err != nil {
+		log.WithError(err).Error("Could not access data")
+		return nil, err
+	}
+	defer reader.Close()
+
+	bytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		log.WithError(err).Error("Could read body data")
+		return nil, err
+	}
+	return bytes, nil
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zachgoldstein/datatoapi/models"
+)
+
+func TestGetGCSPathDetails(t *testing.T) {
+	tests := []struct {
+		storagePath    string
+		bucket, prefix string
+	}{
+		{storagePath: "gs://data", bucket: "data"},
+		{storagePath: "gs://data/", bucket: "data"},
+		{storagePath: "gs://data/people", bucket: "data", prefix: "people"},
+		{storagePath: "gs://data/people/2020/a.jsonfiles", bucket: "data", prefix: "people/2020/a.jsonfiles"},
+	}
+	for _, test := range tests {
+		bucket, prefix := getGCSPathDetails(test.storagePath)
+		if bucket != test.bucket || prefix != test.prefix {
+			t.Errorf("getGCSPathDetails(%q) = %q, %q, expected %q, %q", test.storagePath, bucket, prefix, test.bucket, test.prefix)
+		}
+	}
+}
+
+// newTestGCSServer serves a single bucket's objects through the parts of the gcs json api
+// GCSFS lists with, listing a page of two objects at a time, and the download host it reads from
+func newTestGCSServer(bucket string, objects map[string]string) *httptest.Server {
+	names := []string{}
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/storage/v1/b/"+bucket+"/o" {
+			query := r.URL.Query()
+			items := []map[string]interface{}{}
+			nextPageToken := ""
+			for _, name := range names {
+				if !strings.HasPrefix(name, query.Get("prefix")) || name <= query.Get("pageToken") {
+					continue
+				}
+				if len(items) == 2 {
+					nextPageToken = items[1]["name"].(string)
+					break
+				}
+				items = append(items, map[string]interface{}{"bucket": bucket, "name": name})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"kind":          "storage#objects",
+				"items":         items,
+				"nextPageToken": nextPageToken,
+			})
+			return
+		}
+		object, ok := objects[strings.TrimPrefix(r.URL.Path, "/"+bucket+"/")]
+		if !strings.HasPrefix(r.URL.Path, "/"+bucket+"/") || !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "Not Found"}}`))
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(object))
+	}))
+}
+
+func TestGCSFS(t *testing.T) {
+	objects := map[string]string{
+		"people/a.jsonfiles":      "{\"id\": 1}\n{\"id\": 2}\n",
+		"people/b.jsonfiles":      "{\"id\": 3}\n",
+		"people/c.tmp":            "{\"id\": 4}\n",
+		"people/2020/d.jsonfiles": "{\"id\": 5}\n",
+		"peoplex/e.jsonfiles":     "{\"id\": 6}\n",
+		"places/f.jsonfiles":      "{\"id\": 7}\n",
+	}
+	server := newTestGCSServer("data", objects)
+	defer server.Close()
+
+	// Like fake-gcs-server, the emulator host makes reads use plain http
+	emulatorHost, emulated := os.LookupEnv("STORAGE_EMULATOR_HOST")
+	os.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+	defer func() {
+		if emulated {
+			os.Setenv("STORAGE_EMULATOR_HOST", emulatorHost)
+		} else {
+			os.Unsetenv("STORAGE_EMULATOR_HOST")
+		}
+	}()
+	credentials := map[string]interface{}{
+		CredentialGCSEndpoint:  server.URL + "/storage/v1/",
+		CredentialGCSAnonymous: true,
+		CredentialInclude:      "*.jsonfiles",
+	}
+
+	gcsfs := NewGCSFS()
+	err := gcsfs.Start(context.Background(), "gs://data/people", credentials)
+	if err != nil {
+		t.Fatalf("Could not start gcs storage: %s", err)
+	}
+	names := []string{}
+	err = gcsfs.walkDataObjects(context.Background(), func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not list objects: %s", err)
+	}
+	expected := []string{"people/2020/d.jsonfiles", "people/a.jsonfiles", "people/b.jsonfiles"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("Listed %q, expected %q", names, expected)
+	}
+
+	dataChan := make(chan models.IndexData, 10)
+	blockChan := make(chan models.DataBlock, 10)
+	err = gcsfs.ScanDataBlocks(context.Background(), dataChan, blockChan)
+	if err != nil {
+		t.Fatalf("Could not scan objects: %s", err)
+	}
+	records := 0
+	for range dataChan {
+		records++
+	}
+	if records != 4 {
+		t.Errorf("Scanned %d records, expected 4", records)
+	}
+	for block := range blockChan {
+		data, err := gcsfs.RetrieveDataBlockBytes(context.Background(), &block)
+		if err != nil {
+			t.Errorf("Could not retrieve block %+v: %s", block, err)
+			continue
+		}
+		expected := objects[block.File.Address][block.Start:block.End]
+		if string(data) != expected {
+			t.Errorf("Retrieved %q for block %+v, expected %q", data, block, expected)
+		}
+	}
+
+	err = NewGCSFS().Start(context.Background(), "gs://missing/people", credentials)
+	if err == nil {
+		t.Errorf("Starting with a missing bucket expected an error")
+	}
+	err = NewGCSFS().Start(context.Background(), "gs://data/places", map[string]interface{}{
+		CredentialGCSEndpoint:  server.URL + "/storage/v1/",
+		CredentialGCSAnonymous: true,
+		CredentialExclude:      "places/*",
+	})
+	if err == nil {
+		t.Errorf("Starting with every object excluded expected an error")
+	}
+}
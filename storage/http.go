@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zachgoldstein/datatoapi/models"
+)
+
+// CredentialHTTPManifest is read from the credentials map passed to HTTPFS.Start. When set, the
+// storage path points at a manifest listing the data file urls, one per line.
+const CredentialHTTPManifest = "httpManifest"
+
+// HTTPFS serves data published as plain files on an http server or CDN. Files are streamed
+// for indexing and records are fetched with Range requests, so the server must support them.
+type HTTPFS struct {
+	FSLocation string
+	FileURLs   []string
+	Manifest   bool
+	Blocks     BlockConfig
+	client     *http.Client
+}
+
+// NewHTTPFS creates an instance of HTTPFS
+func NewHTTPFS() *HTTPFS {
+	return &HTTPFS{
+		client: http.DefaultClient,
+	}
+}
+
+// IsHTTPPath returns true for storage paths that should be served by HTTPFS
+func IsHTTPPath(storagePath string) bool {
+	return strings.HasPrefix(storagePath, "http://") || strings.HasPrefix(storagePath, "https://")
+}
+
+// Start reads the list of file urls, testing to make sure each of them is accessible.
+// The storage path is either a comma separated list of urls or the url of a manifest.
+func (httpfs *HTTPFS) Start(ctx context.Context, path string, credentials map[string]interface{}) error {
+	httpfs.FSLocation = path
+	httpfs.Manifest = credentialBool(credentials, CredentialHTTPManifest)
+	httpfs.Blocks = NewBlockConfig(credentials)
+
+	if httpfs.Manifest {
+		fileURLs, err := httpfs.readManifest(ctx, path)
+		if err != nil {
+			log.WithError(err).Error("Could not read manifest")
+			return err
+		}
+		httpfs.FileURLs = fileURLs
+	} else {
+		httpfs.FileURLs = []string{}
+		for _, fileURL := range strings.Split(path, ",") {
+			fileURL = strings.TrimSpace(fileURL)
+			if fileURL != "" {
+				httpfs.FileURLs = append(httpfs.FileURLs, fileURL)
+			}
+		}
+	}
+	return httpfs.TestData(ctx)
+}
+
+// readManifest fetches a manifest and returns the urls it lists. Blank lines and lines
+// starting with # are skipped, and relative urls are resolved against the manifest url.
+func (httpfs *HTTPFS) readManifest(ctx context.Context, manifestURL string) ([]string, error) {
+	baseURL, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpfs.do(ctx, http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not get manifest %s: %s", manifestURL, resp.Status)
+	}
+
+	fileURLs := []string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fileURL, err := baseURL.Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		fileURLs = append(fileURLs, fileURL.String())
+	}
+	return fileURLs, scanner.Err()
+}
+
+func (httpfs *HTTPFS) do(ctx context.Context, method, fileURL string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return httpfs.client.Do(req.WithContext(ctx))
+}
+
+// TestData makes sure every file exists and that the server supports Range requests for it
+func (httpfs *HTTPFS) TestData(ctx context.Context) error {
+	log.Info("Testing data access")
+	if len(httpfs.FileURLs) == 0 {
+		err := fmt.Errorf("No file urls found at %s", httpfs.FSLocation)
+		log.WithError(err).Error("Could not access data")
+		return err
+	}
+	for _, fileURL := range httpfs.FileURLs {
+		resp, err := httpfs.do(ctx, http.MethodHead, fileURL, nil)
+		if err != nil {
+			log.WithError(err).Error("Could not access data")
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("Could not access %s: %s", fileURL, resp.Status)
+			log.WithError(err).Error("Could not access data")
+			return err
+		}
+		if resp.Header.Get("Accept-Ranges") != "bytes" {
+			err = fmt.Errorf("Server does not support range requests for %s", fileURL)
+			log.WithError(err).Error("Could not access data")
+			return err
+		}
+		if etag := resp.Header.Get("ETag"); etag == "" || isWeakETag(etag) {
+			log.WithFields(log.Fields{
+				"url": fileURL,
+			}).Warn("Server does not send a strong ETag, changes to the file won't be detected")
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"numFiles": len(httpfs.FileURLs),
+	}).Info("Data is accessible")
+	return nil
+}
+
+// ScanDataBlocks streams each file, sending records and data blocks on channels. The ETag of each
+// file is recorded on its data blocks. Channels are always closed when scanning stops.
+func (httpfs *HTTPFS) ScanDataBlocks(ctx context.Context, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+	defer close(blockChan)
+	defer close(dataChan)
+
+	log.Info("Scanning http data into channels")
+	for _, fileURL := range httpfs.FileURLs {
+		err := httpfs.scanFile(ctx, fileURL, dataChan, blockChan)
+		if err != nil {
+			log.WithError(err).Error("Could not scan files")
+			return err
+		}
+	}
+	log.Info("Finished scanning http data into channels")
+	return nil
+}
+
+// scanFile streams a single file into the data chans
+func (httpfs *HTTPFS) scanFile(ctx context.Context, fileURL string, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+	resp, err := httpfs.do(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not download %s: %s", fileURL, resp.Status)
+	}
+
+	file := models.File{
+		Address: fileURL,
+		Type:    "jsonfiles",
+		Version: resp.Header.Get("ETag"),
+	}
+	scanner := NewRecordScanner(resp.Body)
+	return WriteJSONFileToDataChans(ctx, file, scanner, httpfs.Blocks, dataChan, blockChan)
+}
+
+// RetrieveDataBlockBytes fetches the byte range for a data block with a Range request. If the
+// block was indexed with a strong ETag, the request fails when the file has changed since.
+func (httpfs *HTTPFS) RetrieveDataBlockBytes(ctx context.Context, block *models.DataBlock) ([]byte, error) {
+	headers := map[string]string{
+		// http ranges are inclusive of the last byte
+		"Range": fmt.Sprintf("bytes=%d-%d", block.Start, block.End-1),
+	}
+	// If-Match only compares strong ETags, so a weak one would fail every request
+	if block.File.Version != "" && !isWeakETag(block.File.Version) {
+		headers["If-Match"] = block.File.Version
+	}
+	resp, err := httpfs.do(ctx, http.MethodGet, block.File.Address, headers)
+	if err != nil {
+		log.WithError(err).Error("Could not access data")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusPreconditionFailed:
+		err = fmt.Errorf("%s has changed since it was indexed, indexes need to be rebuilt", block.File.Address)
+		log.WithError(err).Error("Could not access data")
+		return nil, err
+	default:
+		err = fmt.Errorf("Expected partial content for %s, got %s", block.File.Address, resp.Status)
+		log.WithError(err).Error("Could not access data")
+		return nil, err
+	}
+
+	bytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.WithError(err).Error("Could read body data")
+		return nil, err
+	}
+	return bytes, nil
+}
+
+// isWeakETag returns true if an ETag is weak, only promising the file means the same, e.g. W/"a1"
+func isWeakETag(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zachgoldstein/datatoapi/models"
+)
+
+// testFileServer serves files with Range support and an ETag for each, like a static file host or CDN
+type testFileServer struct {
+	*httptest.Server
+	sync.Mutex
+	files map[string]string
+	etags map[string]string
+}
+
+func newTestFileServer(files, etags map[string]string) *testFileServer {
+	fileServer := &testFileServer{files: files, etags: etags}
+	fileServer.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileServer.Lock()
+		file, ok := fileServer.files[r.URL.Path]
+		etag := fileServer.etags[r.URL.Path]
+		fileServer.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(file))
+	}))
+	return fileServer
+}
+
+func (fileServer *testFileServer) setFile(path, file, etag string) {
+	fileServer.Lock()
+	defer fileServer.Unlock()
+	fileServer.files[path] = file
+	fileServer.etags[path] = etag
+}
+
+// scanTestBlocks scans all of the storage's records, returning how many there were and its data blocks
+func scanTestBlocks(t *testing.T, physStore PhysicalStorer) (int, []models.DataBlock) {
+	dataChan := make(chan models.IndexData, 100)
+	blockChan := make(chan models.DataBlock, 100)
+	err := physStore.ScanDataBlocks(context.Background(), dataChan, blockChan)
+	if err != nil {
+		t.Fatalf("Could not scan data: %s", err)
+	}
+	records := 0
+	for range dataChan {
+		records++
+	}
+	blocks := []models.DataBlock{}
+	for block := range blockChan {
+		blocks = append(blocks, block)
+	}
+	return records, blocks
+}
+
+func TestHTTPFS(t *testing.T) {
+	files := map[string]string{
+		"/people/a.jsonfiles": "{\"id\": 1}\n{\"id\": 2}\n",
+		"/people/b.jsonfiles": "{\"id\": 3}\n",
+		"/people/manifest":    "# people\n\na.jsonfiles\n/people/b.jsonfiles\n",
+	}
+	etags := map[string]string{
+		"/people/a.jsonfiles": `"a1"`,
+		"/people/b.jsonfiles": `"b1"`,
+	}
+	server := newTestFileServer(files, etags)
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		path        string
+		credentials map[string]interface{}
+	}{
+		{name: "urls", path: server.URL + "/people/a.jsonfiles, " + server.URL + "/people/b.jsonfiles,"},
+		{name: "manifest", path: server.URL + "/people/manifest", credentials: map[string]interface{}{CredentialHTTPManifest: true}},
+	}
+	for _, test := range tests {
+		httpfs := NewHTTPFS()
+		err := httpfs.Start(context.Background(), test.path, test.credentials)
+		if err != nil {
+			t.Errorf("%s: could not start http storage: %s", test.name, err)
+			continue
+		}
+		expected := []string{server.URL + "/people/a.jsonfiles", server.URL + "/people/b.jsonfiles"}
+		if strings.Join(httpfs.FileURLs, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: found %q, expected %q", test.name, httpfs.FileURLs, expected)
+		}
+
+		records, blocks := scanTestBlocks(t, httpfs)
+		if records != 3 {
+			t.Errorf("%s: scanned %d records, expected 3", test.name, records)
+		}
+		for _, block := range blocks {
+			data, err := httpfs.RetrieveDataBlockBytes(context.Background(), &block)
+			if err != nil {
+				t.Errorf("%s: could not retrieve block %+v: %s", test.name, block, err)
+				continue
+			}
+			expected := files[strings.TrimPrefix(block.File.Address, server.URL)][block.Start:block.End]
+			if string(data) != expected {
+				t.Errorf("%s: retrieved %q for block %+v, expected %q", test.name, data, block, expected)
+			}
+			if block.File.Version != etags[strings.TrimPrefix(block.File.Address, server.URL)] {
+				t.Errorf("%s: block %+v wasn't versioned with the file's ETag", test.name, block)
+			}
+		}
+	}
+
+	err := NewHTTPFS().Start(context.Background(), server.URL+"/people/missing.jsonfiles", nil)
+	if err == nil {
+		t.Errorf("Starting with a missing file expected an error")
+	}
+	err = NewHTTPFS().Start(context.Background(), server.URL+"/people/missing", map[string]interface{}{CredentialHTTPManifest: true})
+	if err == nil {
+		t.Errorf("Starting with a missing manifest expected an error")
+	}
+}
+
+func TestHTTPFSChangedFile(t *testing.T) {
+	server := newTestFileServer(
+		map[string]string{"/a.jsonfiles": "{\"id\": 1}\n{\"id\": 2}\n"},
+		map[string]string{"/a.jsonfiles": `"a1"`},
+	)
+	defer server.Close()
+
+	httpfs := NewHTTPFS()
+	err := httpfs.Start(context.Background(), server.URL+"/a.jsonfiles", nil)
+	if err != nil {
+		t.Fatalf("Could not start http storage: %s", err)
+	}
+	_, blocks := scanTestBlocks(t, httpfs)
+	if len(blocks) == 0 {
+		t.Fatalf("Scanning found no blocks")
+	}
+
+	server.setFile("/a.jsonfiles", "{\"id\": 3}\n{\"id\": 4}\n", `"a2"`)
+	_, err = httpfs.RetrieveDataBlockBytes(context.Background(), &blocks[0])
+	if err == nil {
+		t.Errorf("Retrieving a block from a changed file expected an error")
+	}
+}
+
+func TestHTTPFSWeakETag(t *testing.T) {
+	server := newTestFileServer(
+		map[string]string{"/a.jsonfiles": "{\"id\": 1}\n{\"id\": 2}\n"},
+		map[string]string{"/a.jsonfiles": `W/"a1"`},
+	)
+	defer server.Close()
+
+	httpfs := NewHTTPFS()
+	err := httpfs.Start(context.Background(), server.URL+"/a.jsonfiles", nil)
+	if err != nil {
+		t.Fatalf("Could not start http storage: %s", err)
+	}
+	_, blocks := scanTestBlocks(t, httpfs)
+	if len(blocks) == 0 {
+		t.Fatalf("Scanning found no blocks")
+	}
+
+	bytes, err := httpfs.RetrieveDataBlockBytes(context.Background(), &blocks[0])
+	if err != nil {
+		t.Fatalf("Could not retrieve a block from a file with a weak ETag: %s", err)
+	}
+	if !strings.HasPrefix(string(bytes), "{\"id\": 1}") {
+		t.Errorf("Retrieved %q, expected the file's first record", bytes)
+	}
+}
@@ -1,7 +1,7 @@
 package storage
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,6 +12,8 @@ import (
 type LocalFS struct {
 	FSLocation string
 	FilePaths  []string
+	Filter     PathFilter
+	Blocks     BlockConfig
 }
 
 // NewLocalFS creates an instance of LocalFS
@@ -20,13 +22,18 @@ func NewLocalFS() *LocalFS {
 }
 
 // Start initialises the local filesystem, testing to make sure the data is accessible
-func (fs *LocalFS) Start(path string, credentials map[string]interface{}) error {
+func (fs *LocalFS) Start(ctx context.Context, path string, credentials map[string]interface{}) error {
 	fs.FSLocation = path
-	return fs.TestData()
+	fs.Filter = NewPathFilter(credentials)
+	fs.Blocks = NewBlockConfig(credentials)
+	return fs.TestData(ctx)
 }
 
 // TestData makes sure we have access to the file(s) we need to interact with
-func (fs *LocalFS) TestData() error {
+func (fs *LocalFS) TestData(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	f, err := os.Open(fs.FSLocation)
 	if err != nil {
 		return err
@@ -43,14 +50,14 @@ func (fs *LocalFS) TestData() error {
 	return err
 }
 
-func (fs *LocalFS) ScanDataBlocksForPath(path string, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+func (fs *LocalFS) ScanDataBlocksForPath(ctx context.Context, path string, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	err = WriteJSONToDataChans(path, scanner, dataChan, blockChan)
+	scanner := NewRecordScanner(f)
+	err = WriteJSONToDataChans(ctx, path, scanner, fs.Blocks, dataChan, blockChan)
 	if err != nil {
 		return err
 	}
@@ -59,38 +66,57 @@ func (fs *LocalFS) ScanDataBlocksForPath(path string, dataChan chan<- models.Ind
 }
 
 func (fs *LocalFS) visitPath(path string, f os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
 	if f.IsDir() {
 		return nil
 	}
+	relPath, err := filepath.Rel(fs.FSLocation, path)
+	if err != nil || relPath == "." {
+		relPath = filepath.Base(path)
+	}
+	if !fs.Filter.Match(filepath.ToSlash(relPath)) {
+		return nil
+	}
 	fs.FilePaths = append(fs.FilePaths, path)
 	return nil
 }
 
 // ScanDataBlocks will read all data, serialising the full data and blocks of data to send on channels
-// Focused on Jsonfiles for now.
-func (fs *LocalFS) ScanDataBlocks(dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+// Focused on Jsonfiles for now. Channels are always closed when scanning stops.
+func (fs *LocalFS) ScanDataBlocks(ctx context.Context, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+	defer close(blockChan)
+	defer close(dataChan)
+
 	fs.FilePaths = []string{}
 	err := filepath.Walk(fs.FSLocation, fs.visitPath)
 	if err != nil {
 		return err
 	}
 	for _, path := range fs.FilePaths {
-		err := fs.ScanDataBlocksForPath(path, dataChan, blockChan)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := fs.ScanDataBlocksForPath(ctx, path, dataChan, blockChan)
 		if err != nil {
 			return err
 		}
 	}
-	close(dataChan)
-	close(blockChan)
 
 	return nil
 }
 
-func (fs *LocalFS) RetrieveDataBlockBytes(block *models.DataBlock) ([]byte, error) {
+// RetrieveDataBlockBytes reads the byte range for a data block from the local file
+func (fs *LocalFS) RetrieveDataBlockBytes(ctx context.Context, block *models.DataBlock) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	f, err := os.Open(block.File.Address)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 	_, err = f.Seek(block.Start, 0)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zachgoldstein/datatoapi/models"
+)
+
+func writeTestDataFile(t *testing.T, records int) string {
+	dir, err := ioutil.TempDir("", "datatoapi-local")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %s", err)
+	}
+	lines := []string{}
+	for i := 0; i < records; i++ {
+		lines = append(lines, fmt.Sprintf(`{"id": %d, "name": "record %d"}`, i, i))
+	}
+	path := filepath.Join(dir, "data.jsonfiles")
+	err = ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write test data: %s", err)
+	}
+	return path
+}
+
+func TestLocalFSScanDataBlocksCancelled(t *testing.T) {
+	path := writeTestDataFile(t, 200)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	fs := NewLocalFS()
+	err := fs.Start(context.Background(), path, nil)
+	if err != nil {
+		t.Fatalf("Could not start local storage: %s", err)
+	}
+
+	// Nothing reads from the channels, so the scan blocks until the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	dataChan := make(chan models.IndexData)
+	blockChan := make(chan models.DataBlock)
+	done := make(chan error, 1)
+	go func() {
+		done <- fs.ScanDataBlocks(ctx, dataChan, blockChan)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err = <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("ScanDataBlocks did not return after its context was cancelled")
+	}
+	if err != context.Canceled {
+		t.Errorf("ScanDataBlocks returned %v, expected %v", err, context.Canceled)
+	}
+	if _, ok := <-dataChan; ok {
+		t.Errorf("ScanDataBlocks left the data channel open")
+	}
+	if _, ok := <-blockChan; ok {
+		t.Errorf("ScanDataBlocks left the block channel open")
+	}
+}
+
+func TestLocalFSRetrieveDataBlockBytes(t *testing.T) {
+	path := writeTestDataFile(t, 2)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	fs := NewLocalFS()
+	block := &models.DataBlock{Start: 0, End: 29, File: models.File{Address: path, Type: "jsonfiles"}}
+	data, err := fs.RetrieveDataBlockBytes(context.Background(), block)
+	if err != nil {
+		t.Fatalf("Could not retrieve block: %s", err)
+	}
+	expected := `{"id": 0, "name": "record 0"}`
+	if string(data) != expected {
+		t.Errorf("Retrieved %q, expected %q", data, expected)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fs.RetrieveDataBlockBytes(ctx, block)
+	if err != context.Canceled {
+		t.Errorf("RetrieveDataBlockBytes with a cancelled context returned %v, expected %v", err, context.Canceled)
+	}
+}
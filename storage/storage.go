@@ -3,8 +3,11 @@ package storage
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -14,20 +17,273 @@ import (
 	"github.com/zachgoldstein/datatoapi/models"
 )
 
+// BLOCK_SIZE is the number of records in a data block when no block size is configured
 const BLOCK_SIZE = int64(50)
 
+// MaxRecordSize is the largest single record (line) we can scan. Records with large text
+// fields easily exceed bufio's default 64KB token size.
+const MaxRecordSize = 16 * 1024 * 1024
+
 // PhysicalStorer is responsible for interacting with physical storage, creating
-// datablocks for indexing to reference
+// datablocks for indexing to reference. All calls accept a context so that client
+// disconnects, shutdown and deadlines cancel any outstanding work.
 type PhysicalStorer interface {
-	Start(path string, credentials map[string]interface{}) error
-	TestData() error
-	ScanDataBlocks(dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error
+	Start(ctx context.Context, path string, credentials map[string]interface{}) error
+	TestData(ctx context.Context) error
+	ScanDataBlocks(ctx context.Context, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error
+
+	RetrieveDataBlockBytes(ctx context.Context, block *models.DataBlock) ([]byte, error)
+}
+
+// Keys read from the credentials map to build a PathFilter
+const (
+	CredentialInclude = "include"
+	CredentialExclude = "exclude"
+)
+
+// Keys read from the credentials map to build a BlockConfig
+const (
+	CredentialBlockRecords = "blockRecords"
+	CredentialBlockBytes   = "blockBytes"
+	CredentialSortKeys     = "sortKeys"
+	CredentialBloomFields  = "bloomFields"
+	CredentialBloomRate    = "bloomFalsePositiveRate"
+)
+
+// BlockConfig decides how many records go in each data block. A block is closed once it holds
+// Records records or spans at least Bytes bytes, whichever comes first, and a limit of zero is
+// ignored. Sizing by bytes keeps every range fetched from storage roughly the same size.
+type BlockConfig struct {
+	Records int64
+	Bytes   int64
+	// SortKeys are the fields whose smallest and largest values are recorded on each block
+	SortKeys []string
+	// BloomFields are the fields a bloom filter is built for on each block. They're left out
+	// of the records sent for indexing, since lookups use the bloom filters instead.
+	BloomFields []string
+	BloomRate   float64
+}
+
+// NewBlockConfig reads block sizes out of a credentials map, defaulting to BLOCK_SIZE records
+func NewBlockConfig(credentials map[string]interface{}) BlockConfig {
+	config := BlockConfig{
+		Records: credentialInt(credentials, CredentialBlockRecords),
+		Bytes:   credentialInt(credentials, CredentialBlockBytes),
+
+		SortKeys:    credentialStrings(credentials, CredentialSortKeys),
+		BloomFields: credentialStrings(credentials, CredentialBloomFields),
+		BloomRate:   credentialFloat(credentials, CredentialBloomRate),
+	}
+	if config.Records <= 0 && config.Bytes <= 0 {
+		config.Records = BLOCK_SIZE
+	}
+	if config.BloomRate <= 0 || config.BloomRate >= 1 {
+		config.BloomRate = DefaultBloomFalsePositiveRate
+	}
+	return config
+}
+
+// Full returns true when a block holding records records over size bytes should be closed
+func (config BlockConfig) Full(records, size int64) bool {
+	if config.Records > 0 && records >= config.Records {
+		return true
+	}
+	return config.Bytes > 0 && size >= config.Bytes
+}
+
+// addToRanges widens the ranges of each sort key to include the record's values.
+// Records missing a key, or holding a null, object or array, are skipped.
+func (config BlockConfig) addToRanges(ranges map[string]models.KeyRange, record map[string]interface{}) {
+	for _, key := range config.SortKeys {
+		value, ok := record[key]
+		if !ok || value == nil {
+			continue
+		}
+		keyRange, ok := ranges[key]
+		if !ok {
+			if _, err := CompareValues(value, value); err == nil {
+				ranges[key] = models.KeyRange{Min: value, Max: value}
+			}
+			continue
+		}
+		if cmp, err := CompareValues(value, keyRange.Min); err == nil && cmp < 0 {
+			keyRange.Min = value
+		}
+		if cmp, err := CompareValues(value, keyRange.Max); err == nil && cmp > 0 {
+			keyRange.Max = value
+		}
+		ranges[key] = keyRange
+	}
+}
+
+// addToBlooms records the values of the record's bloom fields, removing them from the record
+func (config BlockConfig) addToBlooms(values map[string][]string, record map[string]interface{}) {
+	for _, field := range config.BloomFields {
+		value, ok := record[field]
+		if !ok {
+			continue
+		}
+		delete(record, field)
+		if key, ok := BloomKey(value); ok {
+			values[field] = append(values[field], key)
+		}
+	}
+}
+
+// CompareValues compares two json values, returning -1, 0 or 1, the way DefaultComparator does
+func CompareValues(a, b interface{}) (int, error) {
+	return DefaultComparator.Compare(a, b)
+}
+
+// PathFilter selects which files or objects under a storage path are indexed.
+// Patterns use path.Match syntax and are matched against both the full name and its base name.
+type PathFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// NewPathFilter reads include and exclude patterns out of a credentials map
+func NewPathFilter(credentials map[string]interface{}) PathFilter {
+	return PathFilter{
+		Include: credentialStrings(credentials, CredentialInclude),
+		Exclude: credentialStrings(credentials, CredentialExclude),
+	}
+}
+
+// Match returns true if one of names matches an include pattern (or there are none) and none of
+// them match an exclude pattern. Names are the ways a file can be referred to, e.g. its full
+// name and its name relative to the storage path.
+func (filter PathFilter) Match(names ...string) bool {
+	for _, pattern := range filter.Exclude {
+		for _, name := range names {
+			if matchGlob(pattern, name) {
+				return false
+			}
+		}
+	}
+	if len(filter.Include) == 0 {
+		return true
+	}
+	for _, pattern := range filter.Include {
+		for _, name := range names {
+			if matchGlob(pattern, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// InStoragePath decides whether an object in a bucket or container belongs to the dataset at prefix.
+// A prefix naming a single object selects only that object, otherwise the prefix is treated as a
+// directory. Objects are then narrowed down with the filter's include and exclude patterns.
+func InStoragePath(name, prefix string, filter PathFilter) bool {
+	inPath := prefix == "" || strings.HasSuffix(prefix, "/") || name == prefix || strings.HasPrefix(name, prefix+"/")
+	if !inPath {
+		return false
+	}
+	return filter.Match(strings.TrimPrefix(strings.TrimPrefix(name, prefix), "/"), name)
+}
+
+func matchGlob(pattern, name string) bool {
+	matched, err := path.Match(pattern, name)
+	if err == nil && matched {
+		return true
+	}
+	matched, err = path.Match(pattern, path.Base(name))
+	return err == nil && matched
+}
+
+// credentialStrings returns a list of strings from a credentials map, accepting
+// string slices or a single comma separated string
+func credentialStrings(credentials map[string]interface{}, key string) []string {
+	values := []string{}
+	switch value := credentials[key].(type) {
+	case []string:
+		values = value
+	case []interface{}:
+		for _, v := range value {
+			if str, ok := v.(string); ok {
+				values = append(values, str)
+			}
+		}
+	case string:
+		for _, str := range strings.Split(value, ",") {
+			str = strings.TrimSpace(str)
+			if str != "" {
+				values = append(values, str)
+			}
+		}
+	}
+	return values
+}
+
+// credentialString returns a string value from a credentials map, or "" if it isn't set
+func credentialString(credentials map[string]interface{}, key string) string {
+	value, ok := credentials[key].(string)
+	if !ok {
+		return ""
+	}
+	return value
+}
+
+// credentialInt returns a number from a credentials map, accepting ints, floats or numeric strings
+func credentialInt(credentials map[string]interface{}, key string) int64 {
+	switch value := credentials[key].(type) {
+	case int:
+		return int64(value)
+	case int64:
+		return value
+	case float64:
+		return int64(value)
+	case string:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err == nil {
+			return parsed
+		}
+	}
+	return 0
+}
+
+// credentialFloat returns a number from a credentials map, accepting floats, ints or numeric strings
+func credentialFloat(credentials map[string]interface{}, key string) float64 {
+	switch value := credentials[key].(type) {
+	case float64:
+		return value
+	case int:
+		return float64(value)
+	case string:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			return parsed
+		}
+	}
+	return 0
+}
 
-	RetrieveDataBlockBytes(block *models.DataBlock) ([]byte, error)
+// credentialBool returns a bool value from a credentials map, accepting bools or "true"/"false" strings
+func credentialBool(credentials map[string]interface{}, key string) bool {
+	switch value := credentials[key].(type) {
+	case bool:
+		return value
+	case string:
+		parsed, err := strconv.ParseBool(value)
+		return err == nil && parsed
+	}
+	return false
 }
 
-func GetRefKey(location string) string {
-	return fmt.Sprintf("%s-%d-%d", location, time.Now().UnixNano(), BLOCK_SIZE)
+// NewRecordScanner creates a scanner over a stream of records that tolerates records up to MaxRecordSize
+func NewRecordScanner(reader io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxRecordSize)
+	return scanner
+}
+
+// GetRefKey creates the key a data block is indexed under from its file and the offset it starts
+// at. The time keeps keys from separate scans of a file apart.
+func GetRefKey(location string, start int64) string {
+	return fmt.Sprintf("%s-%d-%d", location, time.Now().UnixNano(), start)
 }
 
 func WriteJSONToInterfaceChan(scanner *bufio.Scanner, interfaceChan chan<- interface{}) error {
@@ -44,16 +300,27 @@ func WriteJSONToInterfaceChan(scanner *bufio.Scanner, interfaceChan chan<- inter
 	return scanner.Err()
 }
 
-func WriteJSONToDataChans(path string, scanner *bufio.Scanner, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+// WriteJSONToDataChans scans jsonfiles records, sending each record and the blocks of records
+// on channels. Blocks are sized by blocks. It stops early if the context is cancelled.
+func WriteJSONToDataChans(ctx context.Context, path string, scanner *bufio.Scanner, blocks BlockConfig, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+	file := models.File{
+		Address: path,
+		Type:    "jsonfiles",
+	}
+	return WriteJSONFileToDataChans(ctx, file, scanner, blocks, dataChan, blockChan)
+}
+
+// WriteJSONFileToDataChans works like WriteJSONToDataChans, attaching file to every data block
+// so storage can record extra details like the file's version.
+func WriteJSONFileToDataChans(ctx context.Context, file models.File, scanner *bufio.Scanner, blocks BlockConfig, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+	path := file.Address
 	log.WithFields(log.Fields{
 		"objectKey": path,
 	}).Info("Starting to write data to channels")
 
 	currentPos := int64(0)
 	prevPos := int64(0)
-	fileEOF := false
 	split := func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		fileEOF = atEOF
 		advance, token, err = bufio.ScanLines(data, atEOF)
 		prevPos = currentPos
 		currentPos += int64(advance)
@@ -61,9 +328,11 @@ func WriteJSONToDataChans(path string, scanner *bufio.Scanner, dataChan chan<- m
 	}
 	scanner.Split(split)
 
-	count := 0
+	blockRecords := int64(0)
+	blockRanges := map[string]models.KeyRange{}
+	blockBloomValues := map[string][]string{}
 	currentBlockPos := int64(0)
-	refKey := GetRefKey(path)
+	refKey := GetRefKey(path, currentBlockPos)
 	for scanner.Scan() {
 		dataBytes := scanner.Bytes()
 		var marshalledData interface{}
@@ -76,37 +345,64 @@ func WriteJSONToDataChans(path string, scanner *bufio.Scanner, dataChan chan<- m
 		indexData := models.IndexData{
 			Data:   marshalledData.(map[string]interface{}),
 			RefKey: refKey,
+			Offset: prevPos,
+		}
+		indexData.Present, indexData.Null = FieldPresence(indexData.Data)
+		blocks.addToRanges(blockRanges, indexData.Data)
+		blocks.addToBlooms(blockBloomValues, indexData.Data)
+		select {
+		case dataChan <- indexData:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 
-		if (count != 0 && count%int(BLOCK_SIZE) == 0) || fileEOF {
+		// The final, partial block is sent once scanning finishes
+		blockRecords++
+		if blocks.Full(blockRecords, currentPos-currentBlockPos) {
 			dataBlock := models.DataBlock{
 				RefKey: refKey,
 				Start:  currentBlockPos,
 				End:    currentPos,
-				File: models.File{
-					Address: path,
-					Type:    "jsonfiles",
-				},
+				File:   file,
+			}
+			if len(blocks.SortKeys) > 0 {
+				dataBlock.Ranges = blockRanges
+				blockRanges = map[string]models.KeyRange{}
+			}
+			if len(blocks.BloomFields) > 0 {
+				dataBlock.Blooms = buildBlooms(blockBloomValues, blocks.BloomRate)
+				blockBloomValues = map[string][]string{}
 			}
 			currentBlockPos = currentPos
-			refKey = GetRefKey(path)
-			blockChan <- dataBlock
+			blockRecords = 0
+			refKey = GetRefKey(path, currentBlockPos)
+			select {
+			case blockChan <- dataBlock:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
-
-		count++
-		dataChan <- indexData
 	}
 
-	dataBlock := models.DataBlock{
-		RefKey: refKey,
-		Start:  currentBlockPos,
-		End:    currentPos,
-		File: models.File{
-			Address: path,
-			Type:    "jsonfiles",
-		},
+	if blockRecords > 0 {
+		dataBlock := models.DataBlock{
+			RefKey: refKey,
+			Start:  currentBlockPos,
+			End:    currentPos,
+			File:   file,
+		}
+		if len(blocks.SortKeys) > 0 {
+			dataBlock.Ranges = blockRanges
+		}
+		if len(blocks.BloomFields) > 0 {
+			dataBlock.Blooms = buildBlooms(blockBloomValues, blocks.BloomRate)
+		}
+		select {
+		case blockChan <- dataBlock:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	blockChan <- dataBlock
 
 	err := scanner.Err()
 	if err != nil {
@@ -119,12 +415,55 @@ func WriteJSONToDataChans(path string, scanner *bufio.Scanner, dataChan chan<- m
 	return err
 }
 
-func GetRecordInDataChunk(chunk []byte, searchField, searchString string) ([]byte, error) {
-	scanner := bufio.NewScanner(bytes.NewReader(chunk))
-	scanner.Split(bufio.ScanLines)
+// GetRecordInDataChunk returns the first record in a chunk where a field matches a search string,
+// with the field's values compared to it by comparator
+func GetRecordInDataChunk(chunk []byte, searchField, searchString string, comparator ValueComparator) ([]byte, error) {
+	scanner := NewRecordScanner(bytes.NewReader(chunk))
 	log.WithFields(log.Fields{
 		"searchString": searchString,
 	}).Info("Checking all fields for match with search string")
+	for scanner.Scan() {
+		rawRecord := scanner.Bytes()
+		if recordMatches(rawRecord, searchField, searchString, comparator) {
+			return rawRecord, nil
+		}
+	}
+	err := fmt.Errorf("Could not find record where '%s' == '%s' in chunk", searchField, searchString)
+	log.WithError(err).Error("Error searching data chunk")
+	return nil, err
+}
+
+// GetRecordsInDataChunk returns every record in a chunk where a field matches a search string,
+// compared the same way as GetRecordInDataChunk
+func GetRecordsInDataChunk(chunk []byte, searchField, searchString string, comparator ValueComparator) [][]byte {
+	scanner := NewRecordScanner(bytes.NewReader(chunk))
+	records := [][]byte{}
+	for scanner.Scan() {
+		rawRecord := scanner.Bytes()
+		if recordMatches(rawRecord, searchField, searchString, comparator) {
+			records = append(records, append([]byte{}, rawRecord...))
+		}
+	}
+	return records
+}
+
+// GetRecordAtOffset returns the record starting at offset in a file from the data block holding it
+func GetRecordAtOffset(chunk []byte, block *models.DataBlock, offset int64) ([]byte, error) {
+	start := offset - block.Start
+	if start < 0 || start >= int64(len(chunk)) {
+		return nil, fmt.Errorf("Offset %d is outside of data block %d-%d", offset, block.Start, block.End)
+	}
+	record := chunk[start:]
+	if end := bytes.IndexByte(record, '\n'); end >= 0 {
+		record = record[:end]
+	}
+	return bytes.TrimRight(record, "\r"), nil
+}
+
+// FilterRecordsInDataChunk returns every record in a chunk that match returns true for
+func FilterRecordsInDataChunk(chunk []byte, match func(record map[string]interface{}) bool) [][]byte {
+	scanner := NewRecordScanner(bytes.NewReader(chunk))
+	records := [][]byte{}
 	for scanner.Scan() {
 		rawRecord := scanner.Bytes()
 		var record map[string]interface{}
@@ -132,42 +471,31 @@ func GetRecordInDataChunk(chunk []byte, searchField, searchString string) ([]byt
 		if err != nil {
 			continue
 		}
-		recordString, ok := record[searchField].(string)
-		if ok && recordString == searchString {
-			return rawRecord, nil
-		}
-
-		recordInt, ok := record[searchField].(int)
-		if ok {
-			recordString = strconv.FormatInt(int64(recordInt), 10)
-			if recordString == searchString {
-				return rawRecord, nil
-			}
-		}
-		recordFloat, ok := record[searchField].(float64)
-		if ok {
-			recordString = strconv.FormatInt(int64(recordFloat), 10)
-			if recordString == searchString {
-				return rawRecord, nil
-			}
+		if match(record) {
+			records = append(records, append([]byte{}, rawRecord...))
 		}
+	}
+	return records
+}
 
-		recordBool, ok := record[searchField].(bool)
-		if ok {
-			recordString = strconv.FormatBool(recordBool)
-			if recordString == searchString {
-				return rawRecord, nil
-			}
+// recordMatches returns true if a field in a raw json record matches a search string. Nested
+// fields are dotted paths, and fields holding arrays match if any of their elements do.
+func recordMatches(rawRecord []byte, searchField, searchString string, comparator ValueComparator) bool {
+	var record map[string]interface{}
+	err := json.Unmarshal(rawRecord, &record)
+	if err != nil {
+		return false
+	}
+	for _, value := range FieldValues(record, searchField) {
+		if comparator.Matches(value, searchString) {
+			return true
 		}
 	}
-	err := fmt.Errorf("Could not find record where '%s' == '%s' in chunk", searchField, searchString)
-	log.WithError(err).Error("Error searching data chunk")
-	return nil, err
+	return false
 }
 
 func SearchRecordInDataChunk(chunk []byte, searchString string) ([]byte, error) {
-	scanner := bufio.NewScanner(bytes.NewReader(chunk))
-	scanner.Split(bufio.ScanLines)
+	scanner := NewRecordScanner(bytes.NewReader(chunk))
 	log.WithFields(log.Fields{
 		"searchString": searchString,
 	}).Info("Searching for first record  in data chunk to contain search string")
@@ -181,3 +509,34 @@ func SearchRecordInDataChunk(chunk []byte, searchString string) ([]byte, error)
 	log.WithError(err).Error("Error searching data chunk")
 	return nil, err
 }
+
+// GetRecordsInRange returns every record in a chunk where field lies between from and to, inclusive.
+// A nil bound leaves that end of the range open.
+func GetRecordsInRange(chunk []byte, field string, from, to interface{}) [][]byte {
+	scanner := NewRecordScanner(bytes.NewReader(chunk))
+	records := [][]byte{}
+	for scanner.Scan() {
+		rawRecord := scanner.Bytes()
+		var record map[string]interface{}
+		err := json.Unmarshal(rawRecord, &record)
+		if err != nil {
+			continue
+		}
+		value, ok := record[field]
+		if !ok {
+			continue
+		}
+		if from != nil {
+			if cmp, err := CompareValues(value, from); err != nil || cmp < 0 {
+				continue
+			}
+		}
+		if to != nil {
+			if cmp, err := CompareValues(value, to); err != nil || cmp > 0 {
+				continue
+			}
+		}
+		records = append(records, append([]byte{}, rawRecord...))
+	}
+	return records
+}
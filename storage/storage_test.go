@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zachgoldstein/datatoapi/models"
+)
+
+func TestNewPathFilter(t *testing.T) {
+	tests := []struct {
+		credentials map[string]interface{}
+		expected    PathFilter
+	}{
+		{credentials: map[string]interface{}{}, expected: PathFilter{Include: []string{}, Exclude: []string{}}},
+		{
+			credentials: map[string]interface{}{CredentialInclude: "*.jsonfiles, *.json,", CredentialExclude: []string{"*-backup.*"}},
+			expected:    PathFilter{Include: []string{"*.jsonfiles", "*.json"}, Exclude: []string{"*-backup.*"}},
+		},
+		{
+			credentials: map[string]interface{}{CredentialInclude: []interface{}{"*.jsonfiles", 1}},
+			expected:    PathFilter{Include: []string{"*.jsonfiles"}, Exclude: []string{}},
+		},
+	}
+	for _, test := range tests {
+		filter := NewPathFilter(test.credentials)
+		if !reflect.DeepEqual(filter, test.expected) {
+			t.Errorf("NewPathFilter(%v) = %+v, expected %+v", test.credentials, filter, test.expected)
+		}
+	}
+}
+
+func TestPathFilterMatch(t *testing.T) {
+	tests := []struct {
+		filter   PathFilter
+		name     string
+		expected bool
+	}{
+		{filter: PathFilter{}, name: "a.jsonfiles", expected: true},
+		{filter: PathFilter{Include: []string{"*.jsonfiles"}}, name: "a.jsonfiles", expected: true},
+		{filter: PathFilter{Include: []string{"*.jsonfiles"}}, name: "2020/a.jsonfiles", expected: true},
+		{filter: PathFilter{Include: []string{"*.jsonfiles"}}, name: "a.json", expected: false},
+		{filter: PathFilter{Include: []string{"2020/*"}}, name: "2020/a.json", expected: true},
+		{filter: PathFilter{Include: []string{"2020/*"}}, name: "2021/a.json", expected: false},
+		{filter: PathFilter{Exclude: []string{"*-backup.jsonfiles"}}, name: "2020/a-backup.jsonfiles", expected: false},
+		{filter: PathFilter{Include: []string{"*.jsonfiles"}, Exclude: []string{"a.*"}}, name: "a.jsonfiles", expected: false},
+		{filter: PathFilter{Include: []string{"["}}, name: "a.jsonfiles", expected: false},
+	}
+	for _, test := range tests {
+		matched := test.filter.Match(test.name)
+		if matched != test.expected {
+			t.Errorf("%+v matched %q: %t, expected %t", test.filter, test.name, matched, test.expected)
+		}
+	}
+}
+
+func TestInStoragePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefix   string
+		filter   PathFilter
+		expected bool
+	}{
+		{name: "people/a.jsonfiles", prefix: "", expected: true},
+		{name: "people/a.jsonfiles", prefix: "people/", expected: true},
+		{name: "people/a.jsonfiles", prefix: "people", expected: true},
+		{name: "people-old/a.jsonfiles", prefix: "people", expected: false},
+		{name: "people.jsonfiles", prefix: "people.jsonfiles", expected: true},
+		{name: "people.jsonfiles.bak", prefix: "people.jsonfiles", expected: false},
+		{name: "people/2020/a.jsonfiles", prefix: "people", filter: PathFilter{Include: []string{"2020/*"}}, expected: true},
+		{name: "people/2021/a.jsonfiles", prefix: "people/", filter: PathFilter{Include: []string{"2020/*"}}, expected: false},
+		{name: "people/a.jsonfiles", prefix: "people", filter: PathFilter{Include: []string{"people/*"}}, expected: true},
+		{name: "people/a.tmp", prefix: "people", filter: PathFilter{Exclude: []string{"people/*.tmp"}}, expected: false},
+		{name: "people/a.tmp", prefix: "people/", filter: PathFilter{Exclude: []string{"*.tmp"}}, expected: false},
+	}
+	for _, test := range tests {
+		inPath := InStoragePath(test.name, test.prefix, test.filter)
+		if inPath != test.expected {
+			t.Errorf("InStoragePath(%q, %q, %+v) = %t, expected %t", test.name, test.prefix, test.filter, inPath, test.expected)
+		}
+	}
+}
+
+func TestNewBlockConfig(t *testing.T) {
+	tests := []struct {
+		credentials    map[string]interface{}
+		records, bytes int64
+	}{
+		{credentials: map[string]interface{}{}, records: BLOCK_SIZE},
+		{credentials: map[string]interface{}{CredentialBlockRecords: 10}, records: 10},
+		{credentials: map[string]interface{}{CredentialBlockBytes: "1024"}, bytes: 1024},
+		{credentials: map[string]interface{}{CredentialBlockRecords: 10.0, CredentialBlockBytes: int64(1024)}, records: 10, bytes: 1024},
+	}
+	for _, test := range tests {
+		config := NewBlockConfig(test.credentials)
+		if config.Records != test.records || config.Bytes != test.bytes {
+			t.Errorf("NewBlockConfig(%v) has %d records and %d bytes, expected %d and %d", test.credentials, config.Records, config.Bytes, test.records, test.bytes)
+		}
+	}
+}
+
+func TestBlockConfigFull(t *testing.T) {
+	tests := []struct {
+		config        BlockConfig
+		records, size int64
+		full          bool
+	}{
+		{config: BlockConfig{Records: 2}, records: 1, size: 1000},
+		{config: BlockConfig{Records: 2}, records: 2, size: 10, full: true},
+		{config: BlockConfig{Bytes: 100}, records: 1000, size: 99},
+		{config: BlockConfig{Bytes: 100}, records: 1, size: 100, full: true},
+		{config: BlockConfig{Records: 2, Bytes: 100}, records: 2, size: 10, full: true},
+		{config: BlockConfig{Records: 2, Bytes: 100}, records: 1, size: 150, full: true},
+		{config: BlockConfig{Records: 2, Bytes: 100}, records: 1, size: 50},
+	}
+	for _, test := range tests {
+		if test.config.Full(test.records, test.size) != test.full {
+			t.Errorf("%+v.Full(%d, %d) = %t, expected %t", test.config, test.records, test.size, !test.full, test.full)
+		}
+	}
+}
+
+func TestWriteJSONFileToDataChansBlocks(t *testing.T) {
+	// Records are 10, 10, 30, 10 and 10 bytes long
+	data := "{\"id\": 1}\n{\"id\": 2}\n{\"id\": 3, \"name\": \"abcdefgh\"}\n{\"id\": 4}\n{\"id\": 5}\n"
+	tests := []struct {
+		name     string
+		config   BlockConfig
+		expected [][2]int64
+	}{
+		{name: "records", config: BlockConfig{Records: 2}, expected: [][2]int64{{0, 20}, {20, 60}, {60, 70}}},
+		{name: "bytes", config: BlockConfig{Bytes: 15}, expected: [][2]int64{{0, 20}, {20, 50}, {50, 70}}},
+		{name: "records first", config: BlockConfig{Records: 2, Bytes: 45}, expected: [][2]int64{{0, 20}, {20, 60}, {60, 70}}},
+		{name: "bytes first", config: BlockConfig{Records: 3, Bytes: 15}, expected: [][2]int64{{0, 20}, {20, 50}, {50, 70}}},
+		{name: "one block", config: BlockConfig{Records: 10}, expected: [][2]int64{{0, 70}}},
+	}
+	for _, test := range tests {
+		dataChan := make(chan models.IndexData, 10)
+		blockChan := make(chan models.DataBlock, 10)
+		scanner := bufio.NewScanner(strings.NewReader(data))
+		err := WriteJSONFileToDataChans(context.Background(), models.File{Address: "data.jsonfiles"}, scanner, test.config, dataChan, blockChan)
+		if err != nil {
+			t.Errorf("%s: could not write data: %s", test.name, err)
+			continue
+		}
+		close(dataChan)
+		close(blockChan)
+		if len(dataChan) != 5 {
+			t.Errorf("%s: wrote %d records, expected 5", test.name, len(dataChan))
+		}
+		blocks := [][2]int64{}
+		refKeys := map[string]bool{}
+		for block := range blockChan {
+			blocks = append(blocks, [2]int64{block.Start, block.End})
+			if refKeys[block.RefKey] {
+				t.Errorf("%s: more than one block has the key %s", test.name, block.RefKey)
+			}
+			refKeys[block.RefKey] = true
+		}
+		if !reflect.DeepEqual(blocks, test.expected) {
+			t.Errorf("%s: wrote blocks %v, expected %v", test.name, blocks, test.expected)
+		}
+	}
+}
+
+func TestAddToRanges(t *testing.T) {
+	config := BlockConfig{SortKeys: []string{"id", "name"}}
+	records := []map[string]interface{}{
+		{"id": 5.0, "name": "m"},
+		{"id": 1.0, "name": nil},
+		{"id": 9.0},
+		{"id": "10", "name": "a"},
+		{"id": []interface{}{100.0}, "name": map[string]interface{}{"first": "z"}},
+	}
+	ranges := map[string]models.KeyRange{}
+	for _, record := range records {
+		config.addToRanges(ranges, record)
+	}
+	expected := map[string]models.KeyRange{
+		"id":   {Min: 1.0, Max: 9.0},
+		"name": {Min: "a", Max: "m"},
+	}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Ranges are %v, expected %v", ranges, expected)
+	}
+}
+
+func TestGetRecordInDataChunkLongRecord(t *testing.T) {
+	// Longer than bufio.Scanner's default 64KB limit on lines
+	long := `{"id": 2, "text": "` + strings.Repeat("plumbus ", 10000) + `"}`
+	chunk := []byte(`{"id": 1}` + "\n" + long + "\n" + `{"id": 3}` + "\n")
+
+	record, err := GetRecordInDataChunk(chunk, "id", "3", DefaultComparator)
+	if err != nil || string(record) != `{"id": 3}` {
+		t.Errorf("Found %q with error %v after a long record, expected id 3", record, err)
+	}
+	record, err = GetRecordInDataChunk(chunk, "id", "2", DefaultComparator)
+	if err != nil || string(record) != long {
+		t.Errorf("Could not find the long record, got error %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ncw/swift/v2"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/zachgoldstein/datatoapi/models"
+)
+
+// SwiftSchemePrefix identifies storage paths handled by SwiftFS, in the form swift://container/prefix
+const SwiftSchemePrefix = "swift://"
+
+// Keys read from the credentials map passed to SwiftFS.Start
+const (
+	CredentialSwiftAuthURL     = "swiftAuthURL"
+	CredentialSwiftUser        = "swiftUser"
+	CredentialSwiftKey         = "swiftKey"
+	CredentialSwiftDomain      = "swiftDomain"
+	CredentialSwiftTenant      = "swiftTenant"
+	CredentialSwiftRegion      = "swiftRegion"
+	CredentialSwiftAuthVersion = "swiftAuthVersion"
+)
+
+type SwiftFS struct {
+	FSLocation string
+	Config     SwiftConfig
+	Filter     PathFilter
+	Blocks     BlockConfig
+	conn       *swift.Connection
+	container  string
+	prefix     string
+}
+
+// SwiftConfig holds the Keystone settings used to connect to OpenStack Swift.
+// Anything left empty is read from the standard OS_* environment variables.
+type SwiftConfig struct {
+	AuthURL     string
+	User        string
+	Key         string
+	Domain      string
+	Tenant      string
+	Region      string
+	AuthVersion int
+}
+
+// NewSwiftFS creates an instance of SwiftFS
+func NewSwiftFS() *SwiftFS {
+	return &SwiftFS{}
+}
+
+// NewSwiftConfig reads Swift connection settings out of a credentials map
+func NewSwiftConfig(credentials map[string]interface{}) SwiftConfig {
+	return SwiftConfig{
+		AuthURL: credentialString(credentials, CredentialSwiftAuthURL),
+		User:    credentialString(credentials, CredentialSwiftUser),
+		Key:     credentialString(credentials, CredentialSwiftKey),
+		Domain:  credentialString(credentials, CredentialSwiftDomain),
+		Tenant:  credentialString(credentials, CredentialSwiftTenant),
+		Region:  credentialString(credentials, CredentialSwiftRegion),
+
+		// Numbers decoded from json credentials are floats
+		AuthVersion: int(credentialInt(credentials, CredentialSwiftAuthVersion)),
+	}
+}
+
+// IsSwiftPath returns true for storage paths that should be served by SwiftFS
+func IsSwiftPath(storagePath string) bool {
+	return strings.HasPrefix(storagePath, SwiftSchemePrefix)
+}
+
+// getSwiftPathDetails splits a swift:// storage path into its container and object prefix
+func getSwiftPathDetails(storagePath string) (container, prefix string) {
+	path := strings.TrimPrefix(storagePath, SwiftSchemePrefix)
+	pathParts := strings.SplitN(path, "/", 2)
+	if len(pathParts) == 1 {
+		return pathParts[0], ""
+	}
+	return pathParts[0], pathParts[1]
+}
+
+func (swiftfs *SwiftFS) getConnection() (*swift.Connection, error) {
+	conn := &swift.Connection{}
+	err := conn.ApplyEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	if swiftfs.Config.AuthURL != "" {
+		conn.AuthUrl = swiftfs.Config.AuthURL
+	}
+	if swiftfs.Config.User != "" {
+		conn.UserName = swiftfs.Config.User
+	}
+	if swiftfs.Config.Key != "" {
+		conn.ApiKey = swiftfs.Config.Key
+	}
+	if swiftfs.Config.Domain != "" {
+		conn.Domain = swiftfs.Config.Domain
+	}
+	if swiftfs.Config.Tenant != "" {
+		conn.Tenant = swiftfs.Config.Tenant
+	}
+	if swiftfs.Config.Region != "" {
+		conn.Region = swiftfs.Config.Region
+	}
+	if swiftfs.Config.AuthVersion != 0 {
+		conn.AuthVersion = swiftfs.Config.AuthVersion
+	}
+	return conn, nil
+}
+
+// Start authenticates with Keystone, testing to make sure the data is accessible
+func (swiftfs *SwiftFS) Start(ctx context.Context, path string, credentials map[string]interface{}) error {
+	swiftfs.FSLocation = path
+	swiftfs.Config = NewSwiftConfig(credentials)
+	swiftfs.Filter = NewPathFilter(credentials)
+	swiftfs.Blocks = NewBlockConfig(credentials)
+
+	conn, err := swiftfs.getConnection()
+	if err != nil {
+		log.WithError(err).Error("Could not configure swift connection")
+		return err
+	}
+	log.WithFields(log.Fields{
+		"authURL": conn.AuthUrl,
+		"region":  conn.Region,
+	}).Info("Authenticating with swift")
+	err = conn.Authenticate(ctx)
+	if err != nil {
+		log.WithError(err).Error("Could not authenticate with swift")
+		return err
+	}
+
+	swiftfs.conn = conn
+	swiftfs.container, swiftfs.prefix = getSwiftPathDetails(path)
+	return swiftfs.TestData(ctx)
+}
+
+// TestData makes sure we can list objects under the storage path
+func (swiftfs *SwiftFS) TestData(ctx context.Context) error {
+	log.Info("Testing data access")
+	numObjects := 0
+	err := swiftfs.walkDataObjects(ctx, func(name string) error {
+		numObjects++
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("Could not access data")
+		return err
+	}
+	if numObjects == 0 {
+		err = fmt.Errorf("No objects found at %s", swiftfs.FSLocation)
+		log.WithError(err).Error("Could not access data")
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"numObjects": numObjects,
+	}).Info("Data is accessible")
+	return nil
+}
+
+// walkDataObjects lists objects in the container page by page, calling walkFn
+// with the name of each object that belongs to the dataset, see InStoragePath
+func (swiftfs *SwiftFS) walkDataObjects(ctx context.Context, walkFn func(name string) error) error {
+	opts := &swift.ObjectsOpts{
+		Prefix: swiftfs.prefix,
+	}
+	return swiftfs.conn.ObjectsWalk(ctx, swiftfs.container, opts, func(ctx context.Context, opts *swift.ObjectsOpts) (interface{}, error) {
+		names, err := swiftfs.conn.ObjectNames(ctx, swiftfs.container, opts)
+		if err != nil {
+			log.WithError(err).Error("Could not list objects")
+			return nil, err
+		}
+		for _, name := range names {
+			if !InStoragePath(name, swiftfs.prefix, swiftfs.Filter) {
+				continue
+			}
+			err = walkFn(name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return names, nil
+	})
+}
+
+// ScanDataBlocks streams each object under the storage path, sending records and data blocks on channels.
+// Channels are always closed when scanning stops.
+func (swiftfs *SwiftFS) ScanDataBlocks(ctx context.Context, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+	defer close(blockChan)
+	defer close(dataChan)
+
+	log.Info("Scanning swift data into channels")
+	err := swiftfs.walkDataObjects(ctx, func(name string) error {
+		return swiftfs.scanObject(ctx, name, dataChan, blockChan)
+	})
+	if err != nil {
+		log.WithError(err).Error("Could not scan objects")
+		return err
+	}
+	log.Info("Finished scanning swift data into channels")
+	return nil
+}
+
+// scanObject streams a single object into the data chans
+func (swiftfs *SwiftFS) scanObject(ctx context.Context, name string, dataChan chan<- models.IndexData, blockChan chan<- models.DataBlock) error {
+	file, _, err := swiftfs.conn.ObjectOpen(ctx, swiftfs.container, name, false, nil)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"objectKey": name,
+		}).Error("Could not download object")
+		return err
+	}
+	defer file.Close()
+
+	scanner := NewRecordScanner(file)
+	return WriteJSONToDataChans(ctx, name, scanner, swiftfs.Blocks, dataChan, blockChan)
+}
+
+// RetrieveDataBlockBytes fetches the byte range for a data block with a Range GET
+func (swiftfs *SwiftFS) RetrieveDataBlockBytes(ctx context.Context, block *models.DataBlock) ([]byte, error) {
+	headers := swift.Headers{
+		// http ranges are inclusive of the last byte
+		"Range": fmt.Sprintf("bytes=%d-%d", block.Start, block.End-1),
+	}
+	file, _, err := swiftfs.conn.ObjectOpen(ctx, swiftfs.container, block.File.Address, false, headers)
+	if err != nil {
+		log.WithError(err).Error("Could not access data")
+		return nil, err
+	}
+	defer file.Close()
+
+	bytes, err := ioutil.ReadAll(file)
+	if err != nil {
+		log.WithError(err).Error("Could read body data")
+		return nil, err
+	}
+	return bytes, nil
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ncw/swift/v2"
+	"github.com/ncw/swift/v2/swifttest"
+
+	"github.com/zachgoldstein/datatoapi/models"
+)
+
+func TestGetSwiftPathDetails(t *testing.T) {
+	tests := []struct {
+		storagePath       string
+		container, prefix string
+		isSwift           bool
+	}{
+		{storagePath: "swift://data", container: "data", isSwift: true},
+		{storagePath: "swift://data/", container: "data", isSwift: true},
+		{storagePath: "swift://data/people", container: "data", prefix: "people", isSwift: true},
+		{storagePath: "swift://data/people/2020/a.jsonfiles", container: "data", prefix: "people/2020/a.jsonfiles", isSwift: true},
+		{storagePath: "gs://data/people"},
+	}
+	for _, test := range tests {
+		if IsSwiftPath(test.storagePath) != test.isSwift {
+			t.Errorf("IsSwiftPath(%q) = %t, expected %t", test.storagePath, !test.isSwift, test.isSwift)
+		}
+		if !test.isSwift {
+			continue
+		}
+		container, prefix := getSwiftPathDetails(test.storagePath)
+		if container != test.container || prefix != test.prefix {
+			t.Errorf("getSwiftPathDetails(%q) = %q, %q, expected %q, %q", test.storagePath, container, prefix, test.container, test.prefix)
+		}
+	}
+}
+
+func TestNewSwiftConfig(t *testing.T) {
+	for _, authVersion := range []interface{}{2, float64(2), "2"} {
+		config := NewSwiftConfig(map[string]interface{}{CredentialSwiftAuthVersion: authVersion})
+		if config.AuthVersion != 2 {
+			t.Errorf("Auth version %#v was read as %d, expected 2", authVersion, config.AuthVersion)
+		}
+	}
+}
+
+func TestSwiftFS(t *testing.T) {
+	server, err := swifttest.NewSwiftServer("localhost")
+	if err != nil {
+		t.Fatalf("Could not start swift server: %s", err)
+	}
+	defer server.Close()
+
+	objects := map[string]string{
+		"people/a.jsonfiles":      "{\"id\": 1}\n{\"id\": 2}\n",
+		"people/b.jsonfiles":      "{\"id\": 3}\n",
+		"people/c.tmp":            "{\"id\": 4}\n",
+		"people/2020/d.jsonfiles": "{\"id\": 5}\n",
+		"peoplex/e.jsonfiles":     "{\"id\": 6}\n",
+	}
+	conn := &swift.Connection{UserName: swifttest.TEST_ACCOUNT, ApiKey: swifttest.TEST_ACCOUNT, AuthUrl: server.AuthURL}
+	ctx := context.Background()
+	err = conn.Authenticate(ctx)
+	if err != nil {
+		t.Fatalf("Could not authenticate with swift server: %s", err)
+	}
+	err = conn.ContainerCreate(ctx, "data", nil)
+	if err != nil {
+		t.Fatalf("Could not create container: %s", err)
+	}
+	for name, contents := range objects {
+		err = conn.ObjectPutString(ctx, "data", name, contents, "")
+		if err != nil {
+			t.Fatalf("Could not create object %s: %s", name, err)
+		}
+	}
+	credentials := map[string]interface{}{
+		CredentialSwiftAuthURL:     server.AuthURL,
+		CredentialSwiftUser:        swifttest.TEST_ACCOUNT,
+		CredentialSwiftKey:         swifttest.TEST_ACCOUNT,
+		CredentialSwiftAuthVersion: 1,
+		CredentialExclude:          "*.tmp",
+	}
+
+	swiftfs := NewSwiftFS()
+	err = swiftfs.Start(ctx, "swift://data/people", credentials)
+	if err != nil {
+		t.Fatalf("Could not start swift storage: %s", err)
+	}
+	names := []string{}
+	err = swiftfs.walkDataObjects(ctx, func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not list objects: %s", err)
+	}
+	expected := []string{"people/2020/d.jsonfiles", "people/a.jsonfiles", "people/b.jsonfiles"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("Listed %q, expected %q", names, expected)
+	}
+
+	dataChan := make(chan models.IndexData, 10)
+	blockChan := make(chan models.DataBlock, 10)
+	err = swiftfs.ScanDataBlocks(ctx, dataChan, blockChan)
+	if err != nil {
+		t.Fatalf("Could not scan objects: %s", err)
+	}
+	records := 0
+	for range dataChan {
+		records++
+	}
+	if records != 4 {
+		t.Errorf("Scanned %d records, expected 4", records)
+	}
+	for block := range blockChan {
+		data, err := swiftfs.RetrieveDataBlockBytes(ctx, &block)
+		if err != nil {
+			t.Errorf("Could not retrieve block %+v: %s", block, err)
+			continue
+		}
+		expected := objects[block.File.Address][block.Start:block.End]
+		if string(data) != expected {
+			t.Errorf("Retrieved %q for block %+v, expected %q", data, block, expected)
+		}
+	}
+
+	err = NewSwiftFS().Start(ctx, "swift://missing/people", credentials)
+	if err == nil {
+		t.Errorf("Starting with a missing container expected an error")
+	}
+}